@@ -0,0 +1,70 @@
+//go:build !solution
+
+// distbuild-gocache is GOCACHEPROG backend sharing go build cache through distbuild coordinator.
+//
+//	GOCACHEPROG="distbuild-gocache -coordinator http://coordinator:8080" go build ./...
+//
+// Outputs are kept in the local cache directory and uploaded to the coordinator filecache.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/gocache"
+)
+
+func main() {
+	var (
+		coordinator = flag.String("coordinator", os.Getenv("DISTBUILD_COORDINATOR"), "coordinator endpoint, only local cache is used if empty")
+		dir         = flag.String("dir", "", "local cache directory, distbuild-gocache in user cache directory by default")
+		verbose     = flag.Bool("v", false, "log requests")
+	)
+	flag.Parse()
+
+	if err := run(*coordinator, *dir, *verbose); err != nil {
+		fmt.Fprintf(os.Stderr, "distbuild-gocache: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(coordinator, dir string, verbose bool) error {
+	// stdout is used by the protocol, logs go to stderr
+	cfg := zap.NewDevelopmentConfig()
+	cfg.Level = zap.NewAtomicLevelAt(zapcore.WarnLevel)
+	if verbose {
+		cfg.Level = zap.NewAtomicLevelAt(zapcore.DebugLevel)
+	}
+	log, err := cfg.Build()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = log.Sync() }()
+
+	if dir == "" {
+		userCache, err := os.UserCacheDir()
+		if err != nil {
+			return err
+		}
+		dir = filepath.Join(userCache, "distbuild-gocache")
+	}
+
+	local, err := filecache.New(dir)
+	if err != nil {
+		return fmt.Errorf("error during opening local cache: %w", err)
+	}
+
+	var remote *filecache.Client
+	if coordinator != "" {
+		remote = filecache.NewClient(log.Named("filecache"), coordinator)
+	}
+
+	return gocache.New(log, local, remote).Serve(context.Background(), os.Stdin, os.Stdout)
+}
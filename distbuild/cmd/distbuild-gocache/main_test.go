@@ -0,0 +1,67 @@
+package main_test
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+)
+
+// TestGoBuild builds a package twice with different local caches, the second build gets compile results from the coordinator.
+func TestGoBuild(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go command")
+	}
+
+	tmp := t.TempDir()
+	binary := filepath.Join(tmp, "distbuild-gocache")
+	out, err := exec.Command("go", "build", "-o", binary, ".").CombinedOutput()
+	require.NoError(t, err, "%s", out)
+
+	coordinatorCache, err := filecache.New(filepath.Join(tmp, "coordinator"))
+	require.NoError(t, err)
+	mux := http.NewServeMux()
+	filecache.NewHandler(zaptest.NewLogger(t), coordinatorCache).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	module := filepath.Join(tmp, "module")
+	require.NoError(t, os.MkdirAll(module, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(module, "go.mod"), []byte("module example.com/p\n\ngo 1.24\n"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(module, "p.go"), []byte("package p\n\nfunc Answer() int { return 42 }\n"), 0o644))
+
+	goBuild := func(localDir string) string {
+		cmd := exec.Command("go", "build", "-x", ".")
+		cmd.Dir = module
+		cmd.Env = append(os.Environ(),
+			"GOCACHEPROG="+binary+" -coordinator "+server.URL+" -dir "+filepath.Join(tmp, localDir),
+			"GOCACHE="+filepath.Join(tmp, localDir+"-gocache"),
+			"GOFLAGS=",
+			"GOTOOLCHAIN=local",
+		)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		require.NoError(t, cmd.Run(), "%s", stderr.String())
+		return stderr.String()
+	}
+
+	require.Contains(t, goBuild("first"), "compile -o")
+
+	uploaded := 0
+	require.NoError(t, coordinatorCache.Range(func(build.ID) error {
+		uploaded++
+		return nil
+	}))
+	require.NotZero(t, uploaded)
+
+	require.NotContains(t, goBuild("second"), "compile -o")
+}
@@ -0,0 +1,37 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestCachedJobReplaysResult(t *testing.T) {
+	env, cancel := newEnv(t, singleWorkerConfig)
+	defer cancel()
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'a'},
+				Name: "test",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "echo PASS; echo warning >&2; echo out > {{.OutputDir}}/out.txt"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	assert.Equal(t, &JobResult{Stdout: "PASS\n", Stderr: "warning\n", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+
+	recorder = NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	assert.Equal(t, &JobResult{Stdout: "PASS\n", Stderr: "warning\n", Code: new(int), Cached: true}, recorder.Jobs[build.ID{'a'}])
+	assert.Equal(t, 1, recorder.Summary.Cached)
+	assert.Equal(t, 0, recorder.Summary.Jobs)
+}
@@ -0,0 +1,173 @@
+package disttest
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+)
+
+func TestQueuedBuilds(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &dist.Config{MaxBuilds: 1}})
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+
+	for i := 0; i < 3; i++ {
+		graph := build.Graph{
+			Jobs: []build.Job{
+				{
+					ID:   build.ID{'q', byte(i)},
+					Name: "echo",
+					Cmds: []build.Cmd{
+						{Exec: []string{"echo", fmt.Sprint(i)}},
+					},
+				},
+			},
+		}
+
+		go func() {
+			defer wg.Done()
+
+			recorder := NewRecorder()
+			if !assert.NoError(t, env.Client.Build(env.Ctx, graph, recorder)) {
+				return
+			}
+			assert.Equal(t, &JobResult{Stdout: fmt.Sprintln(i), Code: new(int)}, recorder.Jobs[graph.Jobs[0].ID])
+		}()
+	}
+
+	wg.Wait()
+}
+
+// startRecorder closes started when the build is scheduled.
+type startRecorder struct {
+	*Recorder
+	started chan struct{}
+	once    sync.Once
+}
+
+func (r *startRecorder) OnBuildProgress(progress *api.BuildProgress) error {
+	r.once.Do(func() { close(r.started) })
+	return r.Recorder.OnBuildProgress(progress)
+}
+
+func TestQueuedBuildUploadsFiles(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &dist.Config{MaxBuilds: 1}})
+	defer cancel()
+
+	sleep := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'s'},
+				Name: "sleep",
+				Cmds: []build.Cmd{{Exec: []string{"sleep", "0.5"}}},
+			},
+		},
+	}
+	cat := build.Graph{
+		SourceFiles: map[build.ID]string{{'a'}: "a.txt"},
+		Jobs: []build.Job{
+			{
+				ID:     build.ID{'c'},
+				Name:   "cat",
+				Inputs: []string{"a.txt"},
+				Cmds:   []build.Cmd{{Exec: []string{"cat", "{{.SourceDir}}/a.txt"}}},
+			},
+		},
+	}
+
+	started := &startRecorder{Recorder: NewRecorder(), started: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- env.Client.Build(env.Ctx, sleep, started)
+	}()
+	<-started.started
+
+	// build is queued before its files are uploaded, and started after they are
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, cat, recorder))
+	require.Equal(t, &JobResult{Stdout: "a\n", Code: new(int)}, recorder.Jobs[build.ID{'c'}])
+	require.NoError(t, <-done)
+}
+
+func TestUploadTimeout(t *testing.T) {
+	config := dist.Config{MaxActiveJobs: 1, UploadTimeout: 100 * time.Millisecond}
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &config})
+	defer cancel()
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'e'},
+				Name: "echo",
+				Cmds: []build.Cmd{{Exec: []string{"echo", "OK"}}},
+			},
+		},
+	}
+
+	// client never reports that the files are uploaded
+	buildClient := api.NewBuildClient(env.Logger, env.CoordinatorEndpoint)
+	_, status, err := buildClient.StartBuild(env.Ctx, &api.BuildRequest{Graph: graph})
+	require.NoError(t, err)
+	defer func() { _ = status.Close() }()
+
+	upd, err := status.Next()
+	if err != nil {
+		require.ErrorIs(t, err, io.EOF)
+	}
+	require.NotNil(t, upd.BuildFailed)
+	require.Contains(t, upd.BuildFailed.Error, "were not uploaded")
+
+	// jobs of the failed build are released
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, "OK\n", recorder.Jobs[build.ID{'e'}].Stdout)
+}
+
+func TestRejectedBuild(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &dist.Config{MaxActiveJobs: 2}})
+	defer cancel()
+
+	sleep := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'s'},
+				Name: "sleep",
+				Cmds: []build.Cmd{{Exec: []string{"sleep", "0.5"}}},
+			},
+		},
+	}
+
+	started := &startRecorder{Recorder: NewRecorder(), started: make(chan struct{})}
+	done := make(chan error)
+	go func() {
+		done <- env.Client.Build(env.Ctx, sleep, started)
+	}()
+	<-started.started
+
+	err := env.Client.Build(env.Ctx, artifactTransferGraph, NewRecorder())
+
+	var overloaded *api.OverloadedError
+	require.ErrorAs(t, err, &overloaded)
+	require.NoError(t, <-done)
+}
+
+func TestTooLargeBuild(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &dist.Config{MaxActiveJobs: 1}})
+	defer cancel()
+
+	err := env.Client.Build(env.Ctx, artifactTransferGraph, NewRecorder())
+
+	var tooLarge *api.TooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+}
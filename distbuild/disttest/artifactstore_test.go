@@ -0,0 +1,90 @@
+package disttest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+)
+
+func TestArtifactStore(t *testing.T) {
+	config := dist.Config{ArtifactStoreDir: filepath.Join(t.TempDir(), "store")}
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &config, ArtifactStore: true})
+	defer cancel()
+
+	producer := build.Job{
+		ID:   build.ID{'a'},
+		Name: "write",
+		Cmds: []build.Cmd{
+			{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+		},
+	}
+	require.NoError(t, env.Client.Build(env.Ctx, build.Graph{Jobs: []build.Job{producer}}, NewRecorder()))
+
+	dir := t.TempDir()
+	require.NoError(t, env.Client.DownloadArtifact(env.Ctx, producer.ID, dir))
+	content, err := os.ReadFile(filepath.Join(dir, "out.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "OK", string(content))
+
+	// the only worker replica is lost, the artifact is downloaded from the store
+	require.NoError(t, env.WorkerCache[0].Remove(producer.ID))
+
+	graph := build.Graph{Jobs: []build.Job{
+		producer,
+		{
+			ID:   build.ID{'b'},
+			Name: "read",
+			Cmds: []build.Cmd{
+				{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/out.txt", producer.ID)}},
+			},
+			Deps: []build.ID{producer.ID},
+		},
+	}}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, "OK", recorder.Jobs[build.ID{'b'}].Stdout)
+	require.True(t, recorder.Jobs[producer.ID].Cached)
+}
+
+func TestArtifactStoreProducerKilled(t *testing.T) {
+	producer := build.Job{
+		ID:   build.ID{'a'},
+		Name: "write",
+		Cmds: []build.Cmd{
+			{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+		},
+	}
+
+	config := dist.Config{ArtifactStoreDir: filepath.Join(t.TempDir(), "store")}
+	env, cancel := newEnv(t, &Config{
+		WorkerCount:   2,
+		Coordinator:   &config,
+		ArtifactStore: true,
+		KillAfterJob:  producer.ID,
+	})
+	defer cancel()
+
+	graph := build.Graph{Jobs: []build.Job{
+		producer,
+		{
+			ID:   build.ID{'b'},
+			Name: "read",
+			Cmds: []build.Cmd{
+				{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/out.txt", producer.ID)}},
+			},
+			Deps: []build.ID{producer.ID},
+		},
+	}}
+
+	// the producer dies right after reporting the job, the dependent gets the artifact from the store
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, "OK", recorder.Jobs[build.ID{'b'}].Stdout)
+}
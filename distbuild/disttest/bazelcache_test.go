@@ -0,0 +1,75 @@
+package disttest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+)
+
+// bazelClient makes requests of Bazel HTTP remote cache protocol.
+type bazelClient struct {
+	t        *testing.T
+	endpoint string
+}
+
+func (c *bazelClient) do(method, path string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, c.endpoint+path, bytes.NewReader(body))
+	require.NoError(c.t, err)
+
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(c.t, err)
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	require.NoError(c.t, err)
+	return rsp.StatusCode, data
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestBazelRemoteCache(t *testing.T) {
+	config := dist.Config{BazelCacheDir: filepath.Join(t.TempDir(), "bazel")}
+	env, cancel := newEnv(t, &Config{Coordinator: &config})
+	defer cancel()
+
+	bazel := &bazelClient{t: t, endpoint: "http://" + env.HTTP.Addr + "/coordinator/bazel"}
+
+	// bazel checks action cache first, then uploads outputs and the action result
+	action := sha256Hex([]byte("action"))
+	code, _ := bazel.do(http.MethodGet, "/ac/"+action, nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	output := []byte("compiled output")
+	code, _ = bazel.do(http.MethodPut, "/cas/"+sha256Hex(output), output)
+	require.Equal(t, http.StatusOK, code)
+
+	result := []byte("action result referencing " + sha256Hex(output))
+	code, _ = bazel.do(http.MethodPut, "/ac/"+action, result)
+	require.Equal(t, http.StatusOK, code)
+
+	// the next build hits the cache
+	code, data := bazel.do(http.MethodGet, "/ac/"+action, nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, result, data)
+
+	code, _ = bazel.do(http.MethodHead, "/cas/"+sha256Hex(output), nil)
+	require.Equal(t, http.StatusOK, code)
+
+	code, data = bazel.do(http.MethodGet, "/cas/"+sha256Hex(output), nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, output, data)
+
+	code, _ = bazel.do(http.MethodPut, "/cas/"+sha256Hex([]byte("other")), output)
+	require.Equal(t, http.StatusBadRequest, code)
+}
@@ -0,0 +1,54 @@
+package disttest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+func TestArtifactEviction(t *testing.T) {
+	// everything not pinned or locked is evicted before every heartbeat
+	workerConfig := worker.Config{
+		ArtifactLimits:   artifact.Limits{MaxAge: time.Nanosecond},
+		EvictionInterval: time.Nanosecond,
+	}
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Worker: &workerConfig})
+	defer cancel()
+
+	graph := build.Graph{Jobs: []build.Job{
+		{
+			ID:   build.ID{'a'},
+			Name: "write",
+			Cmds: []build.Cmd{
+				{CatTemplate: "OK", CatOutput: "{{.OutputDir}}/out.txt"},
+			},
+		},
+		{
+			ID:   build.ID{'b'},
+			Name: "read",
+			Cmds: []build.Cmd{
+				{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/out.txt", build.ID{'a'})}},
+			},
+			Deps: []build.ID{{'a'}},
+		},
+	}}
+
+	// artifact of a is pinned while b needs it
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, "OK", recorder.Jobs[build.ID{'b'}].Stdout)
+
+	// a is picked from cache by the heartbeat reporting b, so it is pinned before the worker evicts anything,
+	// while eviction of b is reported and b runs again instead of using missing artifact
+	recorder = NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Equal(t, "OK", recorder.Jobs[build.ID{'b'}].Stdout)
+	require.True(t, recorder.Jobs[build.ID{'a'}].Cached)
+	require.False(t, recorder.Jobs[build.ID{'b'}].Cached)
+}
@@ -1,9 +1,12 @@
 package disttest
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -11,6 +14,8 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"slices"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -19,6 +24,7 @@ import (
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/api"
 	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/client"
 	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
 	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
@@ -39,6 +45,9 @@ type env struct {
 	Workers     []*worker.Worker
 	WorkerCache []*artifact.Cache
 
+	// CoordinatorEndpoint is the endpoint of the coordinator API.
+	CoordinatorEndpoint string
+
 	HTTP *http.Server
 }
 
@@ -48,6 +57,19 @@ const (
 
 type Config struct {
 	WorkerCount int
+
+	// Coordinator overrides default coordinator config.
+	Coordinator *dist.Config
+
+	// Worker overrides default worker config.
+	Worker *worker.Config
+
+	// ArtifactStore makes workers upload artifacts to the coordinator, Coordinator must enable the store.
+	ArtifactStore bool
+
+	// KillAfterJob kills the worker which reports the job finished. The worker gets no jobs in that heartbeat,
+	// stops and doesn't serve its artifacts anymore.
+	KillAfterJob build.ID
 }
 
 func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
@@ -97,6 +119,7 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 	require.NoError(t, err)
 	addr := "127.0.0.1:" + port
 	coordinatorEndpoint := "http://" + addr + "/coordinator"
+	env.CoordinatorEndpoint = coordinatorEndpoint
 
 	var cancelRootContext func()
 	env.Ctx, cancelRootContext = context.WithCancel(context.Background())
@@ -109,12 +132,23 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 	coordinatorCache, err := filecache.New(filepath.Join(env.RootDir, "coordinator", "filecache"))
 	require.NoError(t, err)
 
-	env.Coordinator = dist.NewCoordinator(
-		env.Logger.Named("coordinator"),
-		coordinatorCache,
-	)
+	if config.Coordinator != nil {
+		env.Coordinator, err = dist.NewCoordinatorWithConfig(
+			env.Logger.Named("coordinator"),
+			coordinatorCache,
+			*config.Coordinator,
+		)
+		require.NoError(t, err)
+	} else {
+		env.Coordinator = dist.NewCoordinator(
+			env.Logger.Named("coordinator"),
+			coordinatorCache,
+		)
+	}
 
 	router := http.NewServeMux()
+	var workerCtxs []context.Context
+	var killWorkers []func()
 	router.Handle("/coordinator/", http.StripPrefix("/coordinator", env.Coordinator))
 
 	for i := 0; i < config.WorkerCount; i++ {
@@ -132,18 +166,43 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 		workerPrefix := fmt.Sprintf("/worker/%d", i)
 		workerID := api.WorkerID("http://" + addr + workerPrefix)
 
-		w := worker.New(
+		workerCtx, kill := context.WithCancel(env.Ctx)
+		killWorkers = append(killWorkers, kill)
+		var killed atomic.Bool
+		workerCoordinator := coordinatorEndpoint
+		if config.KillAfterJob != (build.ID{}) {
+			proxyPrefix := workerPrefix + "/proxy"
+			workerCoordinator = "http://" + addr + proxyPrefix + "/coordinator"
+			router.Handle(proxyPrefix+"/coordinator/", http.StripPrefix(proxyPrefix+"/coordinator",
+				killAfterJob(env.Coordinator, config.KillAfterJob, &killed, kill)))
+		}
+
+		var workerConfig worker.Config
+		if config.Worker != nil {
+			workerConfig = *config.Worker
+		}
+		if config.ArtifactStore {
+			workerConfig.ArtifactStore = coordinatorEndpoint
+		}
+
+		w := worker.NewWithConfig(
 			workerID,
-			coordinatorEndpoint,
+			workerCoordinator,
 			env.Logger.Named(workerName),
 			fileCache,
 			artifacts,
+			workerConfig,
 		)
 
 		env.Workers = append(env.Workers, w)
 		env.WorkerCache = append(env.WorkerCache, artifacts)
+		workerCtxs = append(workerCtxs, workerCtx)
 
-		router.Handle(workerPrefix+"/", http.StripPrefix(workerPrefix, w))
+		var workerHandler http.Handler = w
+		if config.KillAfterJob != (build.ID{}) {
+			workerHandler = unlessKilled(w, &killed)
+		}
+		router.Handle(workerPrefix+"/", http.StripPrefix(workerPrefix, workerHandler))
 	}
 
 	env.HTTP = &http.Server{
@@ -161,15 +220,15 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 		}
 	}()
 
-	for _, w := range env.Workers {
-		go func(w *worker.Worker) {
-			err := w.Run(env.Ctx)
+	for i, w := range env.Workers {
+		go func(w *worker.Worker, ctx context.Context) {
+			err := w.Run(ctx)
 			if errors.Is(err, context.Canceled) {
 				return
 			}
 
 			env.Logger.Fatal("worker stopped", zap.Error(err))
-		}(w)
+		}(w, workerCtxs[i])
 	}
 
 	go func() {
@@ -182,7 +241,13 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 	}()
 
 	return env, func() {
+		for _, kill := range killWorkers {
+			kill()
+		}
 		cancelRootContext()
+		// Connections dialed but never used are not idle for the server yet,
+		// Shutdown would wait for them for 5 seconds.
+		http.DefaultTransport.(*http.Transport).CloseIdleConnections()
 		_ = env.HTTP.Shutdown(context.Background())
 		_ = env.Logger.Sync()
 
@@ -190,6 +255,48 @@ func newEnv(t *testing.T, config *Config) (e *env, cancel func()) {
 	}
 }
 
+// killAfterJob passes worker requests to the coordinator until the worker reports the job finished.
+// The report is delivered without free slots, after that the worker is killed.
+func killAfterJob(coordinator http.Handler, id build.ID, killed *atomic.Bool, kill func()) http.Handler {
+	return unlessKilled(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/heartbeat" {
+			coordinator.ServeHTTP(w, r)
+			return
+		}
+
+		var req api.HeartbeatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if slices.ContainsFunc(req.FinishedJob, func(res api.JobResult) bool { return res.ID == id }) {
+			req.FreeSlots = 0
+			killed.Store(true)
+			defer kill()
+		}
+
+		body, err := json.Marshal(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		coordinator.ServeHTTP(w, r)
+	}), killed)
+}
+
+// unlessKilled fails requests of the killed worker.
+func unlessKilled(h http.Handler, killed *atomic.Bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if killed.Load() {
+			http.Error(w, "worker is killed", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
 func newWinFileSink(u *url.URL) (zap.Sink, error) {
 	if len(u.Opaque) > 0 {
 		// Remove leading slash left by url.Parse()
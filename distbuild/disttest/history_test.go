@@ -0,0 +1,82 @@
+package disttest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+var historyGraph = build.Graph{
+	Jobs: []build.Job{
+		{
+			ID:   build.ID{'a'},
+			Name: "a",
+			Cmds: []build.Cmd{{Exec: []string{"sleep", "0.2"}}},
+		},
+		{
+			ID:   build.ID{'b'},
+			Name: "b",
+			Deps: []build.ID{{'a'}},
+			Cmds: []build.Cmd{{Exec: []string{"sleep", "0.2"}}},
+		},
+	},
+}
+
+func TestBuildETA(t *testing.T) {
+	config := dist.Config{Scheduler: scheduler.Config{HistoryPath: filepath.Join(t.TempDir(), "history")}}
+
+	run := func() []time.Duration {
+		env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &config})
+		defer cancel()
+
+		recorder := NewRecorder()
+		require.NoError(t, env.Client.Build(env.Ctx, historyGraph, recorder))
+
+		var etas []time.Duration
+		for i, progress := range recorder.Progress {
+			require.Equal(t, i, progress.Done)
+			require.Equal(t, 2, progress.Total)
+			etas = append(etas, progress.ETA)
+		}
+		require.Len(t, etas, 2)
+		return etas
+	}
+
+	// jobs were never observed, default estimate is used
+	etas := run()
+	require.Equal(t, 2*time.Second, etas[0])
+
+	// history survives coordinator restart
+	etas = run()
+	require.Greater(t, etas[0], 300*time.Millisecond)
+	require.Less(t, etas[0], time.Second)
+	require.Less(t, etas[1], etas[0])
+}
+
+func TestBuildProgressThrottled(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1})
+	defer cancel()
+
+	var graph build.Graph
+	for i := 0; i < 300; i++ {
+		graph.Jobs = append(graph.Jobs, build.Job{
+			ID:   build.ID{'p', byte(i / 256), byte(i % 256)},
+			Name: "noop",
+		})
+	}
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	require.NotEmpty(t, recorder.Progress)
+	require.LessOrEqual(t, len(recorder.Progress), 100)
+	for _, progress := range recorder.Progress {
+		require.Zero(t, progress.Done%3)
+	}
+}
@@ -0,0 +1,20 @@
+package disttest
+
+import (
+	"os"
+	"testing"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/sandbox"
+)
+
+func TestMain(m *testing.M) {
+	// workers re-execute the test binary to start sandboxed commands
+	sandbox.Init()
+
+	// and run it as the tool of persistent worker tests
+	if os.Getenv(persistentToolEnv) != "" {
+		os.Exit(runPersistentTool(os.Args[1:]))
+	}
+
+	os.Exit(m.Run())
+}
@@ -0,0 +1,78 @@
+package disttest
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/sandbox"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+// materializationGraph checks that inputs are not symlinks. Writer tries to make its input writable
+// and corrupt it, reader must still see the original content.
+func materializationGraph() build.Graph {
+	write := "test ! -L {{.SourceDir}}/a.txt && echo out > {{.OutputDir}}/out.txt" +
+		"; chmod u+w {{.SourceDir}}/a.txt; echo corrupted > {{.SourceDir}}/a.txt; true"
+
+	return build.Graph{
+		SourceFiles: map[build.ID]string{{'a'}: "a.txt"},
+		Jobs: []build.Job{
+			{
+				ID:     build.ID{'w'},
+				Name:   "write",
+				Inputs: []string{"a.txt"},
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", write}},
+				},
+			},
+			{
+				ID:     build.ID{'r'},
+				Name:   "read",
+				Inputs: []string{"a.txt"},
+				Deps:   []build.ID{{'w'}},
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", fmt.Sprintf("test ! -L {{index .Deps %q}}/out.txt && cat {{.SourceDir}}/a.txt {{index .Deps %q}}/out.txt", build.ID{'w'}, build.ID{'w'})}},
+				},
+			},
+		},
+	}
+}
+
+func TestMaterialization(t *testing.T) {
+	for _, tc := range []struct {
+		materialization worker.Materialization
+		sandbox         bool
+	}{
+		{materialization: worker.MaterializeHardlink},
+		{materialization: worker.MaterializeCopy},
+		{materialization: worker.MaterializeBind, sandbox: true},
+	} {
+		t.Run(string(tc.materialization), func(t *testing.T) {
+			if tc.sandbox && !sandbox.Supported() {
+				t.Skip("sandbox is not supported")
+			}
+
+			tmp := t.TempDir()
+			t.Setenv("TMPDIR", tmp)
+
+			env, cancel := newEnv(t, &Config{
+				WorkerCount: 1,
+				Worker:      &worker.Config{Sandbox: tc.sandbox, Materialization: tc.materialization},
+			})
+			defer cancel()
+
+			recorder := NewRecorder()
+			require.NoError(t, env.Client.Build(env.Ctx, materializationGraph(), recorder))
+			assert.Equal(t, &JobResult{Stdout: "fooout\n", Code: new(int)}, recorder.Jobs[build.ID{'r'}])
+
+			roots, err := filepath.Glob(filepath.Join(tmp, "job*"))
+			require.NoError(t, err)
+			assert.Empty(t, roots, "execution roots must be removed")
+		})
+	}
+}
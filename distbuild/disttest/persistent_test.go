@@ -0,0 +1,103 @@
+package disttest
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/persistent"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+const persistentToolEnv = "DISTTEST_PERSISTENT_TOOL"
+
+// runPersistentTool is a compiler-style tool: it copies input file to output file and prints its pid.
+func runPersistentTool(args []string) int {
+	compile := func(args []string) (string, int) {
+		if len(args) != 2 {
+			return fmt.Sprintf("usage: tool INPUT OUTPUT, got %q\n", args), 1
+		}
+
+		content, err := os.ReadFile(args[0])
+		if err == nil {
+			err = os.WriteFile(args[1], content, 0o666)
+		}
+		if err != nil {
+			return err.Error() + "\n", 1
+		}
+		return fmt.Sprintf("pid %d\n", os.Getpid()), 0
+	}
+
+	if slices.Contains(args, persistent.Flag) {
+		err := persistent.Serve(os.Stdin, os.Stdout, func(req *persistent.WorkRequest) *persistent.WorkResponse {
+			output, code := compile(req.Arguments)
+			return &persistent.WorkResponse{Output: output, ExitCode: code}
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+
+	output, code := compile(args)
+	fmt.Print(output)
+	return code
+}
+
+func persistentGraph() build.Graph {
+	compile := func(id build.ID, input string) build.Job {
+		return build.Job{
+			ID:     id,
+			Name:   "compile " + input,
+			Inputs: []string{input},
+			Cmds: []build.Cmd{
+				{
+					Exec:       []string{os.Args[0], "{{.SourceDir}}/" + input, "{{.OutputDir}}/out"},
+					Environ:    []string{persistentToolEnv + "=1"},
+					Persistent: true,
+				},
+			},
+		}
+	}
+
+	a := compile(build.ID{'a'}, "a.txt")
+	b := compile(build.ID{'b'}, "b.txt")
+	b.Deps = []build.ID{a.ID}
+
+	return build.Graph{
+		SourceFiles: map[build.ID]string{{'A'}: "a.txt", {'B'}: "b.txt"},
+		Jobs:        []build.Job{a, b},
+	}
+}
+
+func TestPersistentWorkers(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%v", enabled), func(t *testing.T) {
+			env, cancel := newEnv(t, &Config{
+				WorkerCount: 1,
+				Worker:      &worker.Config{PersistentWorkers: enabled},
+			})
+			defer cancel()
+
+			recorder := NewRecorder()
+			require.NoError(t, env.Client.Build(env.Ctx, persistentGraph(), recorder))
+
+			a, b := recorder.Jobs[build.ID{'a'}], recorder.Jobs[build.ID{'b'}]
+			require.Equal(t, 0, *a.Code)
+			require.Equal(t, 0, *b.Code)
+			require.True(t, strings.HasPrefix(a.Stdout, "pid "))
+
+			if enabled {
+				require.Equal(t, a.Stdout, b.Stdout, "tool process must be reused")
+			} else {
+				require.NotEqual(t, a.Stdout, b.Stdout)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package disttest
 
 import (
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 )
 
@@ -10,10 +11,14 @@ type JobResult struct {
 
 	Code  *int
 	Error string
+
+	Cached bool
 }
 
 type Recorder struct {
-	Jobs map[build.ID]*JobResult
+	Jobs     map[build.ID]*JobResult
+	Summary  *api.BuildSummary
+	Progress []api.BuildProgress
 }
 
 func NewRecorder() *Recorder {
@@ -55,3 +60,18 @@ func (r *Recorder) OnJobFailed(jobID build.ID, code int, error string) error {
 	j.Error = error
 	return nil
 }
+
+func (r *Recorder) OnBuildSummary(summary *api.BuildSummary) error {
+	r.Summary = summary
+	return nil
+}
+
+func (r *Recorder) OnBuildProgress(progress *api.BuildProgress) error {
+	r.Progress = append(r.Progress, *progress)
+	return nil
+}
+
+func (r *Recorder) OnJobCached(jobID build.ID) error {
+	r.job(jobID).Cached = true
+	return nil
+}
@@ -0,0 +1,42 @@
+package disttest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/resources"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+func TestJobMemoryLimit(t *testing.T) {
+	env, cancel := newEnv(t, &Config{
+		WorkerCount: 1,
+		Worker:      &worker.Config{Limits: resources.Limits{AddressSpace: 32 << 20}},
+	})
+	defer cancel()
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, echoGraph, recorder))
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'m'},
+				Name: "allocate",
+				Cmds: []build.Cmd{
+					{Exec: []string{"awk", `BEGIN { s = "a"; while (length(s) < 50000000) s = s s; print length(s) }`}},
+				},
+			},
+		},
+	}
+
+	recorder = NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	result := recorder.Jobs[build.ID{'m'}]
+	require.NotNil(t, result)
+	assert.NotEqual(t, 0, *result.Code)
+}
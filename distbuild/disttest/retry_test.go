@@ -0,0 +1,72 @@
+package disttest
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestCrashedJobNotRetried(t *testing.T) {
+	env, cancel := newEnv(t, singleWorkerConfig)
+	defer cancel()
+
+	// first attempt crashes, the crash is deterministic and the job would succeed only if it was retried
+	marker := filepath.Join(t.TempDir(), "marker")
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:          build.ID{'r'},
+				Name:        "crash",
+				MaxAttempts: 2,
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "if [ ! -f " + marker + " ]; then touch " + marker + "; kill -SEGV $$; fi; echo OK"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	require.Len(t, recorder.Jobs, 1)
+	assert.Empty(t, recorder.Jobs[build.ID{'r'}].Stdout)
+}
+
+func TestJobFailureFailsBuild(t *testing.T) {
+	env, cancel := newEnv(t, singleWorkerConfig)
+	defer cancel()
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'f'},
+				Name: "fail",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "echo FAIL; exit 1"}},
+				},
+			},
+			{
+				ID:   build.ID{'g'},
+				Name: "dependent",
+				Deps: []build.ID{{'f'}},
+				Cmds: []build.Cmd{
+					{Exec: []string{"echo", "OK"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	// exit code is not a transient failure, job is not retried and dependent job is not run
+	require.Len(t, recorder.Jobs, 1)
+	failed := recorder.Jobs[build.ID{'f'}]
+	require.NotNil(t, failed.Code)
+	assert.Equal(t, 1, *failed.Code)
+	assert.Equal(t, "FAIL\n", failed.Stdout)
+}
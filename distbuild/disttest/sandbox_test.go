@@ -0,0 +1,107 @@
+package disttest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/sandbox"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+func newSandboxEnv(t *testing.T) (*env, func()) {
+	if !sandbox.Supported() {
+		t.Skip("sandbox is not supported")
+	}
+	return newEnv(t, &Config{WorkerCount: 1, Worker: &worker.Config{Sandbox: true}})
+}
+
+func TestSandboxDeclaredInputs(t *testing.T) {
+	env, cancel := newSandboxEnv(t)
+	defer cancel()
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, artifactTransferGraph, recorder))
+
+	assert.Len(t, recorder.Jobs, 2)
+	assert.Equal(t, &JobResult{Stdout: "OK", Code: new(int)}, recorder.Jobs[build.ID{'b'}])
+}
+
+func TestSandboxSourceFiles(t *testing.T) {
+	env, cancel := newSandboxEnv(t)
+	defer cancel()
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, sourceFilesGraph, recorder))
+
+	assert.Equal(t, &JobResult{Stdout: "foo", Stderr: "bar", Code: new(int)}, recorder.Jobs[build.ID{'a'}])
+}
+
+func TestSandboxUndeclaredInput(t *testing.T) {
+	env, cancel := newSandboxEnv(t)
+	defer cancel()
+
+	undeclared := filepath.Join(t.TempDir(), "undeclared.txt")
+	require.NoError(t, os.WriteFile(undeclared, []byte("leaked"), 0o644))
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'u'},
+				Name: "cat",
+				Cmds: []build.Cmd{
+					{Exec: []string{"cat", undeclared}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	result := recorder.Jobs[build.ID{'u'}]
+	require.NotNil(t, result)
+	assert.NotEqual(t, 0, *result.Code)
+	assert.NotContains(t, result.Stdout, "leaked")
+	assert.Contains(t, result.Stderr, "No such file or directory")
+}
+
+func TestSandboxIsolation(t *testing.T) {
+	env, cancel := newSandboxEnv(t)
+	defer cancel()
+
+	outside := t.TempDir()
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'n'},
+				Name: "network",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", "tail -n +3 /proc/net/dev | cut -d: -f1 | tr -d ' '"}},
+				},
+			},
+			{
+				ID:   build.ID{'w'},
+				Name: "write",
+				Cmds: []build.Cmd{
+					{Exec: []string{"sh", "-c", fmt.Sprintf("echo tmp > /tmp/x && echo out > {{.OutputDir}}/x && echo leak > %s/x", outside)}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	assert.Equal(t, &JobResult{Stdout: "lo\n", Code: new(int)}, recorder.Jobs[build.ID{'n'}])
+
+	result := recorder.Jobs[build.ID{'w'}]
+	require.NotNil(t, result)
+	assert.NotEqual(t, 0, *result.Code)
+	assert.NoFileExists(t, filepath.Join(outside, "x"))
+}
@@ -0,0 +1,50 @@
+package disttest
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+func TestSpeculativeExecution(t *testing.T) {
+	env, cancel := newEnv(t, &Config{
+		WorkerCount: 2,
+		Coordinator: &dist.Config{Scheduler: scheduler.Config{
+			SpeculationFactor:     2,
+			SpeculationMinRuntime: 200 * time.Millisecond,
+		}},
+	})
+	defer cancel()
+
+	// fill history of the job
+	warmup := build.Graph{Jobs: []build.Job{
+		{ID: build.ID{'s', 0}, Name: "straggler", Cmds: []build.Cmd{{Exec: []string{"echo", "OK"}}}},
+	}}
+	require.NoError(t, env.Client.Build(env.Ctx, warmup, NewRecorder()))
+
+	// first attempt hangs, duplicate started on the second worker finishes instantly
+	marker := filepath.Join(t.TempDir(), "marker")
+	graph := build.Graph{Jobs: []build.Job{
+		{
+			ID:   build.ID{'s', 1},
+			Name: "straggler",
+			Cmds: []build.Cmd{
+				{Exec: []string{"sh", "-c", "if [ ! -f " + marker + " ]; then touch " + marker + "; exec sleep 30; fi; echo OK"}},
+			},
+		},
+	}}
+
+	start := time.Now()
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	assert.Equal(t, &JobResult{Stdout: "OK\n", Code: new(int)}, recorder.Jobs[build.ID{'s', 1}])
+}
@@ -0,0 +1,63 @@
+package disttest
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+var summaryGraph = build.Graph{
+	SourceFiles: map[build.ID]string{{'a'}: "a.txt"},
+	Jobs: []build.Job{
+		{
+			ID:     build.ID{'c'},
+			Name:   "copy",
+			Inputs: []string{"a.txt"},
+			Cmds: []build.Cmd{
+				{Exec: []string{"cp", "{{.SourceDir}}/a.txt", "{{.OutputDir}}/a.txt"}},
+			},
+		},
+		{
+			ID:   build.ID{'s'},
+			Name: "sleep",
+			Deps: []build.ID{{'c'}},
+			Cmds: []build.Cmd{
+				{Exec: []string{"sleep", "0.1"}},
+				{Exec: []string{"cat", fmt.Sprintf("{{index .Deps %q}}/a.txt", build.ID{'c'})}},
+			},
+		},
+	},
+}
+
+func TestBuildSummary(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1})
+	defer cancel()
+
+	recorder := NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, summaryGraph, recorder))
+	require.Equal(t, "foo\n", recorder.Jobs[build.ID{'s'}].Stdout)
+
+	summary := recorder.Summary
+	require.NotNil(t, summary)
+	require.Equal(t, 2, summary.Jobs)
+	require.Equal(t, 0, summary.Cached)
+	require.Equal(t, 1, summary.SourceFiles.Count)
+	require.Equal(t, int64(len("foo\n")), summary.SourceFiles.Bytes)
+	require.Equal(t, 0, summary.Artifacts.Count, "artifact is produced by the same worker")
+	require.GreaterOrEqual(t, summary.Exec, 100*time.Millisecond)
+	require.Greater(t, summary.Duration, summary.Exec)
+
+	require.Len(t, summary.Slowest, 2)
+	require.Equal(t, "sleep", summary.Slowest[0].Name)
+	require.GreaterOrEqual(t, summary.Slowest[0].Duration, 100*time.Millisecond)
+
+	recorder = NewRecorder()
+	require.NoError(t, env.Client.Build(env.Ctx, summaryGraph, recorder))
+	require.Equal(t, 0, recorder.Summary.Jobs)
+	require.Equal(t, 2, recorder.Summary.Cached)
+	t.Log(recorder.Summary)
+}
@@ -0,0 +1,92 @@
+package disttest
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/dist"
+)
+
+// processAlive reports whether the process exists and is not a zombie.
+func processAlive(t *testing.T, pid string) bool {
+	stat, err := os.ReadFile(filepath.Join("/proc", pid, "stat"))
+	if os.IsNotExist(err) {
+		return false
+	}
+	require.NoError(t, err)
+
+	// state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return fields[0] != "Z"
+}
+
+func TestCommandTimeout(t *testing.T) {
+	env, cancel := newEnv(t, singleWorkerConfig)
+	defer cancel()
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'t'},
+				Name: "hang",
+				Cmds: []build.Cmd{
+					{
+						Exec:    []string{"sh", "-c", "sleep 30 & echo $! > " + pidFile + "; wait"},
+						Timeout: 200 * time.Millisecond,
+					},
+				},
+			},
+		},
+	}
+
+	start := time.Now()
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+	require.Less(t, time.Since(start), 2*time.Second)
+
+	result := recorder.Jobs[build.ID{'t'}]
+	require.NotNil(t, result)
+	assert.Equal(t, -1, *result.Code)
+	assert.Contains(t, result.Error, "command timed out after 200ms")
+
+	if runtime.GOOS == "linux" {
+		pid, err := os.ReadFile(pidFile)
+		require.NoError(t, err)
+		assert.False(t, processAlive(t, strings.TrimSpace(string(pid))), "child of the command must be killed")
+	}
+}
+
+func TestDefaultJobTimeout(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1, Coordinator: &dist.Config{JobTimeout: 200 * time.Millisecond}})
+	defer cancel()
+
+	graph := build.Graph{
+		Jobs: []build.Job{
+			{
+				ID:   build.ID{'t'},
+				Name: "hang",
+				Cmds: []build.Cmd{
+					{Exec: []string{"echo", "started"}},
+					{Exec: []string{"sleep", "30"}},
+				},
+			},
+		},
+	}
+
+	recorder := NewRecorder()
+	require.Error(t, env.Client.Build(env.Ctx, graph, recorder))
+
+	result := recorder.Jobs[build.ID{'t'}]
+	require.NotNil(t, result)
+	assert.Equal(t, "started\n", result.Stdout)
+	assert.Contains(t, result.Error, "job timed out after 200ms")
+}
@@ -0,0 +1,42 @@
+package disttest
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/client"
+	"gitlab.com/slon/shad-go/distbuild/pkg/trace"
+)
+
+func TestBuildTrace(t *testing.T) {
+	env, cancel := newEnv(t, &Config{WorkerCount: 1})
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "trace.json")
+	require.NoError(t, env.Client.BuildWithOptions(env.Ctx, summaryGraph, client.BuildOptions{TracePath: path}, NewRecorder()))
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	var tr trace.Trace
+	require.NoError(t, json.Unmarshal(content, &tr))
+
+	phases := make(map[string]map[string]bool)
+	for _, e := range tr.Events {
+		if phases[e.Phase] == nil {
+			phases[e.Phase] = make(map[string]bool)
+		}
+		phases[e.Phase][e.Name] = true
+	}
+
+	require.Equal(t, map[string]bool{"process_name": true, "thread_name": true}, phases["M"])
+	for _, name := range []string{"copy", "sleep", "download source files", "cmd 0", "cmd 1", "commit"} {
+		require.True(t, phases["X"][name], "span %q is missing", name)
+	}
+	require.True(t, phases["s"]["dep"])
+	require.True(t, phases["f"]["dep"])
+}
@@ -0,0 +1,173 @@
+//go:build !solution
+
+// Package actioncache stores results of successful jobs, so that jobs found in caches are reported
+// to clients the same way as executed ones.
+package actioncache
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+var ErrNotFound = errors.New("action result not found")
+
+// DefaultMemoryLimit bounds results kept in memory by coordinator without action cache directory.
+const DefaultMemoryLimit = 64 << 20
+
+// entryOverhead approximates memory used by the result besides its output.
+const entryOverhead = 512
+
+// Cache maps job ID, which is the digest of the job and its inputs, to the result of its execution.
+// All methods are concurrency safe.
+type Cache struct {
+	// root is the directory of stored results, empty if results are kept in memory
+	root string
+
+	mu sync.Mutex
+	// results are kept in memory in lru order, the least recently used is at the back
+	results map[build.ID]*list.Element
+	lru     *list.List
+	size    int64
+	limit   int64
+}
+
+// NewMemory returns cache keeping results in memory. The least recently used results are dropped
+// when their total size exceeds limit bytes.
+func NewMemory(limit int64) *Cache {
+	return &Cache{results: make(map[build.ID]*list.Element), lru: list.New(), limit: limit}
+}
+
+// New returns cache storing results in root directory, they survive restarts of the process.
+func New(root string) (*Cache, error) {
+	if err := os.MkdirAll(root, 0o777); err != nil {
+		return nil, err
+	}
+	return &Cache{root: root}, nil
+}
+
+// clone returns copy of res not sharing memory with it.
+func clone(res *api.JobResult) *api.JobResult {
+	copied := *res
+	copied.Stdout = slices.Clone(res.Stdout)
+	copied.Stderr = slices.Clone(res.Stderr)
+	copied.Outputs = slices.Clone(res.Outputs)
+	copied.Timings.Cmds = slices.Clone(res.Timings.Cmds)
+	if res.Error != nil {
+		msg := *res.Error
+		copied.Error = &msg
+	}
+	return &copied
+}
+
+// resultSize approximates memory used by the stored result.
+func resultSize(res *api.JobResult) int64 {
+	size := int64(entryOverhead + len(res.Stdout) + len(res.Stderr))
+	for _, o := range res.Outputs {
+		size += int64(len(o.Path)) + entryOverhead/8
+	}
+	return size
+}
+
+func (c *Cache) path(id build.ID) string {
+	return filepath.Join(c.root, id.Path()+".json")
+}
+
+// Put stores the result of the job execution. Stored result is not modified by later changes of res.
+func (c *Cache) Put(res *api.JobResult) error {
+	stored := clone(res)
+	stored.Cached = false
+	stored.Attempt = 0
+
+	if c.root != "" {
+		if err := c.write(stored); err != nil {
+			return fmt.Errorf("error during storing result of job %v: %w", res.ID, err)
+		}
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.results[res.ID]; ok {
+		c.remove(e)
+	}
+	c.results[res.ID] = c.lru.PushFront(stored)
+	c.size += resultSize(stored)
+
+	for c.size > c.limit && c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+	return nil
+}
+
+// remove drops the result kept in memory. Requires c.mu to be held.
+func (c *Cache) remove(e *list.Element) {
+	res := c.lru.Remove(e).(*api.JobResult)
+	delete(c.results, res.ID)
+	c.size -= resultSize(res)
+}
+
+func (c *Cache) write(res *api.JobResult) error {
+	content, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+
+	path := c.path(res.ID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get returns copy of the stored result of the job or ErrNotFound.
+func (c *Cache) Get(id build.ID) (*api.JobResult, error) {
+	if c.root == "" {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		e, ok := c.results[id]
+		if !ok {
+			return nil, ErrNotFound
+		}
+		c.lru.MoveToFront(e)
+		return clone(e.Value.(*api.JobResult)), nil
+	}
+
+	content, err := os.ReadFile(c.path(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored api.JobResult
+	if err := json.Unmarshal(content, &stored); err != nil {
+		return nil, fmt.Errorf("error during reading result of job %v: %w", id, err)
+	}
+	return &stored, nil
+}
@@ -0,0 +1,77 @@
+package actioncache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/actioncache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func testCache(t *testing.T, newCache func() *actioncache.Cache) {
+	c := newCache()
+
+	id := build.ID{'a'}
+	_, err := c.Get(id)
+	require.ErrorIs(t, err, actioncache.ErrNotFound)
+
+	res := &api.JobResult{
+		ID:      id,
+		Stdout:  []byte("out"),
+		Stderr:  []byte("err"),
+		Attempt: 2,
+		Timings: api.JobTimings{Cmds: []api.CmdTiming{{Wall: time.Second}}},
+		Outputs: []api.OutputFile{{Path: "a/b.txt", Size: 3, Digest: build.Digest{'d'}}},
+	}
+	require.NoError(t, c.Put(res))
+	res.Stdout[0] = 'O'
+	res.Stderr = []byte("changed")
+
+	stored, err := newCache().Get(id)
+	require.NoError(t, err)
+	require.Equal(t, "out", string(stored.Stdout))
+	require.Equal(t, "err", string(stored.Stderr))
+	require.Equal(t, 0, stored.Attempt)
+	require.Equal(t, res.Timings, stored.Timings)
+	require.Equal(t, res.Outputs, stored.Outputs)
+}
+
+func TestMemory(t *testing.T) {
+	c := actioncache.NewMemory(actioncache.DefaultMemoryLimit)
+	testCache(t, func() *actioncache.Cache { return c })
+}
+
+func TestMemoryLimit(t *testing.T) {
+	c := actioncache.NewMemory(5 << 10)
+
+	put := func(id build.ID) {
+		require.NoError(t, c.Put(&api.JobResult{ID: id, Stdout: make([]byte, 1<<10)}))
+	}
+
+	put(build.ID{'a'})
+	put(build.ID{'b'})
+	_, err := c.Get(build.ID{'a'})
+	require.NoError(t, err)
+
+	put(build.ID{'c'})
+	put(build.ID{'d'})
+
+	_, err = c.Get(build.ID{'b'})
+	require.ErrorIs(t, err, actioncache.ErrNotFound, "least recently used result is dropped")
+	for _, id := range []build.ID{{'a'}, {'c'}, {'d'}} {
+		_, err = c.Get(id)
+		require.NoError(t, err)
+	}
+}
+
+func TestDisk(t *testing.T) {
+	root := t.TempDir()
+	testCache(t, func() *actioncache.Cache {
+		c, err := actioncache.New(root)
+		require.NoError(t, err)
+		return c
+	})
+}
@@ -2,14 +2,31 @@ package api
 
 import (
 	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 )
 
 type BuildRequest struct {
 	Graph build.Graph
+
+	// User identifies the owner of the build. Workers are shared fairly between users.
+	User string
+
+	// Priority sets share of the build among concurrent builds of the same user,
+	// every priority level doubles the share. Zero is the normal priority.
+	// Values outside of [MinPriority, MaxPriority] are clamped to the range.
+	Priority int
 }
 
+const (
+	MinPriority = -10
+	MaxPriority = 10
+)
+
 type BuildStarted struct {
 	ID           build.ID
 	MissingFiles []build.ID
@@ -19,13 +36,145 @@ type StatusUpdate struct {
 	JobFinished   *JobResult
 	BuildFailed   *BuildFailed
 	BuildFinished *BuildFinished
+	BuildQueued   *BuildQueued
+	JobRetried    *JobRetried
+	BuildProgress *BuildProgress
+}
+
+// BuildProgress is sent when the build starts executing jobs and every time its job is done.
+type BuildProgress struct {
+	Done, Total int
+
+	// ETA is the estimated time left until the build is done. It is the longest chain of not finished jobs,
+	// job durations are taken from their previous executions.
+	ETA time.Duration
+}
+
+// JobRetried is sent when failed job is scheduled again.
+type JobRetried struct {
+	ID build.ID
+
+	// Attempt is the number of the failed attempt.
+	Attempt int
+	// Cause describes the failure.
+	Cause string
+}
+
+// BuildQueued is sent when the build waits for other builds to finish before its jobs are scheduled.
+type BuildQueued struct {
+	// Position is the number of builds ahead in the queue.
+	Position int
+}
+
+// OverloadedError is returned by StartBuild when coordinator can't accept more builds.
+type OverloadedError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e *OverloadedError) Error() string {
+	return fmt.Sprintf("coordinator is overloaded: %s; retry after %v", e.Reason, e.RetryAfter)
+}
+
+// TooLargeError is returned by StartBuild when the build exceeds coordinator limits and can't be accepted
+// even when the coordinator is idle.
+type TooLargeError struct {
+	Reason string
+}
+
+func (e *TooLargeError) Error() string {
+	return fmt.Sprintf("build is too large: %s", e.Reason)
 }
 
 type BuildFailed struct {
 	Error string
+
+	Summary BuildSummary
 }
 
 type BuildFinished struct {
+	Summary BuildSummary
+}
+
+// slowestJobs is the number of jobs listed in BuildSummary.
+const slowestJobs = 5
+
+// BuildSummary aggregates timings of the build jobs, including failed attempts.
+type BuildSummary struct {
+	// Duration is the time from the build start till its end, Upload is the part of it spent uploading source files.
+	Duration, Upload time.Duration
+
+	// Jobs is the number of executed attempts, Cached is the number of jobs which results were found in caches.
+	Jobs, Cached int
+
+	// Queue is the total time jobs waited for workers.
+	Queue time.Duration
+
+	SourceFiles, Artifacts Transfer
+
+	// Exec is the total wall time of commands, CPU is their total CPU time.
+	Exec, CPU time.Duration
+
+	Commit time.Duration
+
+	// Slowest lists the longest executed jobs.
+	Slowest []JobSummary
+}
+
+type JobSummary struct {
+	ID       build.ID
+	Name     string
+	Duration time.Duration
+}
+
+// AddJob accounts result of the job attempt.
+func (s *BuildSummary) AddJob(name string, res *JobResult) {
+	if res.Cached {
+		s.Cached++
+		return
+	}
+	t := &res.Timings
+
+	s.Jobs++
+	if !t.Queued.IsZero() && !t.Assigned.IsZero() {
+		s.Queue += t.Assigned.Sub(t.Queued)
+	}
+	s.SourceFiles.Add(t.SourceFiles)
+	s.Artifacts.Add(t.Artifacts)
+	for _, cmd := range t.Cmds {
+		s.Exec += cmd.Wall
+		s.CPU += cmd.CPU
+	}
+	s.Commit += t.Commit
+
+	job := JobSummary{ID: res.ID, Name: name, Duration: t.Finished.Sub(t.Started)}
+	i := slices.IndexFunc(s.Slowest, func(other JobSummary) bool { return other.Duration < job.Duration })
+	if i == -1 {
+		i = len(s.Slowest)
+	}
+	if i < slowestJobs {
+		s.Slowest = slices.Insert(s.Slowest, i, job)
+		s.Slowest = s.Slowest[:min(len(s.Slowest), slowestJobs)]
+	}
+}
+
+// String formats the summary for humans.
+func (s *BuildSummary) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "build took %v, %d jobs executed, %d cached\n", s.Duration, s.Jobs, s.Cached)
+	fmt.Fprintf(&b, "  upload:       %v\n", s.Upload)
+	fmt.Fprintf(&b, "  queue:        %v\n", s.Queue)
+	fmt.Fprintf(&b, "  source files: %v, %d files, %d bytes\n", s.SourceFiles.Duration, s.SourceFiles.Count, s.SourceFiles.Bytes)
+	fmt.Fprintf(&b, "  artifacts:    %v, %d artifacts, %d bytes\n", s.Artifacts.Duration, s.Artifacts.Count, s.Artifacts.Bytes)
+	fmt.Fprintf(&b, "  exec:         %v, cpu %v\n", s.Exec, s.CPU)
+	fmt.Fprintf(&b, "  commit:       %v\n", s.Commit)
+	if len(s.Slowest) != 0 {
+		fmt.Fprintf(&b, "slowest jobs:\n")
+		for _, job := range s.Slowest {
+			fmt.Fprintf(&b, "  %v %s (%v)\n", job.Duration, job.Name, job.ID)
+		}
+	}
+	return b.String()
 }
 
 type UploadDone struct{}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 
 	"go.uber.org/zap"
@@ -90,6 +91,17 @@ func (c *BuildClient) StartBuild(ctx context.Context, request *BuildRequest) (*B
 
 		c.logger.Error("start build request failed", zap.Int("status_code", resp.StatusCode), zap.String("error", errText))
 
+		if resp.StatusCode == http.StatusTooManyRequests {
+			retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			return nil, nil, &OverloadedError{
+				Reason:     resp.Header.Get("X-Overload-Reason"),
+				RetryAfter: time.Duration(retryAfter) * time.Second,
+			}
+		}
+		if resp.StatusCode == http.StatusRequestEntityTooLarge {
+			return nil, nil, &TooLargeError{Reason: resp.Header.Get("X-Reject-Reason")}
+		}
+
 		return nil, nil, errors.New(errText)
 	}
 
@@ -152,3 +164,26 @@ func (c *BuildClient) SignalBuild(ctx context.Context, buildID build.ID, signal
 
 	return &signalResp, nil
 }
+
+// Trace returns timeline of the build in Chrome trace event format.
+func (c *BuildClient) Trace(ctx context.Context, buildID build.ID) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/builds/"+buildID.String()+"/trace", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error during making trace request: %w", err)
+	}
+
+	resp, err := c.httpc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error during reading trace: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("trace request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
@@ -7,7 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"sync/atomic"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
@@ -119,12 +121,29 @@ func (h *BuildHandler) Register(mux *http.ServeMux) {
 				// statusWriter was not opened, return error from handler
 				h.l.Error("StartBuild returned error", zap.Error(err))
 
+				var overloaded *OverloadedError
+				if errors.As(err, &overloaded) {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(overloaded.RetryAfter.Seconds()))))
+					w.Header().Set("X-Overload-Reason", overloaded.Reason)
+					http.Error(w, fmt.Sprintf("%q\n", err.Error()), http.StatusTooManyRequests)
+					rc.Flush()
+					return
+				}
+
+				var tooLarge *TooLargeError
+				if errors.As(err, &tooLarge) {
+					w.Header().Set("X-Reject-Reason", tooLarge.Reason)
+					http.Error(w, fmt.Sprintf("%q\n", err.Error()), http.StatusRequestEntityTooLarge)
+					rc.Flush()
+					return
+				}
+
 				http.Error(w, fmt.Sprintf("%q\n", err.Error()), http.StatusInternalServerError)
 				rc.Flush()
 				return
 			} else {
 				// statusWriter opened, send error as update status
-				updErr := sw.Updated(&StatusUpdate{nil, &BuildFailed{err.Error()}, nil})
+				updErr := sw.Updated(&StatusUpdate{BuildFailed: &BuildFailed{Error: err.Error()}})
 				if updErr != nil {
 					errMessage := fmt.Sprintf("error during updating status BuildFailed: %v", updErr)
 					h.l.Error(errMessage)
@@ -2,11 +2,13 @@ package api_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/require"
@@ -160,3 +162,76 @@ func TestBuildResultsStreaming(t *testing.T) {
 	defer r.Close()
 	require.Equal(t, started, rsp)
 }
+
+func TestBuildOverloaded(t *testing.T) {
+	env, stop := newEnv(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	env.mock.EXPECT().StartBuild(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(fmt.Errorf("start build: %w", &api.OverloadedError{Reason: "too many jobs", RetryAfter: 1500 * time.Millisecond}))
+
+	_, _, err := env.client.StartBuild(ctx, &api.BuildRequest{})
+
+	var overloaded *api.OverloadedError
+	require.ErrorAs(t, err, &overloaded)
+	require.Equal(t, "too many jobs", overloaded.Reason)
+	require.Equal(t, 2*time.Second, overloaded.RetryAfter)
+}
+
+func TestBuildTooLarge(t *testing.T) {
+	env, stop := newEnv(t)
+	defer stop()
+
+	ctx := context.Background()
+
+	env.mock.EXPECT().StartBuild(gomock.Any(), gomock.Any(), gomock.Any()).
+		Return(fmt.Errorf("start build: %w", &api.TooLargeError{Reason: "too many jobs"}))
+
+	_, _, err := env.client.StartBuild(ctx, &api.BuildRequest{})
+
+	var tooLarge *api.TooLargeError
+	require.ErrorAs(t, err, &tooLarge)
+	require.Equal(t, "too many jobs", tooLarge.Reason)
+
+	var overloaded *api.OverloadedError
+	require.False(t, errors.As(err, &overloaded))
+}
+
+func TestBuildSummary(t *testing.T) {
+	start := time.Now()
+	result := func(id byte, duration time.Duration) *api.JobResult {
+		return &api.JobResult{
+			ID: build.ID{id},
+			Timings: api.JobTimings{
+				Queued:      start,
+				Assigned:    start.Add(time.Second),
+				Started:     start,
+				Finished:    start.Add(duration),
+				SourceFiles: api.Transfer{Count: 1, Bytes: 10, Duration: time.Millisecond},
+				Cmds:        []api.CmdTiming{{Wall: duration, CPU: duration / 2}},
+			},
+		}
+	}
+
+	var summary api.BuildSummary
+	for i := range 7 {
+		summary.AddJob(fmt.Sprint("job", i), result(byte(i), time.Duration(i%4)*time.Second))
+	}
+	summary.AddJob("cached", &api.JobResult{ID: build.ID{'c'}, Cached: true, Timings: result('c', time.Second).Timings})
+
+	require.Equal(t, 7, summary.Jobs)
+	require.Equal(t, 1, summary.Cached)
+	require.Equal(t, 7*time.Second, summary.Queue)
+	require.Equal(t, api.Transfer{Count: 7, Bytes: 70, Duration: 7 * time.Millisecond}, summary.SourceFiles)
+	require.Equal(t, 9*time.Second, summary.Exec)
+	require.Equal(t, 9*time.Second/2, summary.CPU)
+
+	var slowest []string
+	for _, job := range summary.Slowest {
+		slowest = append(slowest, fmt.Sprint(job.Name, " ", job.Duration))
+	}
+	require.Equal(t, []string{"job3 3s", "job2 2s", "job6 2s", "job1 1s", "job5 1s"}, slowest)
+	require.Contains(t, summary.String(), "7 jobs executed, 1 cached")
+}
@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 )
@@ -19,10 +20,87 @@ type JobResult struct {
 	// Если Error == nil, значит джоб завершился успешно.
 	Error *string
 
+	// Transient выставляется, если джоб упал из-за инфраструктуры (не удалось скачать артефакт,
+	// процесс убит OOM killer-ом из-за нехватки памяти на хосте) и может завершиться успешно при повторе.
+	Transient bool
+
+	// TimedOut выставляется, если джоб был убит из-за превышения таймаута джоба или команды.
+	TimedOut bool
+
+	// PeakMemory задаёт максимальный объём памяти в байтах, который использовали команды джоба.
+	PeakMemory int64
+
+	// CPUTime задаёт суммарное процессорное время команд джоба.
+	CPUTime time.Duration
+
+	// OOMKilled выставляется, если процесс джоба был убит OOM killer-ом, потому что джоб превысил
+	// свой лимит памяти или на хосте закончилась память.
+	OOMKilled bool
+
+	// Attempt задаёт номер попытки, начиная с 1. Заполняется координатором.
+	Attempt int
+
+	// Timings описывает, на что было потрачено время джоба.
+	Timings JobTimings
+
+	// Outputs перечисляет файлы артефакта джоба.
+	Outputs []OutputFile
+
+	// Cached выставляется, если джоб не выполнялся, потому что его артефакт нашёлся в кеше.
+	// В этом случае воспроизводится результат выполнения, которое создало артефакт.
+	Cached bool
+
 	// id билда для которого выполнена эта джоба (или взят из кэша результат)
 	buildID build.ID
 }
 
+// OutputFile описывает файл артефакта джоба.
+type OutputFile struct {
+	// Path задаётся относительно корня артефакта.
+	Path       string
+	Size       int64
+	Executable bool
+	// Digest задаёт sha256 содержимого файла, такой же, как в манифесте артефакта.
+	Digest build.Digest
+}
+
+// JobTimings описывает этапы выполнения джоба. Queued и Assigned выставляет координатор,
+// остальные поля измеряет воркер, поэтому разница между их временными метками неточна.
+type JobTimings struct {
+	// Queued задаёт момент передачи джоба в планировщик, Assigned - момент отправки джоба воркеру.
+	Queued, Assigned time.Time
+	// Started и Finished задают начало и конец выполнения джоба на воркере.
+	Started, Finished time.Time
+
+	// SourceFiles и Artifacts описывают входы, скачанные воркером. Входы, найденные в его кешах, не учитываются.
+	SourceFiles Transfer
+	Artifacts   Transfer
+
+	// Cmds перечисляет запущенные команды джоба.
+	Cmds []CmdTiming
+
+	// Commit задаёт время, потраченное на коммит артефакта в кеш воркера.
+	Commit time.Duration
+}
+
+// Transfer описывает скачанные данные.
+type Transfer struct {
+	Count    int
+	Bytes    int64
+	Duration time.Duration
+}
+
+func (t *Transfer) Add(other Transfer) {
+	t.Count += other.Count
+	t.Bytes += other.Bytes
+	t.Duration += other.Duration
+}
+
+type CmdTiming struct {
+	Wall time.Duration
+	CPU  time.Duration
+}
+
 type WorkerID string
 
 func (w WorkerID) String() string {
@@ -50,6 +128,18 @@ type HeartbeatRequest struct {
 
 	// AddedArtifacts говорит, какие артефакты появились в кеше на этой итерации цикла.
 	AddedArtifacts []build.ID
+
+	// StoredArtifacts перечисляет артефакты, загруженные в хранилище артефактов на этой итерации цикла.
+	StoredArtifacts []build.ID
+	// ArtifactStore задаёт endpoint хранилища артефактов, выставляется вместе со StoredArtifacts.
+	ArtifactStore WorkerID
+
+	// RemovedArtifacts перечисляет артефакты, вытесненные из кеша на этой итерации цикла.
+	RemovedArtifacts []build.ID
+
+	// PinsVersion задаёт версию закреплённых артефактов из последнего ответа координатора.
+	// Ноль означает, что воркер ещё не получал закреплённых артефактов.
+	PinsVersion int64
 }
 
 // JobSpec описывает джоб, который нужно запустить.
@@ -60,14 +150,36 @@ type JobSpec struct {
 	// Artifacts задаёт воркеров, с которых можно скачать артефакты необходимые этому джобу.
 	Artifacts map[build.ID]WorkerID
 
+	// ArtifactReplicas перечисляет других воркеров, у которых есть копия артефакта.
+	// Они используются, если не удалось скачать артефакт с воркера из Artifacts.
+	ArtifactReplicas map[build.ID][]WorkerID
+
 	build.Job
 
+	// Queued и Assigned копируются в тайминги результата джоба.
+	Queued, Assigned time.Time
+
 	// id билда для которого мы выполняем эту джобу
 	buildID build.ID
 }
 
 type HeartbeatResponse struct {
 	JobsToRun map[build.ID]JobSpec
+
+	// CancelJobs перечисляет выполняющиеся джобы, которые воркер должен остановить, потому что их дубликат
+	// завершился раньше.
+	CancelJobs []build.ID
+
+	// PinnedArtifacts перечисляет артефакты, ставшие нужными выполняющимся билдам после PinsVersion из запроса.
+	// Воркер не должен их вытеснять.
+	PinnedArtifacts []build.ID
+	// UnpinnedArtifacts перечисляет артефакты, переставшие быть нужными после PinsVersion из запроса.
+	UnpinnedArtifacts []build.ID
+	// ResetPins означает, что PinnedArtifacts перечисляет все нужные артефакты, а остальные артефакты
+	// больше не закреплены.
+	ResetPins bool
+	// PinsVersion задаёт версию закреплённых артефактов, которую воркер присылает в следующем запросе.
+	PinsVersion int64
 }
 
 type HeartbeatService interface {
@@ -1,15 +1,19 @@
+//go:build !solution
+
 package artifact
 
 import (
-	"encoding/hex"
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
 )
 
 var (
@@ -19,43 +23,76 @@ var (
 	ErrReadLocked  = errors.New("artifact is locked for read")
 )
 
+// Cache gives access to artifacts of the store as local directories and locks them for reading and writing.
+// Artifacts of stores which are not DirStore are streamed and kept in local copies under root.
+//
+// Manifest of the artifact is computed on commit and kept under root next to the store.
 type Cache struct {
-	tmpDir   string
-	cacheDir string
+	store Store
+	dirs  DirStore
+
+	tmpDir      string
+	copyDir     string
+	manifestDir string
+	// quarantineDir keeps artifacts which failed Fsck
+	quarantineDir string
 
 	mu          sync.Mutex
 	writeLocked map[build.ID]struct{}
 	readLocked  map[build.ID]int
+
+	// sizes of artifacts are loaded from the store by the first eviction
+	sizes map[build.ID]int64
+	// accessed is the last time the artifact was committed or read
+	accessed map[build.ID]time.Time
+	// pinned artifacts are not evicted
+	pinned map[build.ID]int
 }
 
+// NewCache creates cache keeping artifacts in DiskStore at root.
 func NewCache(root string) (*Cache, error) {
-	tmpDir := filepath.Join(root, "tmp")
-
-	if err := os.RemoveAll(tmpDir); err != nil {
+	store, err := NewDiskStore(root)
+	if err != nil {
 		return nil, err
 	}
-	if err := os.MkdirAll(tmpDir, 0777); err != nil {
-		return nil, err
+	return NewCacheWithStore(root, store)
+}
+
+// NewCacheWithStore creates cache on top of the store. Root keeps manifests of artifacts and their
+// local copies if store is not DirStore.
+func NewCacheWithStore(root string, store Store) (*Cache, error) {
+	c := &Cache{
+		store:         store,
+		manifestDir:   filepath.Join(root, "manifest"),
+		quarantineDir: filepath.Join(root, "quarantine"),
+		writeLocked:   make(map[build.ID]struct{}),
+		readLocked:    make(map[build.ID]int),
+		accessed:      make(map[build.ID]time.Time),
+		pinned:        make(map[build.ID]int),
+	}
+	for _, dir := range []string{c.manifestDir, c.quarantineDir} {
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
 	}
 
-	cacheDir := filepath.Join(root, "c")
-	if err := os.MkdirAll(cacheDir, 0777); err != nil {
-		return nil, err
+	if dirs, ok := store.(DirStore); ok {
+		c.dirs = dirs
+		return c, nil
 	}
 
-	for i := 0; i < 256; i++ {
-		d := hex.EncodeToString([]byte{uint8(i)})
-		if err := os.MkdirAll(filepath.Join(cacheDir, d), 0777); err != nil {
+	c.tmpDir = filepath.Join(root, "tmp")
+	c.copyDir = filepath.Join(root, "copy")
+	// copies may be left from the store used before
+	for _, dir := range []string{c.tmpDir, c.copyDir} {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(dir, 0777); err != nil {
 			return nil, err
 		}
 	}
-
-	return &Cache{
-		tmpDir:      tmpDir,
-		cacheDir:    cacheDir,
-		writeLocked: make(map[build.ID]struct{}),
-		readLocked:  make(map[build.ID]int),
-	}, nil
+	return c, nil
 }
 
 func (c *Cache) readLock(id build.ID) error {
@@ -80,17 +117,21 @@ func (c *Cache) readUnlock(id build.ID) {
 	}
 }
 
+// writeLock locks the artifact for Create or for removal. Existence of the artifact is checked before
+// the lock is taken, artifact committed concurrently is detected by the commit.
 func (c *Cache) writeLock(id build.ID, remove bool) error {
+	if !remove {
+		exists, err := c.store.Exists(context.Background(), id)
+		if err != nil {
+			return err
+		} else if exists {
+			return ErrExists
+		}
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	_, err := os.Stat(filepath.Join(c.cacheDir, id.Path()))
-	if !os.IsNotExist(err) && err != nil {
-		return err
-	} else if err == nil && !remove {
-		return ErrExists
-	}
-
 	if _, ok := c.writeLocked[id]; ok {
 		return ErrWriteLocked
 	}
@@ -110,48 +151,70 @@ func (c *Cache) writeUnlock(id build.ID) {
 }
 
 func (c *Cache) Range(artifactFn func(artifact build.ID) error) error {
-	shards, err := ioutil.ReadDir(c.cacheDir)
-	if err != nil {
+	return c.store.Range(artifactFn)
+}
+
+func (c *Cache) Stat(ctx context.Context, artifact build.ID) (Info, error) {
+	return c.store.Stat(ctx, artifact)
+}
+
+func (c *Cache) Remove(artifact build.ID) error {
+	if err := c.writeLock(artifact, true); err != nil {
 		return err
 	}
+	defer c.writeUnlock(artifact)
 
-	for _, shard := range shards {
-		dirs, err := ioutil.ReadDir(filepath.Join(c.cacheDir, shard.Name()))
-		if err != nil {
-			return err
-		}
+	return c.remove(artifact)
+}
 
-		for _, d := range dirs {
-			var id build.ID
-			if err := id.UnmarshalText([]byte(d.Name())); err != nil {
-				return fmt.Errorf("invalid artifact name: %w", err)
-			}
+// remove deletes write locked artifact.
+func (c *Cache) remove(artifact build.ID) error {
+	if err := c.store.Remove(artifact); err != nil {
+		return err
+	}
+	c.forget(artifact)
 
-			if err := artifactFn(id); err != nil {
-				return err
-			}
-		}
+	if err := os.Remove(c.manifestPath(artifact)); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 
+	if c.dirs == nil {
+		return os.RemoveAll(filepath.Join(c.copyDir, artifact.String()))
+	}
 	return nil
 }
 
-func (c *Cache) Remove(artifact build.ID) error {
-	if err := c.writeLock(artifact, true); err != nil {
-		return err
+// Create returns directory where the artifact is prepared. Commit computes manifest of the directory
+// and makes the artifact visible.
+func (c *Cache) Create(artifact build.ID) (path string, commit, abort func() error, err error) {
+	path, commitManifest, abort, err := c.create(artifact)
+	if err != nil {
+		return
 	}
-	defer c.writeUnlock(artifact)
 
-	return os.RemoveAll(filepath.Join(c.cacheDir, artifact.Path()))
+	commit = func() error {
+		m, err := ComputeManifest(path)
+		if err != nil {
+			_ = abort()
+			return err
+		}
+		return commitManifest(m)
+	}
+	return
 }
 
-func (c *Cache) Create(artifact build.ID) (path string, commit, abort func() error, err error) {
+// create is Create which commit takes manifest of the directory computed by the caller.
+func (c *Cache) create(artifact build.ID) (path string, commit func(m *Manifest) error, abort func() error, err error) {
 	if err = c.writeLock(artifact, false); err != nil {
 		return
 	}
 
-	path = filepath.Join(c.tmpDir, artifact.String())
-	if err = os.MkdirAll(path, 0777); err != nil {
+	if c.dirs != nil {
+		path, err = c.dirs.TempDir(artifact)
+	} else {
+		path, err = os.MkdirTemp(c.tmpDir, artifact.String())
+	}
+	if err != nil {
 		c.writeUnlock(artifact)
 		return
 	}
@@ -161,31 +224,151 @@ func (c *Cache) Create(artifact build.ID) (path string, commit, abort func() err
 		return os.RemoveAll(path)
 	}
 
-	commit = func() error {
+	commit = func(m *Manifest) error {
 		defer c.writeUnlock(artifact)
-		return os.Rename(path, filepath.Join(c.cacheDir, artifact.Path()))
+
+		if c.dirs != nil {
+			if err := c.dirs.Commit(artifact, path); err != nil {
+				return err
+			}
+		} else {
+			if err := c.upload(artifact, path); err != nil {
+				_ = os.RemoveAll(path)
+				return err
+			}
+			c.keepCopy(artifact, path)
+		}
+		if err := c.writeManifest(artifact, m); err != nil {
+			return fmt.Errorf("error during writing manifest of artifact %v: %w", artifact, err)
+		}
+		c.added(artifact)
+		return nil
 	}
 
 	return
 }
 
+// upload streams the artifact from dir to the store.
+func (c *Cache) upload(artifact build.ID, dir string) error {
+	w, err := c.store.Create(artifact)
+	if err != nil {
+		return err
+	}
+	if err := tarstream.Send(dir, w); err != nil {
+		return errors.Join(err, w.Abort())
+	}
+	return w.Close()
+}
+
+// keepCopy moves dir to local copies of artifacts, it is removed if a copy exists already.
+func (c *Cache) keepCopy(artifact build.ID, dir string) string {
+	dst := filepath.Join(c.copyDir, artifact.String())
+	if err := os.Rename(dir, dst); err != nil {
+		_ = os.RemoveAll(dir)
+	}
+	return dst
+}
+
+// fetch makes local copy of the artifact from the store.
+func (c *Cache) fetch(artifact build.ID) (string, error) {
+	path := filepath.Join(c.copyDir, artifact.String())
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+
+	r, err := c.store.Get(artifact)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	dir, err := os.MkdirTemp(c.tmpDir, artifact.String())
+	if err != nil {
+		return "", err
+	}
+	m, err := receive(dir, r)
+	if err == nil {
+		err = c.verify(artifact, m)
+	}
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return "", fmt.Errorf("error during receiving artifact %v from store: %w", artifact, err)
+	}
+	return c.keepCopy(artifact, dir), nil
+}
+
 func (c *Cache) Get(artifact build.ID) (path string, unlock func(), err error) {
 	if err = c.readLock(artifact); err != nil {
 		return
 	}
 
-	path = filepath.Join(c.cacheDir, artifact.Path())
-	if _, err = os.Stat(path); err != nil {
-		c.readUnlock(artifact)
-
+	if c.dirs != nil {
+		path = c.dirs.Dir(artifact)
+		_, err = os.Stat(path)
 		if os.IsNotExist(err) {
 			err = ErrNotFound
 		}
+	} else {
+		path, err = c.fetch(artifact)
+	}
+	if err != nil {
+		c.readUnlock(artifact)
 		return
 	}
 
+	c.touch(artifact)
 	unlock = func() {
 		c.readUnlock(artifact)
 	}
 	return
 }
+
+func (c *Cache) manifestPath(artifact build.ID) string {
+	return filepath.Join(c.manifestDir, artifact.String()+".json")
+}
+
+// writeManifest atomically replaces manifest of the artifact.
+func (c *Cache) writeManifest(artifact build.ID, m *Manifest) error {
+	f, err := os.CreateTemp(c.manifestDir, artifact.String())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	err = json.NewEncoder(f).Encode(m)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.manifestPath(artifact))
+}
+
+// Manifest returns manifest computed when the artifact was committed. ErrNotFound is returned
+// if the artifact was committed before manifests were introduced.
+func (c *Cache) Manifest(artifact build.ID) (*Manifest, error) {
+	data, err := os.ReadFile(c.manifestPath(artifact))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("error during decoding manifest of artifact %v: %w", artifact, err)
+	}
+	return &m, nil
+}
+
+// verify checks the artifact received from the store against its manifest if there is one.
+func (c *Cache) verify(artifact build.ID, m *Manifest) error {
+	expected, err := c.Manifest(artifact)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return checkRoot(artifact, &expected.Root, m)
+}
@@ -97,3 +97,26 @@ func TestArtifactExists(t *testing.T) {
 	_, _, _, err = c.Create(idA)
 	require.Truef(t, errors.Is(err, artifact.ErrExists), "%v", err)
 }
+
+func TestDuplicateCommit(t *testing.T) {
+	c := newTestCache(t)
+
+	// another cache instance over the same directory, e.g. left by restarted worker
+	other, err := artifact.NewCache(c.tmpDir)
+	require.NoError(t, err)
+
+	idA := build.ID{'a'}
+
+	_, commit, _, err := c.Create(idA)
+	require.NoError(t, err)
+	_, otherCommit, _, err := other.Create(idA)
+	require.NoError(t, err)
+
+	require.NoError(t, commit())
+	err = otherCommit()
+	require.Truef(t, errors.Is(err, artifact.ErrExists), "%v", err)
+
+	_, unlock, err := c.Get(idA)
+	require.NoError(t, err)
+	unlock()
+}
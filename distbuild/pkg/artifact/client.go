@@ -4,52 +4,291 @@ package artifact
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/retry"
 	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
 )
 
-// Download artifact from remote cache into local cache.
-func Download(ctx context.Context, endpoint string, c *Cache, artifactID build.ID) error {
+// parseDigest reads root digest of the artifact manifest sent in the digest header, it is nil if the header is missing.
+func parseDigest(text string) (*build.Digest, error) {
+	if text == "" {
+		return nil, nil
+	}
+	var d build.Digest
+	if err := d.UnmarshalText([]byte(text)); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal digest %q: %w", text, err)
+	}
+	return &d, nil
+}
+
+// parseOffset reads offset of the resumed stream sent in the offset header, it is zero if the header is missing.
+func parseOffset(text string) (int64, error) {
+	if text == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(text, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset %q", text)
+	}
+	return offset, nil
+}
+
+// stream is the artifact in tarstream format sent by the remote cache.
+type stream struct {
+	body io.ReadCloser
+	// digest is root digest of the artifact manifest, it is nil if the remote cache doesn't know it
+	digest *build.Digest
+	// offset is the position of the body in the stream of the artifact
+	offset int64
+}
+
+// get requests artifact from the remote cache. Stream of the artifact is resumed from offset if the remote cache
+// has the artifact with the same root digest, otherwise the whole stream is sent.
+func get(ctx context.Context, endpoint string, artifactID build.ID, digest *build.Digest, offset int64) (*stream, error) {
 	client := http.Client{}
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"/artifact", nil)
 	if err != nil {
-		return fmt.Errorf("error during creating request: %w", err)
+		return nil, fmt.Errorf("error during creating request: %w", err)
 	}
 	req.Header.Set("id", artifactID.String())
+	if digest != nil && offset > 0 {
+		req.Header.Set("digest", digest.String())
+		req.Header.Set("offset", strconv.FormatInt(offset, 10))
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error during /artifact request: %w", err)
+		return nil, fmt.Errorf("error during /artifact request: %w", err)
 	}
-	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, fmt.Errorf("artifact %v is missing at %v: %w", artifactID, endpoint, ErrNotFound)
+	}
 	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
 		buf, err := io.ReadAll(resp.Body)
 		if err != nil {
-			return fmt.Errorf("/artifact request finished with status_code %v, couldn't read body", resp.StatusCode)
+			return nil, fmt.Errorf("/artifact request finished with status_code %v, couldn't read body", resp.StatusCode)
 		}
-		return fmt.Errorf("/artifact reuest finished with status_code: %v, err: %v", resp.StatusCode, string(buf))
+		return nil, fmt.Errorf("/artifact reuest finished with status_code: %v, err: %v", resp.StatusCode, string(buf))
 	}
 
-	path, commit, abort, err := c.Create(artifactID)
+	s := &stream{body: resp.Body}
+	s.digest, err = parseDigest(resp.Header.Get("digest"))
+	if err == nil {
+		s.offset, err = parseOffset(resp.Header.Get("offset"))
+	}
 	if err != nil {
-		return fmt.Errorf("error during adding artifact %v to local cache: %w", artifactID, err)
+		resp.Body.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// partialArtifact is the artifact being received into the local cache. It is kept between download attempts,
+// so that the next attempt resumes the stream. Tar stream of the artifact is deterministic, so it may be resumed
+// from any replica having the artifact with the same root digest.
+type partialArtifact struct {
+	pw     *io.PipeWriter
+	digest *build.Digest
+	offset int64
+
+	// done is closed when the artifact is received or receiving failed
+	done   chan struct{}
+	m      *Manifest
+	err    error
+	commit func(m *Manifest) error
+	abort  func() error
+}
+
+func newPartialArtifact(path string, commit func(m *Manifest) error, abort func() error, digest *build.Digest) *partialArtifact {
+	pr, pw := io.Pipe()
+	p := &partialArtifact{pw: pw, digest: digest, done: make(chan struct{}), commit: commit, abort: abort}
+	go func() {
+		p.m, p.err = receive(path, pr)
+		if p.err == nil {
+			// writer must not block on the rest of the stream
+			_, _ = io.Copy(io.Discard, pr)
+		}
+		close(p.done)
+		_ = pr.CloseWithError(p.err)
+	}()
+	return p
+}
+
+// failed reports whether receiving of the stream failed, such stream can't be resumed.
+func (p *partialArtifact) failed() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
 	}
+}
 
-	if err = tarstream.Receive(path, resp.Body); err != nil {
-		aboortErr := abort()
-		if aboortErr != nil {
-			return fmt.Errorf("error during receiving artifact %v: %w; also error during aborting: %v", artifactID, err, aboortErr)
+// finish commits the artifact received completely.
+func (p *partialArtifact) finish(artifactID build.ID) error {
+	_ = p.pw.Close()
+	<-p.done
+
+	err := p.err
+	if err == nil {
+		err = checkRoot(artifactID, p.digest, p.m)
+	}
+	if err != nil {
+		if abortErr := p.abort(); abortErr != nil {
+			return fmt.Errorf("error during receiving artifact %v: %w; also error during aborting: %v", artifactID, err, abortErr)
 		}
 		return fmt.Errorf("error during receiving artifact %v: %w", artifactID, err)
 	}
 
-	if err = commit(); err != nil {
+	if err := p.commit(p.m); err != nil {
 		return fmt.Errorf("error during committing artifact %v to local cache: %w", artifactID, err)
 	}
 	return nil
 }
+
+// cancel discards the partial artifact.
+func (p *partialArtifact) cancel() error {
+	_ = p.pw.CloseWithError(errAborted)
+	<-p.done
+	return p.abort()
+}
+
+// download receives the artifact or the rest of partial artifact p. Partial artifact is kept in p
+// if the stream is cut and it may be resumed.
+func download(ctx context.Context, endpoint string, c *Cache, artifactID build.ID, p **partialArtifact) error {
+	var digest *build.Digest
+	var offset int64
+	if *p != nil {
+		digest, offset = (*p).digest, (*p).offset
+	}
+
+	s, err := get(ctx, endpoint, artifactID, digest, offset)
+	if err != nil {
+		return err
+	}
+	defer s.body.Close()
+
+	if *p != nil && s.offset != offset {
+		// replica has different content, stream is received again
+		if err := (*p).cancel(); err != nil {
+			return fmt.Errorf("error during aborting partial artifact %v: %w", artifactID, err)
+		}
+		*p = nil
+	}
+	if *p == nil {
+		if s.offset != 0 {
+			return fmt.Errorf("artifact %v is sent from offset %d", artifactID, s.offset)
+		}
+
+		path, commit, abort, err := c.create(artifactID)
+		if err != nil {
+			return fmt.Errorf("error during adding artifact %v to local cache: %w", artifactID, err)
+		}
+		*p = newPartialArtifact(path, commit, abort, s.digest)
+	}
+
+	partial := *p
+	n, err := io.Copy(partial.pw, s.body)
+	partial.offset += n
+	if err != nil {
+		if partial.failed() || partial.digest == nil {
+			*p = nil
+			return errors.Join(fmt.Errorf("error during receiving artifact %v: %w", artifactID, err), partial.cancel())
+		}
+		// next attempt resumes the stream
+		return fmt.Errorf("error during receiving artifact %v, %d bytes received: %w", artifactID, partial.offset, err)
+	}
+
+	*p = nil
+	return partial.finish(artifactID)
+}
+
+// Download artifact from remote cache into local cache. Artifact is verified against root digest
+// of its manifest sent by the remote cache, ErrCorrupted is returned if it doesn't match.
+func Download(ctx context.Context, endpoint string, c *Cache, artifactID build.ID) error {
+	var p *partialArtifact
+	err := download(ctx, endpoint, c, artifactID, &p)
+	if p != nil {
+		err = errors.Join(err, p.cancel())
+	}
+	return err
+}
+
+// DownloadTo downloads artifact from remote cache into existing directory dir. Artifact is verified
+// like in Download, but files already written to dir are not removed if it is corrupted.
+func DownloadTo(ctx context.Context, endpoint string, artifactID build.ID, dir string) error {
+	s, err := get(ctx, endpoint, artifactID, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer s.body.Close()
+
+	m, err := receive(dir, s.body)
+	if err == nil {
+		err = checkRoot(artifactID, s.digest, m)
+	}
+	if err != nil {
+		return fmt.Errorf("error during receiving artifact %v: %w", artifactID, err)
+	}
+	return nil
+}
+
+// Upload artifact from local cache to the artifact store at endpoint. It is not an error if the store has it already.
+func Upload(ctx context.Context, endpoint string, c *Cache, artifactID build.ID) error {
+	path, unlock, err := c.Get(artifactID)
+	if err != nil {
+		return fmt.Errorf("error during getting artifact %v from local cache: %w", artifactID, err)
+	}
+	defer unlock()
+
+	// store verifies the artifact if manifest is known
+	var digest *build.Digest
+	if m, err := c.Manifest(artifactID); err == nil {
+		digest = &m.Root
+	}
+
+	pr, pw := io.Pipe()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		_ = pw.CloseWithError(tarstream.Send(path, pw))
+	}()
+	defer func() {
+		// request may fail before the body is read
+		_ = pr.CloseWithError(errors.New("upload finished"))
+		<-sent
+	}()
+
+	return put(ctx, endpoint, artifactID, digest, pr)
+}
+
+// DownloadFromReplicas downloads artifact with retries. Every next attempt goes to the next endpoint,
+// so failed or overloaded replica is skipped. Attempts resume the stream received partially.
+// It is not an error if artifact is already in local cache.
+func DownloadFromReplicas(ctx context.Context, policy retry.Policy, endpoints []string, c *Cache, artifactID build.ID) error {
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no replicas of artifact %v", artifactID)
+	}
+
+	var p *partialArtifact
+	err := policy.Do(ctx, func(attempt int) error {
+		err := download(ctx, endpoints[(attempt-1)%len(endpoints)], c, artifactID, &p)
+		if errors.Is(err, ErrExists) {
+			return nil
+		}
+		return err
+	})
+	if p != nil {
+		err = errors.Join(err, p.cancel())
+	}
+	return err
+}
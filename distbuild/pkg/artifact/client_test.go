@@ -1,18 +1,23 @@
 package artifact_test
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"go.uber.org/zap/zaptest"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/retry"
 )
 
 func TestArtifactTransfer(t *testing.T) {
@@ -49,3 +54,105 @@ func TestArtifactTransfer(t *testing.T) {
 	err = artifact.Download(ctx, server.URL, localCache.Cache, build.ID{0x02})
 	require.Error(t, err)
 }
+
+func TestDownloadFromReplicas(t *testing.T) {
+	remoteCache := newTestCache(t)
+	localCache := newTestCache(t)
+
+	id := build.ID{0x01}
+
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("foobar"), 0777))
+	require.NoError(t, commit())
+
+	mux := http.NewServeMux()
+	artifact.NewHandler(zaptest.NewLogger(t), remoteCache.Cache).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	failures := 0
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		failures++
+		http.Error(w, "worker is restarting", http.StatusServiceUnavailable)
+	}))
+	defer broken.Close()
+
+	policy := retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	ctx := context.Background()
+
+	require.NoError(t, artifact.DownloadFromReplicas(ctx, policy, []string{broken.URL, server.URL}, localCache.Cache, id))
+	require.Equal(t, 1, failures)
+
+	_, unlock, err := localCache.Get(id)
+	require.NoError(t, err)
+	unlock()
+
+	// artifact is already in local cache
+	require.NoError(t, artifact.DownloadFromReplicas(ctx, policy, []string{server.URL}, localCache.Cache, id))
+
+	err = artifact.DownloadFromReplicas(ctx, policy, []string{broken.URL}, localCache.Cache, build.ID{0x02})
+	require.Error(t, err)
+	require.Equal(t, 4, failures)
+}
+
+// cutWriter fails writes after limit bytes.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection reset")
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestDownloadResume(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	remoteCache := newTestCache(t)
+	localCache := newTestCache(t)
+
+	id := build.ID{0x01}
+	content := bytes.Repeat([]byte("foobar"), 1024*1024)
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.bin"), content, 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "b.bin"), content, 0o644))
+	require.NoError(t, commit())
+
+	mux := http.NewServeMux()
+	artifact.NewHandler(l, remoteCache.Cache).Register(mux)
+
+	// the first replica breaks in the middle of the stream, the second one sends the rest
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(&cutWriter{ResponseWriter: w, limit: 1 << 20}, r)
+	}))
+	defer broken.Close()
+
+	var offsets []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offsets = append(offsets, r.Header.Get("offset"))
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	policy := retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+	require.NoError(t, artifact.DownloadFromReplicas(context.Background(), policy, []string{broken.URL, server.URL}, localCache.Cache, id))
+	require.Len(t, offsets, 1)
+	require.Regexp(t, `^[1-9][0-9]*$`, offsets[0])
+
+	dir, unlock, err := localCache.Get(id)
+	require.NoError(t, err)
+	defer unlock()
+
+	for _, name := range []string{"a.bin", "b.bin"} {
+		actual, err := os.ReadFile(filepath.Join(dir, name))
+		require.NoError(t, err)
+		require.Equal(t, content, actual)
+	}
+}
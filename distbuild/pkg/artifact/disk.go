@@ -0,0 +1,166 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
+)
+
+// DiskStore keeps artifacts as directories in the local file system, sharded by the first byte of id.
+type DiskStore struct {
+	tmpDir   string
+	cacheDir string
+}
+
+var _ DirStore = (*DiskStore)(nil)
+
+func NewDiskStore(root string) (*DiskStore, error) {
+	tmpDir := filepath.Join(root, "tmp")
+
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(tmpDir, 0777); err != nil {
+		return nil, err
+	}
+
+	cacheDir := filepath.Join(root, "c")
+	if err := os.MkdirAll(cacheDir, 0777); err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < 256; i++ {
+		d := hex.EncodeToString([]byte{uint8(i)})
+		if err := os.MkdirAll(filepath.Join(cacheDir, d), 0777); err != nil {
+			return nil, err
+		}
+	}
+
+	return &DiskStore{tmpDir: tmpDir, cacheDir: cacheDir}, nil
+}
+
+func (s *DiskStore) Dir(id build.ID) string {
+	return filepath.Join(s.cacheDir, id.Path())
+}
+
+func (s *DiskStore) TempDir(id build.ID) (string, error) {
+	return os.MkdirTemp(s.tmpDir, id.String())
+}
+
+func (s *DiskStore) Commit(id build.ID, dir string) error {
+	dst := s.Dir(id)
+	if err := os.Rename(dir, dst); err != nil {
+		// concurrent duplicate of the job committed the same artifact first
+		if _, statErr := os.Stat(dst); statErr == nil {
+			_ = os.RemoveAll(dir)
+			return ErrExists
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *DiskStore) Create(id build.ID) (Writer, error) {
+	if _, err := os.Stat(s.Dir(id)); err == nil {
+		return nil, ErrExists
+	}
+
+	dir, err := s.TempDir(id)
+	if err != nil {
+		return nil, err
+	}
+	return newPipeWriter(
+		func(r io.Reader) error { return tarstream.Receive(dir, r) },
+		func() error { return s.Commit(id, dir) },
+		func() error { return os.RemoveAll(dir) },
+	), nil
+}
+
+func (s *DiskStore) Get(id build.ID) (io.ReadCloser, error) {
+	dir := s.Dir(id)
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(tarstream.Send(dir, pw))
+	}()
+	return pr, nil
+}
+
+func (s *DiskStore) Exists(ctx context.Context, id build.ID) (bool, error) {
+	_, err := os.Stat(s.Dir(id))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DiskStore) Stat(ctx context.Context, id build.ID) (Info, error) {
+	dir := s.Dir(id)
+	stat, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return Info{}, ErrNotFound
+	} else if err != nil {
+		return Info{}, err
+	}
+
+	info := Info{Time: stat.ModTime()}
+	err = filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			info.Size += fi.Size()
+		}
+		return nil
+	})
+	return info, err
+}
+
+func (s *DiskStore) Remove(id build.ID) error {
+	return os.RemoveAll(s.Dir(id))
+}
+
+func (s *DiskStore) Range(artifactFn func(id build.ID) error) error {
+	shards, err := os.ReadDir(s.cacheDir)
+	if err != nil {
+		return err
+	}
+
+	for _, shard := range shards {
+		dirs, err := os.ReadDir(filepath.Join(s.cacheDir, shard.Name()))
+		if err != nil {
+			return err
+		}
+
+		for _, d := range dirs {
+			var id build.ID
+			if err := id.UnmarshalText([]byte(d.Name())); err != nil {
+				return fmt.Errorf("invalid artifact name: %w", err)
+			}
+
+			if err := artifactFn(id); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
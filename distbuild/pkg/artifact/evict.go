@@ -0,0 +1,216 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Limits bound the cache, zero values mean no limit.
+type Limits struct {
+	// MaxSize is the total size of artifacts in bytes, least recently used artifacts are evicted above it.
+	MaxSize int64
+	// MaxAge is the time since the last access after which artifact is evicted.
+	MaxAge time.Duration
+}
+
+func (l Limits) Enabled() bool {
+	return l.MaxSize > 0 || l.MaxAge > 0
+}
+
+// Pin protects the artifact from eviction until Unpin. Pins are counted, artifact doesn't need to exist.
+func (c *Cache) Pin(artifact build.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pinned[artifact]++
+}
+
+func (c *Cache) Unpin(artifact build.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.pinned[artifact]--
+	if c.pinned[artifact] <= 0 {
+		delete(c.pinned, artifact)
+	}
+}
+
+func (c *Cache) touch(artifact build.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accessed[artifact] = time.Now()
+}
+
+// added accounts committed artifact.
+func (c *Cache) added(artifact build.ID) {
+	c.touch(artifact)
+
+	c.mu.Lock()
+	loaded := c.sizes != nil
+	c.mu.Unlock()
+	if !loaded {
+		return
+	}
+
+	if info, err := c.store.Stat(context.Background(), artifact); err == nil {
+		c.mu.Lock()
+		c.sizes[artifact] = info.Size
+		c.mu.Unlock()
+	}
+}
+
+func (c *Cache) forget(artifact build.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.accessed, artifact)
+	if c.sizes != nil {
+		delete(c.sizes, artifact)
+	}
+}
+
+// loadUsage reads sizes of artifacts from the store. Artifacts which were not accessed since start
+// are considered accessed when they were stored.
+func (c *Cache) loadUsage() error {
+	c.mu.Lock()
+	if c.sizes != nil {
+		c.mu.Unlock()
+		return nil
+	}
+	c.sizes = make(map[build.ID]int64)
+	c.mu.Unlock()
+
+	infos := make(map[build.ID]Info)
+	err := c.store.Range(func(id build.ID) error {
+		info, err := c.store.Stat(context.Background(), id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		infos[id] = info
+		return nil
+	})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.sizes = nil
+		return err
+	}
+
+	for id, info := range infos {
+		// committed during the load
+		if _, ok := c.sizes[id]; ok {
+			continue
+		}
+		c.sizes[id] = info.Size
+		if _, ok := c.accessed[id]; !ok {
+			c.accessed[id] = info.Time
+		}
+	}
+	return nil
+}
+
+// tryWriteLock locks the artifact for write unless it is locked already.
+func (c *Cache) tryWriteLock(artifact build.ID) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, writeLocked := c.writeLocked[artifact]
+	if writeLocked || c.readLocked[artifact] > 0 {
+		return false
+	}
+	c.writeLocked[artifact] = struct{}{}
+	return true
+}
+
+// tryEvict removes the artifact unless it is pinned or locked.
+func (c *Cache) tryEvict(artifact build.ID) (bool, error) {
+	c.mu.Lock()
+	pinned := c.pinned[artifact] > 0
+	c.mu.Unlock()
+	if pinned || !c.tryWriteLock(artifact) {
+		return false, nil
+	}
+	defer c.writeUnlock(artifact)
+
+	if err := c.remove(artifact); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Evict removes artifacts exceeding limits, least recently used first. Locked and pinned artifacts are skipped.
+func (c *Cache) Evict(limits Limits) ([]build.ID, error) {
+	if !limits.Enabled() {
+		return nil, nil
+	}
+	if err := c.loadUsage(); err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		id       build.ID
+		size     int64
+		accessed time.Time
+	}
+
+	c.mu.Lock()
+	var total int64
+	candidates := make([]candidate, 0, len(c.sizes))
+	for id, size := range c.sizes {
+		total += size
+		candidates = append(candidates, candidate{id, size, c.accessed[id]})
+	}
+	c.mu.Unlock()
+
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return a.accessed.Compare(b.accessed)
+	})
+
+	now := time.Now()
+	var evicted []build.ID
+	for _, cand := range candidates {
+		expired := limits.MaxAge > 0 && now.Sub(cand.accessed) > limits.MaxAge
+		exceeds := limits.MaxSize > 0 && total > limits.MaxSize
+		if !expired && !exceeds {
+			// candidates accessed later are not expired either
+			break
+		}
+
+		ok, err := c.tryEvict(cand.id)
+		if err != nil {
+			return evicted, err
+		}
+		if ok {
+			total -= cand.size
+			evicted = append(evicted, cand.id)
+		}
+	}
+	return evicted, nil
+}
+
+// RunEviction calls Evict every interval until ctx is done. Evicted artifacts are passed to onEvict.
+func (c *Cache) RunEviction(ctx context.Context, limits Limits, interval time.Duration, onEvict func(evicted []build.ID, err error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		evicted, err := c.Evict(limits)
+		if len(evicted) != 0 || err != nil {
+			onEvict(evicted, err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package artifact_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func commitArtifact(t *testing.T, c *artifact.Cache, id build.ID, size int) {
+	path, commit, _, err := c.Create(id)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "a.txt"), []byte(strings.Repeat("x", size)), 0o644))
+	require.NoError(t, commit())
+}
+
+func exists(t *testing.T, c *artifact.Cache, id build.ID) bool {
+	_, err := c.Stat(context.Background(), id)
+	if errors.Is(err, artifact.ErrNotFound) {
+		return false
+	}
+	require.NoError(t, err)
+	return true
+}
+
+func TestEvictLRU(t *testing.T) {
+	c := newTestCache(t)
+
+	idA, idB, idC := build.ID{'a'}, build.ID{'b'}, build.ID{'c'}
+	for _, id := range []build.ID{idA, idB, idC} {
+		commitArtifact(t, c.Cache, id, 100)
+		time.Sleep(time.Millisecond)
+	}
+
+	// a becomes the most recently used
+	_, unlock, err := c.Get(idA)
+	require.NoError(t, err)
+	unlock()
+
+	evicted, err := c.Evict(artifact.Limits{MaxSize: 250})
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{idB}, evicted)
+	require.False(t, exists(t, c.Cache, idB))
+
+	commitArtifact(t, c.Cache, idB, 100)
+	evicted, err = c.Evict(artifact.Limits{MaxSize: 100})
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{idC, idA}, evicted)
+	require.True(t, exists(t, c.Cache, idB))
+}
+
+func TestEvictAge(t *testing.T) {
+	c := newTestCache(t)
+
+	idA, idB := build.ID{'a'}, build.ID{'b'}
+	commitArtifact(t, c.Cache, idA, 1)
+	time.Sleep(50 * time.Millisecond)
+	commitArtifact(t, c.Cache, idB, 1)
+
+	evicted, err := c.Evict(artifact.Limits{MaxAge: 25 * time.Millisecond})
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{idA}, evicted)
+}
+
+func TestEvictSkipsLockedAndPinned(t *testing.T) {
+	c := newTestCache(t)
+
+	idA, idB, idC := build.ID{'a'}, build.ID{'b'}, build.ID{'c'}
+	for _, id := range []build.ID{idA, idB, idC} {
+		commitArtifact(t, c.Cache, id, 1)
+	}
+
+	_, unlock, err := c.Get(idA)
+	require.NoError(t, err)
+	c.Pin(idB)
+
+	evicted, err := c.Evict(artifact.Limits{MaxAge: time.Nanosecond})
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{idC}, evicted)
+
+	unlock()
+	c.Unpin(idB)
+	evicted, err = c.Evict(artifact.Limits{MaxAge: time.Nanosecond})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []build.ID{idA, idB}, evicted)
+}
+
+func TestEvictExisting(t *testing.T) {
+	c := newTestCache(t)
+	commitArtifact(t, c.Cache, build.ID{'a'}, 100)
+
+	// cache reopened after restart accounts artifacts found in the store
+	reopened, err := artifact.NewCache(c.tmpDir)
+	require.NoError(t, err)
+
+	evicted, err := reopened.Evict(artifact.Limits{MaxSize: 10})
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{{'a'}}, evicted)
+}
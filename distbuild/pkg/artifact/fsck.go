@@ -0,0 +1,124 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// checkRoot returns ErrCorrupted if the received artifact doesn't have expected root digest.
+// Nothing is checked if expected digest is unknown.
+func checkRoot(artifact build.ID, expected *build.Digest, m *Manifest) error {
+	if expected != nil && *expected != m.Root {
+		return fmt.Errorf("artifact %v has root digest %v instead of %v: %w", artifact, m.Root, *expected, ErrCorrupted)
+	}
+	return nil
+}
+
+// Fsck checks content of artifacts against their manifests. Corrupted artifacts are moved to quarantine
+// directory under root of the cache together with their manifests and removed from the cache.
+// Artifacts without manifests and locked artifacts are skipped.
+func (c *Cache) Fsck() (corrupted []build.ID, err error) {
+	var ids []build.ID
+	if err := c.store.Range(func(id build.ID) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		bad, err := c.check(id)
+		if err != nil {
+			return corrupted, fmt.Errorf("error during checking artifact %v: %w", id, err)
+		}
+		if bad {
+			corrupted = append(corrupted, id)
+		}
+	}
+	return corrupted, nil
+}
+
+// check quarantines the artifact if it doesn't match its manifest.
+func (c *Cache) check(artifact build.ID) (bool, error) {
+	if !c.tryWriteLock(artifact) {
+		return false, nil
+	}
+	defer c.writeUnlock(artifact)
+
+	expected, err := c.Manifest(artifact)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var actual *Manifest
+	if c.dirs != nil {
+		actual, err = ComputeManifest(c.dirs.Dir(artifact))
+	} else {
+		actual, err = c.readManifest(artifact)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if expected.Diff(actual) == "" {
+		return false, nil
+	}
+	return true, c.quarantine(artifact)
+}
+
+// readManifest hashes the artifact streamed from the store.
+func (c *Cache) readManifest(artifact build.ID) (*Manifest, error) {
+	r, err := c.store.Get(artifact)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ReadManifest(r)
+}
+
+// quarantine moves write locked artifact out of the cache. Artifacts of stores which are not DirStore
+// are kept in tarstream format.
+func (c *Cache) quarantine(artifact build.ID) error {
+	dst := filepath.Join(c.quarantineDir, artifact.String())
+	// artifact may be quarantined before
+	if err := os.RemoveAll(dst); err != nil {
+		return err
+	}
+
+	if c.dirs != nil {
+		if err := os.Rename(c.dirs.Dir(artifact), dst); err != nil {
+			return err
+		}
+	} else if err := c.saveStream(artifact, dst+".tar"); err != nil {
+		return err
+	}
+
+	if err := os.Rename(c.manifestPath(artifact), dst+".json"); err != nil {
+		return err
+	}
+	return c.remove(artifact)
+}
+
+func (c *Cache) saveStream(artifact build.ID, path string) error {
+	r, err := c.store.Get(artifact)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return errors.Join(err, f.Close())
+}
@@ -3,8 +3,13 @@
 package artifact
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strconv"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
@@ -20,22 +25,200 @@ func NewHandler(l *zap.Logger, c *Cache) *Handler {
 	return &Handler{l, c}
 }
 
+// errorStatus returns HTTP status code of cache error.
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrExists), errors.Is(err, ErrWriteLocked), errors.Is(err, ErrReadLocked):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// setDigest sends root digest of the artifact manifest, so that the receiver verifies the artifact.
+func (h *Handler) setDigest(w http.ResponseWriter, id build.ID) {
+	m, err := h.cache.Manifest(id)
+	if err != nil {
+		if !errors.Is(err, ErrNotFound) {
+			h.logger.Error("couldn't read artifact manifest", zap.String("id", id.String()), zap.Error(err))
+		}
+		return
+	}
+	w.Header().Set("digest", m.Root.String())
+}
+
+// parseID reads artifact id from the request header, it writes error to the response if id is invalid.
+func parseID(w http.ResponseWriter, r *http.Request) (build.ID, bool) {
+	textID := r.Header.Get("id")
+	var id build.ID
+	if err := id.UnmarshalText([]byte(textID)); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't unmarshal id %q: %v", textID, err), http.StatusBadRequest)
+		return id, false
+	}
+	return id, true
+}
+
+// RegisterStore adds methods used by artifact stores, which keep artifacts uploaded by workers:
+//
+//   - PUT /artifact stores artifact received in tarstream format, upload of existing artifact succeeds,
+//     artifact is rejected if it doesn't match root digest in the digest header;
+//   - HEAD /artifact returns size and store time of the artifact in the size and time headers, and
+//     root digest of its manifest in the digest header if it is known;
+//   - DELETE /artifact removes the artifact;
+//   - GET /artifacts lists ids of all artifacts.
+//
+// RemoteStore is the client of these methods.
+func (h *Handler) RegisterStore(mux *http.ServeMux) {
+	mux.HandleFunc("HEAD /artifact", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseID(w, r)
+		if !ok {
+			return
+		}
+		info, err := h.cache.Stat(r.Context(), id)
+		if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+		w.Header().Set("size", strconv.FormatInt(info.Size, 10))
+		w.Header().Set("time", info.Time.Format(time.RFC3339Nano))
+		h.setDigest(w, id)
+	})
+
+	mux.HandleFunc("DELETE /artifact", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseID(w, r)
+		if !ok {
+			return
+		}
+		h.logger.Debug("start handling removal", zap.String("requestURI", r.RequestURI), zap.String("id", id.String()))
+		if err := h.cache.Remove(id); err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+		}
+	})
+
+	mux.HandleFunc("GET /artifacts", func(w http.ResponseWriter, r *http.Request) {
+		ids := []build.ID{}
+		if err := h.cache.Range(func(id build.ID) error {
+			ids = append(ids, id)
+			return nil
+		}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.NewEncoder(w).Encode(ids); err != nil {
+			h.logger.Error("couldn't write artifact list", zap.Error(err))
+		}
+	})
+
+	mux.HandleFunc("PUT /artifact", func(w http.ResponseWriter, r *http.Request) {
+		id, ok := parseID(w, r)
+		if !ok {
+			return
+		}
+		h.logger.Debug("start handling upload", zap.String("requestURI", r.RequestURI), zap.String("id", id.String()))
+		digest, err := parseDigest(r.Header.Get("digest"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		path, commit, abort, err := h.cache.create(id)
+		if errors.Is(err, ErrExists) {
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), errorStatus(err))
+			return
+		}
+
+		m, err := receive(path, r.Body)
+		if err == nil {
+			err = checkRoot(id, digest, m)
+		}
+		if err != nil {
+			if abortErr := abort(); abortErr != nil {
+				h.logger.Error("couldn't abort artifact upload", zap.String("id", id.String()), zap.Error(abortErr))
+			}
+			http.Error(w, fmt.Sprintf("error during receiving artifact: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		if err := commit(m); err != nil && !errors.Is(err, ErrExists) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
+
+// resumeOffset returns position in the artifact stream the client asks to resume from. Stream is resumed
+// only if the client received the artifact with the same root digest, otherwise it is sent from the start.
+func (h *Handler) resumeOffset(r *http.Request, id build.ID) (int64, error) {
+	offset, err := parseOffset(r.Header.Get("offset"))
+	if err != nil || offset == 0 {
+		return 0, err
+	}
+	digest, err := parseDigest(r.Header.Get("digest"))
+	if err != nil || digest == nil {
+		return 0, err
+	}
+
+	m, err := h.cache.Manifest(id)
+	if err != nil || m.Root != *digest {
+		return 0, nil
+	}
+	return offset, nil
+}
+
+// skipWriter discards first skip bytes written to it.
+type skipWriter struct {
+	w    io.Writer
+	skip int64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if s.skip >= int64(n) {
+		s.skip -= int64(n)
+		return n, nil
+	}
+
+	p = p[s.skip:]
+	s.skip = 0
+	if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Register adds GET /artifact, which sends the artifact in tarstream format. Root digest of the artifact
+// manifest is sent in the digest header. Client resumes the stream by sending the digest and the number
+// of received bytes in the offset header, the offset header of the response is the position the stream
+// is sent from. Tar stream of the artifact is deterministic, so any replica of the artifact may resume it.
 func (h *Handler) Register(mux *http.ServeMux) {
 	mux.HandleFunc("/artifact", func(w http.ResponseWriter, r *http.Request) {
-		textID := r.Header.Get("id")
-		var id build.ID
-		if err := id.UnmarshalText([]byte(textID)); err != nil {
-			http.Error(w, fmt.Sprintf("couldn't unmarshal id %q: %v", textID, err), http.StatusBadRequest)
+		id, ok := parseID(w, r)
+		if !ok {
+			return
 		}
 		h.logger.Debug("start handling", zap.String("requestURI", r.RequestURI), zap.String("id", id.String()))
 		path, unlock, err := h.cache.Get(id)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			http.Error(w, err.Error(), errorStatus(err))
 			return
 		}
 		defer unlock()
-		if err = tarstream.Send(path, w); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+
+		offset, err := h.resumeOffset(r, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		h.setDigest(w, id)
+		w.Header().Set("offset", strconv.FormatInt(offset, 10))
+
+		if err = tarstream.Send(path, &skipWriter{w: w, skip: offset}); err != nil {
+			h.logger.Error("error during sending artifact", zap.String("id", id.String()), zap.Error(err))
+			// connection is aborted, so that the client doesn't take partial stream for the whole artifact
+			panic(http.ErrAbortHandler)
 		}
 	})
 }
@@ -0,0 +1,179 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+var ErrCorrupted = errors.New("artifact is corrupted")
+
+// ManifestEntry describes file or directory of the artifact.
+type ManifestEntry struct {
+	// Path is slash separated and relative to the artifact root.
+	Path string
+	// Mode is normalized, so that it doesn't depend on umask: directories have only os.ModeDir,
+	// executable files have 0755 and other files have 0644.
+	Mode os.FileMode
+	Size int64
+	// Digest is sha256 of the file content, it is zero for directories.
+	Digest build.Digest
+}
+
+// Manifest lists content of the artifact sorted by path. Root is sha256 of the entries, so two
+// artifacts have the same root digest only if they have the same content.
+type Manifest struct {
+	Root    build.Digest
+	Entries []ManifestEntry
+}
+
+func normalizeMode(mode os.FileMode) os.FileMode {
+	switch {
+	case mode.IsDir():
+		return os.ModeDir
+	case mode&0o111 != 0:
+		return 0o755
+	default:
+		return 0o644
+	}
+}
+
+// hashFile returns size and sha256 of the content read from r.
+func hashFile(r io.Reader) (int64, build.Digest, error) {
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err != nil {
+		return 0, build.Digest{}, err
+	}
+	var d build.Digest
+	h.Sum(d[:0])
+	return n, d, nil
+}
+
+// newManifest sorts entries and computes root digest.
+func newManifest(entries []ManifestEntry) *Manifest {
+	slices.SortFunc(entries, func(a, b ManifestEntry) int {
+		return strings.Compare(a.Path, b.Path)
+	})
+
+	h := sha256.New()
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(h, "%q %o %d %v\n", e.Path, uint32(e.Mode), e.Size, e.Digest)
+	}
+
+	m := &Manifest{Entries: entries}
+	h.Sum(m.Root[:0])
+	return m
+}
+
+// ComputeManifest hashes content of the artifact directory.
+func ComputeManifest(dir string) (*Manifest, error) {
+	entries := []ManifestEntry{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{Path: filepath.ToSlash(rel), Mode: normalizeMode(info.Mode())}
+		if d.IsDir() {
+			entries = append(entries, entry)
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		entry.Size, entry.Digest, err = hashFile(f)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error during computing manifest of %v: %w", dir, err)
+	}
+	return newManifest(entries), nil
+}
+
+// ReadManifest hashes artifact streamed in tarstream format.
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	entries := []ManifestEntry{}
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		entry := ManifestEntry{Path: filepath.ToSlash(h.Name)}
+		if h.Typeflag == tar.TypeDir {
+			entry.Mode = os.ModeDir
+			entries = append(entries, entry)
+			continue
+		}
+
+		entry.Mode = normalizeMode(os.FileMode(h.Mode))
+		entry.Size, entry.Digest, err = hashFile(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return newManifest(entries), nil
+}
+
+// Diff describes the first difference of the manifests, it returns empty string if roots are equal.
+func (m *Manifest) Diff(other *Manifest) string {
+	if m.Root == other.Root {
+		return ""
+	}
+
+	byPath := make(map[string]ManifestEntry, len(other.Entries))
+	for _, e := range other.Entries {
+		byPath[e.Path] = e
+	}
+	for _, e := range m.Entries {
+		o, ok := byPath[e.Path]
+		switch {
+		case !ok:
+			return fmt.Sprintf("%s is missing", e.Path)
+		case o != e:
+			return fmt.Sprintf("%s differs: mode %v, size %d, digest %v instead of mode %v, size %d, digest %v",
+				e.Path, o.Mode, o.Size, o.Digest, e.Mode, e.Size, e.Digest)
+		}
+		delete(byPath, e.Path)
+	}
+	for path := range byPath {
+		return fmt.Sprintf("%s is unexpected", path)
+	}
+	return fmt.Sprintf("root digest %v instead of %v", other.Root, m.Root)
+}
@@ -0,0 +1,125 @@
+package artifact_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
+)
+
+func writeFiles(t *testing.T, dir string) {
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("foobar"), 0o644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "bin"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bin", "run"), []byte("#!/bin/sh"), 0o755))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "empty"), 0o755))
+}
+
+func TestManifest(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir)
+
+	m, err := artifact.ComputeManifest(dir)
+	require.NoError(t, err)
+	require.Len(t, m.Entries, 4)
+	require.Equal(t, "a.txt", m.Entries[0].Path)
+	require.Equal(t, int64(6), m.Entries[0].Size)
+	require.Equal(t, os.FileMode(0o755), m.Entries[2].Mode)
+	require.Equal(t, os.ModeDir, m.Entries[3].Mode)
+
+	var stream bytes.Buffer
+	require.NoError(t, tarstream.Send(dir, &stream))
+	streamed, err := artifact.ReadManifest(&stream)
+	require.NoError(t, err)
+	require.Equal(t, m, streamed)
+	require.Empty(t, m.Diff(streamed))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("foobaz"), 0o644))
+	changed, err := artifact.ComputeManifest(dir)
+	require.NoError(t, err)
+	require.NotEqual(t, m.Root, changed.Root)
+	require.Contains(t, m.Diff(changed), "a.txt differs")
+}
+
+func TestDownloadCorrupted(t *testing.T) {
+	remoteCache := newTestCache(t)
+	localCache := newTestCache(t)
+
+	id := build.ID{0x01}
+	dir, commit, _, err := remoteCache.Create(id)
+	require.NoError(t, err)
+	writeFiles(t, dir)
+	require.NoError(t, commit())
+
+	m, err := remoteCache.Manifest(id)
+	require.NoError(t, err)
+
+	// content is changed on the way
+	corrupted := t.TempDir()
+	writeFiles(t, corrupted)
+	require.NoError(t, os.WriteFile(filepath.Join(corrupted, "a.txt"), []byte("foobaz"), 0o644))
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("digest", m.Root.String())
+		_ = tarstream.Send(corrupted, w)
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	err = artifact.Download(ctx, server.URL, localCache.Cache, id)
+	require.Truef(t, errors.Is(err, artifact.ErrCorrupted), "%v", err)
+
+	_, _, err = localCache.Get(id)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+
+	err = artifact.DownloadTo(ctx, server.URL, id, t.TempDir())
+	require.Truef(t, errors.Is(err, artifact.ErrCorrupted), "%v", err)
+}
+
+func TestFsck(t *testing.T) {
+	c := newTestCache(t)
+
+	idA, idB := build.ID{'a'}, build.ID{'b'}
+	for _, id := range []build.ID{idA, idB} {
+		dir, commit, _, err := c.Create(id)
+		require.NoError(t, err)
+		writeFiles(t, dir)
+		require.NoError(t, commit())
+	}
+
+	corrupted, err := c.Fsck()
+	require.NoError(t, err)
+	require.Empty(t, corrupted)
+
+	dir, unlock, err := c.Get(idB)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bin", "run"), []byte("rm -rf /"), 0o755))
+	unlock()
+
+	corrupted, err = c.Fsck()
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{idB}, corrupted)
+
+	_, _, err = c.Get(idB)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+	_, err = c.Manifest(idB)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+
+	_, err = os.Stat(filepath.Join(c.tmpDir, "quarantine", idB.String(), "bin", "run"))
+	require.NoError(t, err)
+	_, err = os.Stat(filepath.Join(c.tmpDir, "quarantine", idB.String()+".json"))
+	require.NoError(t, err)
+
+	_, unlock, err = c.Get(idA)
+	require.NoError(t, err)
+	unlock()
+}
@@ -0,0 +1,120 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// MemoryStore keeps artifacts in memory in tarstream format. It is used in tests.
+type MemoryStore struct {
+	mu        sync.Mutex
+	artifacts map[build.ID][]byte
+	stored    map[build.ID]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{artifacts: make(map[build.ID][]byte), stored: make(map[build.ID]time.Time)}
+}
+
+type memoryWriter struct {
+	bytes.Buffer
+	s      *MemoryStore
+	id     build.ID
+	closed bool
+}
+
+func (w *memoryWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+
+	if _, ok := w.s.artifacts[w.id]; ok {
+		return ErrExists
+	}
+	w.s.artifacts[w.id] = w.Bytes()
+	w.s.stored[w.id] = time.Now()
+	return nil
+}
+
+func (w *memoryWriter) Abort() error {
+	w.closed = true
+	return nil
+}
+
+func (s *MemoryStore) Create(id build.ID) (Writer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.artifacts[id]; ok {
+		return nil, ErrExists
+	}
+	return &memoryWriter{s: s, id: id}, nil
+}
+
+func (s *MemoryStore) Get(id build.ID) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.artifacts[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *MemoryStore) Exists(ctx context.Context, id build.ID) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.artifacts[id]
+	return ok, nil
+}
+
+func (s *MemoryStore) Stat(ctx context.Context, id build.ID) (Info, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, ok := s.artifacts[id]
+	if !ok {
+		return Info{}, ErrNotFound
+	}
+	return Info{Size: int64(len(data)), Time: s.stored[id]}, nil
+}
+
+func (s *MemoryStore) Remove(id build.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.artifacts, id)
+	delete(s.stored, id)
+	return nil
+}
+
+func (s *MemoryStore) Range(artifactFn func(id build.ID) error) error {
+	s.mu.Lock()
+	ids := make([]build.ID, 0, len(s.artifacts))
+	for id := range s.artifacts {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+
+	slices.SortFunc(ids, func(a, b build.ID) int { return bytes.Compare(a[:], b[:]) })
+	for _, id := range ids {
+		if err := artifactFn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
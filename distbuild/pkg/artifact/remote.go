@@ -0,0 +1,161 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// remoteRequestTimeout bounds requests of RemoteStore which don't transfer artifacts.
+const remoteRequestTimeout = 30 * time.Second
+
+// RemoteStore keeps artifacts in the artifact store at endpoint, which serves Handler.RegisterStore methods.
+// Writer of artifact uploaded concurrently by someone else is closed without error.
+type RemoteStore struct {
+	endpoint string
+	client   *http.Client
+}
+
+func NewRemoteStore(endpoint string) *RemoteStore {
+	return &RemoteStore{endpoint: endpoint, client: &http.Client{Timeout: remoteRequestTimeout}}
+}
+
+// put uploads artifact in tarstream format read from body. Store verifies the artifact if digest is not nil.
+func put(ctx context.Context, endpoint string, artifactID build.ID, digest *build.Digest, body io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint+"/artifact", body)
+	if err != nil {
+		return fmt.Errorf("error during creating request: %w", err)
+	}
+	req.Header.Set("id", artifactID.String())
+	if digest != nil {
+		req.Header.Set("digest", digest.String())
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error during artifact upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("artifact upload finished with status_code: %v, err: %s", resp.StatusCode, buf)
+	}
+	return nil
+}
+
+// do sends request about the artifact and checks status of the response.
+func (s *RemoteStore) do(ctx context.Context, method string, artifactID build.ID) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.endpoint+"/artifact", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error during creating request: %w", err)
+	}
+	req.Header.Set("id", artifactID.String())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error during %v /artifact request: %w", method, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		defer resp.Body.Close()
+		buf, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("%v /artifact request finished with status_code: %v, err: %s", method, resp.StatusCode, buf)
+	}
+}
+
+func (s *RemoteStore) Create(id build.ID) (Writer, error) {
+	if ok, err := s.Exists(context.Background(), id); err == nil && ok {
+		return nil, ErrExists
+	}
+
+	nop := func() error { return nil }
+	return newPipeWriter(func(r io.Reader) error {
+		return put(context.Background(), s.endpoint, id, nil, r)
+	}, nop, nop), nil
+}
+
+func (s *RemoteStore) Get(id build.ID) (io.ReadCloser, error) {
+	stream, err := get(context.Background(), s.endpoint, id, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return stream.body, nil
+}
+
+func (s *RemoteStore) Exists(ctx context.Context, id build.ID) (bool, error) {
+	resp, err := s.do(ctx, http.MethodHead, id)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+func (s *RemoteStore) Stat(ctx context.Context, id build.ID) (Info, error) {
+	resp, err := s.do(ctx, http.MethodHead, id)
+	if err != nil {
+		return Info{}, err
+	}
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("size"), 10, 64)
+	if err != nil {
+		return Info{}, fmt.Errorf("invalid artifact size: %w", err)
+	}
+	stored, err := time.Parse(time.RFC3339Nano, resp.Header.Get("time"))
+	if err != nil {
+		return Info{}, fmt.Errorf("invalid artifact time: %w", err)
+	}
+	return Info{Size: size, Time: stored}, nil
+}
+
+func (s *RemoteStore) Remove(id build.ID) error {
+	resp, err := s.do(context.Background(), http.MethodDelete, id)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *RemoteStore) Range(artifactFn func(id build.ID) error) error {
+	resp, err := s.client.Get(s.endpoint + "/artifacts")
+	if err != nil {
+		return fmt.Errorf("error during /artifacts request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("/artifacts request finished with status_code: %v, err: %s", resp.StatusCode, buf)
+	}
+
+	var ids []build.ID
+	if err := json.NewDecoder(resp.Body).Decode(&ids); err != nil {
+		return fmt.Errorf("error during decoding artifact list: %w", err)
+	}
+	for _, id := range ids {
+		if err := artifactFn(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+//go:build !solution
+
+package artifact
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
+)
+
+// Store keeps artifacts addressed by their ids. Artifacts are streamed in tarstream format,
+// so stores don't depend on local file system.
+//
+// Store doesn't lock artifacts, Cache built on top of it does.
+type Store interface {
+	// Create starts writing of the artifact, it becomes visible after Close of the writer.
+	// ErrExists is returned if the store has the artifact already.
+	Create(id build.ID) (Writer, error)
+	// Get returns reader of the artifact or ErrNotFound.
+	Get(id build.ID) (io.ReadCloser, error)
+	// Exists reports whether the store has the artifact. Unlike Stat, it doesn't read content of the artifact.
+	Exists(ctx context.Context, id build.ID) (bool, error)
+	// Stat returns information about the artifact or ErrNotFound.
+	Stat(ctx context.Context, id build.ID) (Info, error)
+	// Remove deletes the artifact, removal of missing artifact is not an error.
+	Remove(id build.ID) error
+	// Range calls artifactFn for every artifact in the store.
+	Range(artifactFn func(id build.ID) error) error
+}
+
+// Writer receives artifact in tarstream format. Close commits the artifact and returns ErrExists
+// if it was committed concurrently. Abort discards written data.
+type Writer interface {
+	io.WriteCloser
+	Abort() error
+}
+
+// Info describes artifact kept in the store.
+type Info struct {
+	// Size is the number of bytes the store uses for the artifact.
+	Size int64
+	// Time is when the artifact was stored.
+	Time time.Time
+}
+
+// DirStore is implemented by stores keeping artifacts as local directories. Cache uses them
+// without streaming artifacts through tarstream.
+type DirStore interface {
+	Store
+	// Dir returns directory of the artifact, it may not exist.
+	Dir(id build.ID) string
+	// TempDir creates directory where the artifact is prepared before Commit.
+	TempDir(id build.ID) (string, error)
+	// Commit moves prepared directory into the store, or removes it and returns ErrExists.
+	Commit(id build.ID, dir string) error
+}
+
+// receive materializes artifact streamed in tarstream format inside dir and returns manifest of the stream.
+// Stream may come from the network, entries outside of dir and entries other than files and directories
+// are rejected by tarstream.Receive before anything is written.
+func receive(dir string, r io.Reader) (*Manifest, error) {
+	pr, pw := io.Pipe()
+	type result struct {
+		m   *Manifest
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		m, err := ReadManifest(pr)
+		// writer must not block on the rest of the stream
+		_, _ = io.Copy(io.Discard, pr)
+		done <- result{m, err}
+	}()
+
+	err := tarstream.Receive(dir, io.TeeReader(r, pw))
+	_ = pw.CloseWithError(err)
+	res := <-done
+	if err != nil {
+		return nil, err
+	}
+	return res.m, res.err
+}
+
+var errAborted = errors.New("artifact write aborted")
+
+// pipeWriter passes the stream to consume running in a separate goroutine.
+type pipeWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+
+	// commit is called after consume succeeds, discard after it fails or writer is aborted
+	commit, discard func() error
+
+	closed bool
+}
+
+func newPipeWriter(consume func(r io.Reader) error, commit, discard func() error) *pipeWriter {
+	pr, pw := io.Pipe()
+	w := &pipeWriter{pw: pw, done: make(chan error, 1), commit: commit, discard: discard}
+	go func() {
+		err := consume(pr)
+		if err != nil {
+			_ = pr.CloseWithError(err)
+		} else {
+			_ = pr.CloseWithError(io.ErrClosedPipe)
+		}
+		w.done <- err
+	}()
+	return w
+}
+
+func (w *pipeWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Close commits the artifact. Close and Abort after the first of them are no-op.
+func (w *pipeWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	_ = w.pw.Close()
+	if err := <-w.done; err != nil {
+		return errors.Join(err, w.discard())
+	}
+	return w.commit()
+}
+
+func (w *pipeWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	_ = w.pw.CloseWithError(errAborted)
+	<-w.done
+	return w.discard()
+}
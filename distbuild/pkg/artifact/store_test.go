@@ -0,0 +1,162 @@
+package artifact_test
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/tarstream"
+)
+
+// writeArtifact streams directory with a.txt to the store.
+func writeArtifact(t *testing.T, s artifact.Store, id build.ID, content string) error {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte(content), 0o644))
+
+	w, err := s.Create(id)
+	if err != nil {
+		return err
+	}
+	require.NoError(t, tarstream.Send(dir, w))
+	return w.Close()
+}
+
+func testStore(t *testing.T, s artifact.Store) {
+	idA, idB := build.ID{'a'}, build.ID{'b'}
+
+	_, err := s.Get(idA)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+	_, err = s.Stat(context.Background(), idA)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+
+	w, err := s.Create(idB)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("garbage"))
+	require.NoError(t, err)
+	require.NoError(t, w.Abort())
+	_, err = s.Stat(context.Background(), idB)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+
+	require.NoError(t, writeArtifact(t, s, idA, "foobar"))
+	err = writeArtifact(t, s, idA, "foobar")
+	require.Truef(t, errors.Is(err, artifact.ErrExists), "%v", err)
+
+	info, err := s.Stat(context.Background(), idA)
+	require.NoError(t, err)
+	require.NotZero(t, info.Size)
+
+	exists, err := s.Exists(context.Background(), idA)
+	require.NoError(t, err)
+	require.True(t, exists)
+	exists, err = s.Exists(context.Background(), idB)
+	require.NoError(t, err)
+	require.False(t, exists)
+
+	r, err := s.Get(idA)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	require.NoError(t, tarstream.Receive(dir, r))
+	require.NoError(t, r.Close())
+	content, err := os.ReadFile(filepath.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "foobar", string(content))
+
+	var ids []build.ID
+	require.NoError(t, s.Range(func(id build.ID) error {
+		ids = append(ids, id)
+		return nil
+	}))
+	require.Equal(t, []build.ID{idA}, ids)
+
+	require.NoError(t, s.Remove(idA))
+	_, err = s.Get(idA)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+}
+
+func TestDiskStore(t *testing.T) {
+	s, err := artifact.NewDiskStore(t.TempDir())
+	require.NoError(t, err)
+	testStore(t, s)
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, artifact.NewMemoryStore())
+}
+
+func newStoreServer(t *testing.T, s artifact.Store) string {
+	cache, err := artifact.NewCacheWithStore(t.TempDir(), s)
+	require.NoError(t, err)
+
+	h := artifact.NewHandler(zaptest.NewLogger(t), cache)
+	mux := http.NewServeMux()
+	h.Register(mux)
+	h.RegisterStore(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func TestRemoteStore(t *testing.T) {
+	testStore(t, artifact.NewRemoteStore(newStoreServer(t, artifact.NewMemoryStore())))
+}
+
+func TestRemoteStoreRejectsUnsafeArtifact(t *testing.T) {
+	store := artifact.NewMemoryStore()
+	remote := artifact.NewRemoteStore(newStoreServer(t, store))
+
+	id := build.ID{'a'}
+	w, err := remote.Create(id)
+	require.NoError(t, err)
+
+	tw := tar.NewWriter(w)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "../x", Typeflag: tar.TypeReg, Size: 1, Mode: 0o644}))
+	_, err = tw.Write([]byte("x"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.Error(t, w.Close())
+
+	_, err = store.Stat(context.Background(), id)
+	require.ErrorIs(t, err, artifact.ErrNotFound)
+}
+
+func TestCacheWithStore(t *testing.T) {
+	store := artifact.NewMemoryStore()
+	c, err := artifact.NewCacheWithStore(t.TempDir(), store)
+	require.NoError(t, err)
+
+	idA := build.ID{'a'}
+	path, commit, _, err := c.Create(idA)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(path, "a.txt"), []byte("foobar"), 0o644))
+	require.NoError(t, commit())
+
+	_, _, _, err = c.Create(idA)
+	require.Truef(t, errors.Is(err, artifact.ErrExists), "%v", err)
+
+	// another cache on top of the same store, e.g. on the other worker
+	other, err := artifact.NewCacheWithStore(t.TempDir(), store)
+	require.NoError(t, err)
+
+	path, unlock, err := other.Get(idA)
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(path, "a.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "foobar", string(content))
+	require.Truef(t, errors.Is(other.Remove(idA), artifact.ErrReadLocked), "%v", err)
+	unlock()
+
+	require.NoError(t, other.Remove(idA))
+	_, err = store.Stat(context.Background(), idA)
+	require.Truef(t, errors.Is(err, artifact.ErrNotFound), "%v", err)
+}
@@ -0,0 +1,247 @@
+//go:build !solution
+
+// Package bazelcache serves Bazel HTTP remote cache protocol on top of filecache.
+//
+// Bazel addresses entries by SHA-256 digests: GET, PUT and HEAD of /ac/<sha256> access results of actions,
+// and /cas/<sha256> access content addressable blobs. Entries are stored in filecache under build.ID
+// derived from the kind and the digest of the entry.
+package bazelcache
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+)
+
+// Kind is the namespace of the cache entries.
+type Kind string
+
+const (
+	// ActionCache keeps serialized ActionResult messages by digest of the action.
+	ActionCache Kind = "ac"
+	// CAS keeps blobs by digest of their content.
+	CAS Kind = "cas"
+)
+
+// Digest is SHA-256 hash Bazel uses as the key of cache entries.
+type Digest [sha256.Size]byte
+
+func ParseDigest(s string) (Digest, error) {
+	var d Digest
+	raw, err := hex.DecodeString(s)
+	if err != nil {
+		return d, err
+	}
+	if len(raw) != len(d) {
+		return d, fmt.Errorf("invalid digest size: %q", s)
+	}
+	copy(d[:], raw)
+	return d, nil
+}
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// ID returns id of the entry in filecache. Kind is a part of id, so that action result
+// and blob with the same digest don't collide.
+func ID(kind Kind, d Digest) build.ID {
+	h := sha1.New()
+	_, _ = io.WriteString(h, string(kind))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(d[:])
+
+	var id build.ID
+	copy(id[:], h.Sum(nil))
+	return id
+}
+
+// Stats is the size accounting of the cache, returned by GET /status.
+type Stats struct {
+	// Entries and Bytes are the number and total size of entries in the cache.
+	Entries int
+	Bytes   int64
+	// Hits and Misses count GET and HEAD requests since start.
+	Hits, Misses int64
+	// Uploads and UploadedBytes count stored entries since start.
+	Uploads       int64
+	UploadedBytes int64
+}
+
+type Handler struct {
+	logger *zap.Logger
+	cache  *filecache.Cache
+
+	mu    sync.Mutex
+	stats Stats
+}
+
+// NewHandler creates handler serving the cache. Entries already present in the cache are accounted
+// in Stats, so the cache should be dedicated to Bazel entries.
+func NewHandler(l *zap.Logger, cache *filecache.Cache) *Handler {
+	h := &Handler{logger: l, cache: cache}
+
+	err := cache.Range(func(id build.ID) error {
+		path, unlock, err := cache.Get(id)
+		if err != nil {
+			return nil
+		}
+		defer unlock()
+
+		if info, err := os.Stat(path); err == nil {
+			h.stats.Entries++
+			h.stats.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		l.Error("couldn't account size of bazel cache", zap.Error(err))
+	}
+	return h
+}
+
+// Stats returns current size accounting of the cache.
+func (h *Handler) Stats() Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats
+}
+
+func (h *Handler) Register(mux *http.ServeMux) {
+	for _, kind := range []Kind{ActionCache, CAS} {
+		pattern := "/" + string(kind) + "/{digest}"
+		mux.HandleFunc("GET "+pattern, func(w http.ResponseWriter, r *http.Request) {
+			h.get(w, r, kind)
+		})
+		mux.HandleFunc("PUT "+pattern, func(w http.ResponseWriter, r *http.Request) {
+			h.put(w, r, kind)
+		})
+	}
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(h.Stats()); err != nil {
+			h.logger.Error("couldn't write bazel cache status", zap.Error(err))
+		}
+	})
+}
+
+func parseRequest(w http.ResponseWriter, r *http.Request) (Digest, bool) {
+	d, err := ParseDigest(r.PathValue("digest"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid digest: %v", err), http.StatusBadRequest)
+		return d, false
+	}
+	return d, true
+}
+
+// get serves GET and HEAD requests of the entry.
+func (h *Handler) get(w http.ResponseWriter, r *http.Request, kind Kind) {
+	d, ok := parseRequest(w, r)
+	if !ok {
+		return
+	}
+	h.logger.Debug("start handling", zap.String("method", r.Method), zap.String("kind", string(kind)), zap.Stringer("digest", d))
+
+	path, unlock, err := h.cache.Get(ID(kind, d))
+	if errors.Is(err, filecache.ErrNotFound) {
+		h.count(func(s *Stats) { s.Misses++ })
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer unlock()
+	h.count(func(s *Stats) { s.Hits++ })
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.Copy(w, f); err != nil {
+		h.logger.Warn("error during sending cache entry", zap.Stringer("digest", d), zap.Error(err))
+	}
+}
+
+// put stores the entry. Content of CAS blobs is verified against their digest. Entry which exists
+// or is being written concurrently is not replaced, the request succeeds anyway.
+func (h *Handler) put(w http.ResponseWriter, r *http.Request, kind Kind) {
+	d, ok := parseRequest(w, r)
+	if !ok {
+		return
+	}
+	h.logger.Debug("start handling", zap.String("method", r.Method), zap.String("kind", string(kind)), zap.Stringer("digest", d))
+
+	fw, abort, err := h.cache.Write(ID(kind, d))
+	if errors.Is(err, filecache.ErrExists) || errors.Is(err, filecache.ErrWriteLocked) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(fw, hash), r.Body)
+	if err == nil && r.ContentLength >= 0 && n != r.ContentLength {
+		err = fmt.Errorf("received %d bytes, expected %d", n, r.ContentLength)
+	}
+	if err == nil && kind == CAS && Digest(hash.Sum(nil)) != d {
+		err = fmt.Errorf("content doesn't match digest %v", d)
+	}
+	if err != nil {
+		if abortErr := abort(); abortErr != nil {
+			h.logger.Error("couldn't abort cache entry", zap.Stringer("digest", d), zap.Error(abortErr))
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := fw.Close(); errors.Is(err, filecache.ErrExists) {
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h.count(func(s *Stats) {
+		s.Entries++
+		s.Bytes += n
+		s.Uploads++
+		s.UploadedBytes += n
+	})
+}
+
+func (h *Handler) count(update func(s *Stats)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	update(&h.stats)
+}
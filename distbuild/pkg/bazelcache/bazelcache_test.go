@@ -0,0 +1,105 @@
+package bazelcache_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/bazelcache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+)
+
+func newServer(t *testing.T, dir string) *httptest.Server {
+	cache, err := filecache.New(dir)
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	bazelcache.NewHandler(zaptest.NewLogger(t), cache).Register(mux)
+
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func do(t *testing.T, method, url string, body []byte) (int, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+
+	rsp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer rsp.Body.Close()
+
+	data, err := io.ReadAll(rsp.Body)
+	require.NoError(t, err)
+	return rsp.StatusCode, data
+}
+
+func digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return bazelcache.Digest(sum).String()
+}
+
+func status(t *testing.T, url string) bazelcache.Stats {
+	code, data := do(t, http.MethodGet, url+"/status", nil)
+	require.Equal(t, http.StatusOK, code)
+
+	var stats bazelcache.Stats
+	require.NoError(t, json.Unmarshal(data, &stats))
+	return stats
+}
+
+func TestHandler(t *testing.T) {
+	dir := t.TempDir()
+	server := newServer(t, dir)
+
+	blob := []byte("hello")
+	cas := server.URL + "/cas/" + digest(blob)
+
+	code, _ := do(t, http.MethodHead, cas, nil)
+	require.Equal(t, http.StatusNotFound, code)
+
+	code, _ = do(t, http.MethodPut, server.URL+"/cas/"+digest([]byte("other")), blob)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = do(t, http.MethodPut, cas, blob)
+	require.Equal(t, http.StatusOK, code)
+	code, _ = do(t, http.MethodPut, cas, blob)
+	require.Equal(t, http.StatusOK, code)
+
+	code, data := do(t, http.MethodGet, cas, nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, blob, data)
+
+	// action results are not verified and don't collide with blobs
+	ac := server.URL + "/ac/" + digest(blob)
+	code, _ = do(t, http.MethodGet, ac, nil)
+	require.Equal(t, http.StatusNotFound, code)
+	code, _ = do(t, http.MethodPut, ac, []byte("result"))
+	require.Equal(t, http.StatusOK, code)
+	code, data = do(t, http.MethodGet, ac, nil)
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, []byte("result"), data)
+
+	code, _ = do(t, http.MethodGet, server.URL+"/cas/xyz", nil)
+	require.Equal(t, http.StatusBadRequest, code)
+
+	require.Equal(t, bazelcache.Stats{
+		Entries:       2,
+		Bytes:         11,
+		Hits:          2,
+		Misses:        2,
+		Uploads:       2,
+		UploadedBytes: 11,
+	}, status(t, server.URL))
+
+	server.Close()
+	restarted := newServer(t, dir)
+	require.Equal(t, bazelcache.Stats{Entries: 2, Bytes: 11}, status(t, restarted.URL))
+}
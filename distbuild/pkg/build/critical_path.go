@@ -0,0 +1,31 @@
+//go:build !solution
+
+package build
+
+import "time"
+
+// CriticalPath computes for every job the cost of the longest chain that starts at this job
+// and follows reverse dependencies, i.e. the job itself plus everything that transitively waits for it.
+func CriticalPath(jobs []Job, cost func(job *Job) time.Duration) map[ID]time.Duration {
+	sorted := TopSort(jobs)
+
+	dependents := make(map[ID][]ID, len(sorted))
+	for _, j := range sorted {
+		for _, dep := range j.Deps {
+			dependents[dep] = append(dependents[dep], j.ID)
+		}
+	}
+
+	path := make(map[ID]time.Duration, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		job := &sorted[i]
+
+		var longest time.Duration
+		for _, d := range dependents[job.ID] {
+			longest = max(longest, path[d])
+		}
+		path[job.ID] = cost(job) + longest
+	}
+
+	return path
+}
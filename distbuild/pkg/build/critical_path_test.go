@@ -0,0 +1,43 @@
+//go:build !solution
+
+package build
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCriticalPath(t *testing.T) {
+	jobs := []Job{
+		{
+			ID:   ID{'a'},
+			Deps: []ID{{'b'}, {'d'}},
+		},
+		{
+			ID:   ID{'b'},
+			Deps: []ID{{'c'}},
+		},
+		{
+			ID: ID{'c'},
+		},
+		{
+			ID: ID{'d'},
+		},
+	}
+
+	path := CriticalPath(jobs, func(job *Job) time.Duration {
+		if job.ID == (ID{'b'}) {
+			return 10
+		}
+		return 1
+	})
+
+	require.Equal(t, map[ID]time.Duration{
+		{'a'}: 1,
+		{'b'}: 11,
+		{'c'}: 12,
+		{'d'}: 2,
+	}, path)
+}
@@ -0,0 +1,36 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"fmt"
+)
+
+// Digest is sha256 hash of the content, it is encoded as hex string.
+type Digest [sha256.Size]byte
+
+var (
+	_ = encoding.TextMarshaler(Digest{})
+	_ = encoding.TextUnmarshaler(&Digest{})
+)
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+func (d Digest) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+func (d *Digest) UnmarshalText(b []byte) error {
+	raw, err := hex.DecodeString(string(b))
+	if err != nil {
+		return err
+	}
+	if len(raw) != len(d) {
+		return fmt.Errorf("invalid digest length %d", len(raw))
+	}
+	copy(d[:], raw)
+	return nil
+}
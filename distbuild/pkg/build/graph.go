@@ -1,5 +1,7 @@
 package build
 
+import "time"
+
 // Job описывает одну вершину графа сборки.
 type Job struct {
 	// ID задаёт уникальный идентификатор джоба.
@@ -29,6 +31,14 @@ type Job struct {
 
 	// Cmds описывает список команд, которые нужно выполнить в рамках этого джоба.
 	Cmds []Cmd
+
+	// MaxAttempts ограничивает число попыток запустить джоб после временных ошибок.
+	// Ноль означает значение по умолчанию из конфига координатора.
+	MaxAttempts int
+
+	// Timeout ограничивает суммарное время выполнения команд джоба вместе со скачиванием его входов.
+	// Ноль означает значение по умолчанию из конфига координатора.
+	Timeout time.Duration
 }
 
 // Cmd описывает одну команду сборки.
@@ -61,6 +71,14 @@ type Cmd struct {
 
 	// CatOutput задаёт выходной файл для команды типа cat.
 	CatOutput string
+
+	// Timeout ограничивает время выполнения команды. Ноль означает, что действует только таймаут джоба.
+	Timeout time.Duration
+
+	// Persistent отмечает, что инструмент Exec[0] поддерживает режим persistent worker. Воркер может один раз
+	// запустить инструмент с флагом --persistent_worker и передавать ему Exec[1:] как аргументы запроса
+	// вместо запуска Exec.
+	Persistent bool
 }
 
 type Graph struct {
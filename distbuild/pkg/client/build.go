@@ -7,17 +7,20 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"path/filepath"
 
 	"go.uber.org/zap"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
 )
 
 type Client struct {
 	l         *zap.Logger
+	endpoint  string
 	sourceDir string
 	client    *api.BuildClient
 	filecache *filecache.Client
@@ -28,7 +31,7 @@ func NewClient(
 	apiEndpoint string,
 	sourceDir string,
 ) *Client {
-	return &Client{l, sourceDir, api.NewBuildClient(l, apiEndpoint), filecache.NewClient(l, apiEndpoint)}
+	return &Client{l, apiEndpoint, sourceDir, api.NewBuildClient(l, apiEndpoint), filecache.NewClient(l, apiEndpoint)}
 }
 
 type BuildListener interface {
@@ -39,8 +42,85 @@ type BuildListener interface {
 	OnJobFailed(jobID build.ID, code int, error string) error
 }
 
+// SummaryListener may be implemented by BuildListener to receive timings of the build when it ends.
+type SummaryListener interface {
+	OnBuildSummary(summary *api.BuildSummary) error
+}
+
+func (c *Client) onSummary(lsn BuildListener, buildID build.ID, summary *api.BuildSummary) {
+	c.l.Info("build summary", zap.String("build_id", buildID.String()), zap.Stringer("summary", summary))
+	if lsn, ok := lsn.(SummaryListener); ok {
+		if err := lsn.OnBuildSummary(summary); err != nil {
+			c.l.Error("build summary handler finished with error", zap.String("build_id", buildID.String()), zap.Error(err))
+		}
+	}
+}
+
+// ProgressListener may be implemented by BuildListener to receive progress of the build.
+type ProgressListener interface {
+	OnBuildProgress(progress *api.BuildProgress) error
+}
+
+// CacheListener may be implemented by BuildListener to learn which jobs were not executed,
+// because their artifacts were found in cache. Results of such jobs are replayed from the original execution.
+type CacheListener interface {
+	OnJobCached(jobID build.ID) error
+}
+
+// writeTrace saves timeline of the build to path if it is not empty. Build result doesn't depend on it, so errors are only logged.
+func (c *Client) writeTrace(ctx context.Context, buildID build.ID, path string) {
+	if path == "" {
+		return
+	}
+
+	trace, err := c.client.Trace(ctx, buildID)
+	if err == nil {
+		err = os.WriteFile(path, trace, 0o644)
+	}
+	if err != nil {
+		c.l.Error("couldn't write build trace", zap.String("build_id", buildID.String()), zap.String("path", path), zap.Error(err))
+		return
+	}
+	c.l.Info("build trace written", zap.String("build_id", buildID.String()), zap.String("path", path))
+}
+
+// DownloadArtifact downloads artifact of the job from the artifact store of the coordinator into directory dir.
+// The store must be enabled on the coordinator and the artifact must be uploaded there by the worker.
+func (c *Client) DownloadArtifact(ctx context.Context, jobID build.ID, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if err := artifact.DownloadTo(ctx, c.endpoint, jobID, dir); err != nil {
+		return fmt.Errorf("error during downloading artifact %v: %w", jobID, err)
+	}
+	return nil
+}
+
+// BuildOptions are passed to coordinator together with the build graph.
+type BuildOptions struct {
+	// User identifies the owner of the build for fair scheduling.
+	User string
+	// Priority of the build among other builds of the same user.
+	Priority int
+	// TracePath is the file where timeline of the build is written in Chrome trace event format when it ends.
+	TracePath string
+}
+
+// sourcePaths returns local paths of the source files.
+func (c *Client) sourcePaths(graph *build.Graph, ids []build.ID) map[build.ID]string {
+	paths := make(map[build.ID]string, len(ids))
+	for _, id := range ids {
+		paths[id] = filepath.Join(c.sourceDir, graph.SourceFiles[id])
+	}
+	return paths
+}
+
 func (c *Client) Build(ctx context.Context, graph build.Graph, lsn BuildListener) error {
-	build, statusReader, err := c.client.StartBuild(ctx, &api.BuildRequest{Graph: graph})
+	return c.BuildWithOptions(ctx, graph, BuildOptions{}, lsn)
+}
+
+func (c *Client) BuildWithOptions(ctx context.Context, graph build.Graph, opts BuildOptions, lsn BuildListener) error {
+	build, statusReader, err := c.client.StartBuild(ctx, &api.BuildRequest{Graph: graph, User: opts.User, Priority: opts.Priority})
 	if err != nil {
 		err = fmt.Errorf("couldn't start build: %w", err)
 		c.l.Error(err.Error())
@@ -50,14 +130,11 @@ func (c *Client) Build(ctx context.Context, graph build.Graph, lsn BuildListener
 
 	c.l.Debug("new build started", zap.Any("build", *build))
 
-	for _, id := range build.MissingFiles {
-		path := graph.SourceFiles[id]
-		err = c.filecache.Upload(ctx, id, filepath.Join(c.sourceDir, path))
-		if err != nil {
-			err = fmt.Errorf("error during Uploading file %v to filecache: %w", id, err)
-			c.l.Error(err.Error())
-			return err
-		}
+	// files are uploaded while the build may be queued, coordinator waits for UploadDone before running it
+	if err = c.filecache.UploadFiles(ctx, c.sourcePaths(&graph, build.MissingFiles)); err != nil {
+		err = fmt.Errorf("error during uploading files to filecache: %w", err)
+		c.l.Error(err.Error())
+		return err
 	}
 
 	_, err = c.client.SignalBuild(ctx, build.ID, &api.SignalRequest{UploadDone: &api.UploadDone{}})
@@ -80,13 +157,53 @@ func (c *Client) Build(ctx context.Context, graph build.Graph, lsn BuildListener
 		}
 		if upd.BuildFinished != nil {
 			c.l.Info("build finished, found BuildFinished status", zap.String("build_id", build.ID.String()))
+			c.onSummary(lsn, build.ID, &upd.BuildFinished.Summary)
+			c.writeTrace(ctx, build.ID, opts.TracePath)
 			break
 		}
+		if upd.BuildQueued != nil {
+			c.l.Info("build is queued", zap.String("build_id", build.ID.String()), zap.Int("position", upd.BuildQueued.Position))
+			continue
+		}
+		if progress := upd.BuildProgress; progress != nil {
+			c.l.Info("build progress",
+				zap.String("build_id", build.ID.String()),
+				zap.Int("done", progress.Done),
+				zap.Int("total", progress.Total),
+				zap.Duration("eta", progress.ETA))
+			if lsn, ok := lsn.(ProgressListener); ok {
+				if err := lsn.OnBuildProgress(progress); err != nil {
+					c.l.Error("build progress handler finished with error", zap.String("build_id", build.ID.String()), zap.Error(err))
+				}
+			}
+			continue
+		}
+		if retried := upd.JobRetried; retried != nil {
+			c.l.Warn("job failed and is retried",
+				zap.String("job_id", retried.ID.String()),
+				zap.Int("attempt", retried.Attempt),
+				zap.String("cause", retried.Cause))
+			continue
+		}
 		if upd.BuildFailed != nil {
 			c.l.Info("build failed, found BildFailed status", zap.String("build_id", build.ID.String()))
+			c.onSummary(lsn, build.ID, &upd.BuildFailed.Summary)
+			c.writeTrace(ctx, build.ID, opts.TracePath)
 			return errors.New(upd.BuildFailed.Error)
 		}
 		if finished := upd.JobFinished; finished != nil {
+			c.l.Debug("job finished",
+				zap.String("job_id", finished.ID.String()),
+				zap.Int("exit_code", finished.ExitCode),
+				zap.Int64("peak_memory", finished.PeakMemory),
+				zap.Duration("cpu_time", finished.CPUTime),
+				zap.Bool("oom_killed", finished.OOMKilled),
+				zap.Bool("cached", finished.Cached))
+			if lsn, ok := lsn.(CacheListener); ok && finished.Cached {
+				if err := lsn.OnJobCached(finished.ID); err != nil {
+					c.l.Error("job cache handler finished with error", zap.String("job_id", finished.ID.String()), zap.Error(err))
+				}
+			}
 			if err := lsn.OnJobStdout(finished.ID, finished.Stdout); err != nil {
 				c.l.Error("job stdout handler finished with error", zap.String("job_id", finished.ID.String()), zap.Error(err))
 			}
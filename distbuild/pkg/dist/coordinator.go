@@ -4,143 +4,688 @@ package dist
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"maps"
 	"net/http"
+	"slices"
 	"sync"
 	"time"
 
 	"go.uber.org/zap"
 
+	"gitlab.com/slon/shad-go/distbuild/pkg/actioncache"
 	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/bazelcache"
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
 	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+	"gitlab.com/slon/shad-go/distbuild/pkg/trace"
 )
 
 type buildData struct {
 	mu sync.Mutex
 
 	jobs         []build.Job
+	jobByID      map[build.ID]*build.Job
+	dependents   map[build.ID][]build.ID
+	done         map[build.ID]bool
 	stWriter     api.StatusWriter
 	jobsDoneCnt  int
 	fileIDByName map[string]build.ID
 	buildID      build.ID
+	// attempts counts failed attempts of the jobs
+	attempts map[build.ID]int
+	finished bool
+	// pinned are artifacts of done jobs which dependents are not done yet
+	pinned map[build.ID]bool
+
+	// started and uploaded are when the build was started and its source files were uploaded.
+	started, uploaded time.Time
+	summary           api.BuildSummary
+	// spans are attempts of the build jobs, including failed ones
+	spans []trace.Span
+
+	// filesReady is set when source files are uploaded, queued build is started only after it. Guarded by c.mu.
+	filesReady bool
+	// uploadTimer fails the build if its files are not uploaded in UploadTimeout
+	uploadTimer *time.Timer
+}
+
+func newBuildData(id build.ID, graph *build.Graph, w api.StatusWriter) *buildData {
+	data := &buildData{
+		jobs:         build.TopSort(graph.Jobs),
+		jobByID:      make(map[build.ID]*build.Job, len(graph.Jobs)),
+		dependents:   make(map[build.ID][]build.ID),
+		done:         make(map[build.ID]bool, len(graph.Jobs)),
+		stWriter:     w,
+		fileIDByName: make(map[string]build.ID, len(graph.SourceFiles)),
+		buildID:      id,
+		attempts:     make(map[build.ID]int),
+		pinned:       make(map[build.ID]bool),
+		started:      time.Now(),
+	}
+
+	for i := range data.jobs {
+		job := &data.jobs[i]
+		data.jobByID[job.ID] = job
+		for _, dep := range job.Deps {
+			data.dependents[dep] = append(data.dependents[dep], job.ID)
+		}
+	}
+
+	for fileID, fileName := range graph.SourceFiles {
+		data.fileIDByName[fileName] = fileID
+	}
+
+	return data
+}
+
+// ready reports whether all dependencies of the job from the build graph are done.
+func (data *buildData) ready(job *build.Job) bool {
+	for _, dep := range job.Deps {
+		if _, inGraph := data.jobByID[dep]; inGraph && !data.done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+func (data *buildData) sendStatus(l *zap.Logger, upd *api.StatusUpdate) {
+	if data.stWriter == nil { // invariant
+		panic("data.StWriter is nil")
+	}
+
+	if err := data.stWriter.Updated(upd); err != nil {
+		// TODO: maybe send signal to finish building process with error for this build_id
+		l.Error("error during sending status of build", zap.Any("status", *upd), zap.String("build_id", data.buildID.String()), zap.Error(err))
+	}
 }
 
 type Coordinator struct {
 	log       *zap.Logger
 	files     *filecache.Cache
 	scheduler *scheduler.Scheduler
-
-	builds     sync.Map
-	buildByJob sync.Map
+	actions   *actioncache.Cache
+	config    Config
+
+	// builds maps id of the build to its *buildData until the build is finished
+	builds sync.Map
+
+	mu            sync.Mutex
+	buildsByJob   map[build.ID][]*buildData
+	runningBuilds int
+	queuedBuilds  []*buildData
+	// activeJobs counts jobs of all started and not yet finished builds
+	activeJobs int
+	// lastHeartbeat is when the workers sent their last heartbeats, it is tracked if WorkerTimeout is set
+	lastHeartbeat map[api.WorkerID]time.Time
+	// traces keep spans of the latest finished builds in traceOrder
+	traces     map[build.ID][]trace.Span
+	traceOrder []build.ID
+	// pins are artifacts needed by running builds, workers must not evict them
+	pins *pins
 
 	mux *http.ServeMux
 }
 
-var defaultConfig = scheduler.Config{
-	CacheTimeout: time.Millisecond * 10,
-	DepsTimeout:  time.Millisecond * 100,
+type Config struct {
+	Scheduler scheduler.Config
+
+	// MaxBuilds limits number of builds executed concurrently, other builds wait in the queue.
+	// Zero means no limit.
+	MaxBuilds int
+
+	// MaxActiveJobs limits total number of jobs in all unfinished builds. Builds exceeding the limit are rejected,
+	// the client may retry them later unless the build alone has more jobs. Zero means no limit.
+	MaxActiveJobs int
+
+	// RetryAfter is suggested to clients whose builds were rejected.
+	RetryAfter time.Duration
+
+	// MaxJobAttempts limits attempts to run a job after transient failures, unless job sets its own limit.
+	MaxJobAttempts int
+
+	// JobTimeout is the timeout of the jobs which don't set their own, it covers downloads of the job inputs
+	// and execution of its commands. Zero means no limit.
+	JobTimeout time.Duration
+
+	// UploadTimeout is the time given to the client to upload source files of the build, the build fails after it.
+	// Zero means no limit.
+	UploadTimeout time.Duration
+
+	// WorkerTimeout is the time without heartbeats after which the worker is unregistered from the scheduler.
+	// Zero means workers are never unregistered.
+	WorkerTimeout time.Duration
+
+	// ActionCacheDir is the directory where results of successful jobs are stored to be replayed
+	// when their artifacts are found in cache. If it is empty, the latest results are kept in memory
+	// up to actioncache.DefaultMemoryLimit bytes.
+	ActionCacheDir string
+
+	// ArtifactStoreDir enables artifact store on the coordinator. Workers configured with the coordinator
+	// endpoint as their artifact store upload committed artifacts there, and the store serves them
+	// to other workers and clients when the worker having the artifact is lost.
+	ArtifactStoreDir string
+	// ArtifactStore overrides disk store in ArtifactStoreDir, the directory then keeps only local copies of artifacts.
+	ArtifactStore artifact.Store
+
+	// BazelCacheDir enables Bazel HTTP remote cache under /bazel endpoint of the coordinator,
+	// entries are kept in filecache at the directory.
+	BazelCacheDir string
+}
+
+var defaultConfig = Config{
+	Scheduler: scheduler.Config{
+		CacheTimeout: time.Millisecond * 10,
+		DepsTimeout:  time.Millisecond * 100,
+	},
+	RetryAfter:     time.Second * 10,
+	MaxJobAttempts: 3,
+	JobTimeout:     time.Hour,
+	UploadTimeout:  time.Minute * 10,
+	WorkerTimeout:  time.Minute,
 }
 
 func processFinishedJob(c *Coordinator, jobRes *api.JobResult, workerID *api.WorkerID) {
 	c.log.Debug("coordinator heartbeat received job finished", zap.String("jbp_id", jobRes.ID.String()))
-	c.scheduler.OnJobComplete(*workerID, jobRes.ID, jobRes)
+	if !c.scheduler.OnJobComplete(*workerID, jobRes.ID, jobRes) {
+		return
+	}
 
-	buildCh, ok := c.buildByJob.Load(jobRes.ID)
-	if !ok { // invariant
-		panic("heartbeat for undefined job")
+	if jobRes.Cached {
+		// worker had the artifact already, e.g. after restart, so output of its execution is replayed
+		timings := jobRes.Timings
+		jobRes = c.cachedResult(jobRes.ID)
+		jobRes.Timings = timings
+	} else if jobRes.Error == nil && jobRes.ExitCode == 0 {
+		if err := c.actions.Put(jobRes); err != nil {
+			c.log.Error("couldn't store job result", zap.String("job_id", jobRes.ID.String()), zap.Error(err))
+		}
+	}
+
+	c.mu.Lock()
+	builds := c.buildsByJob[jobRes.ID]
+	if len(builds) == 0 {
+		c.mu.Unlock()
+		c.log.Warn("job finished, but no build is waiting for it", zap.String("job_id", jobRes.ID.String()))
+		return
 	}
+	data := builds[0]
+	if len(builds) == 1 {
+		delete(c.buildsByJob, jobRes.ID)
+	} else {
+		c.buildsByJob[jobRes.ID] = builds[1:]
+	}
+	c.mu.Unlock()
 
-	data := <-buildCh.(chan *buildData)
 	c.log.Debug(fmt.Sprintf("found buildID %v for jobID %v", data.buildID, jobRes.ID))
 
+	if next := c.onBuildJobFinished(data, jobRes, *workerID); next != nil {
+		c.startBuild(next)
+	}
+}
+
+// onBuildJobFinished updates the build state and returns queued build that should be started next, if any.
+func (c *Coordinator) onBuildJobFinished(data *buildData, jobRes *api.JobResult, workerID api.WorkerID) *buildData {
 	data.mu.Lock()
 	defer data.mu.Unlock()
 
-	if data.stWriter == nil { // invariant
-		panic("data.StWriter is nil")
+	if data.finished {
+		return nil
 	}
 
-	sendStatus := func(upd *api.StatusUpdate) {
-		if err := data.stWriter.Updated(upd); err != nil {
-			// TODO: maybe send signal to finish building process with error for this build_id
-			c.log.Error("error during sending status of job", zap.Any("status", *upd), zap.String("job_id", jobRes.ID.String()), zap.Error(err))
+	res := *jobRes
+	res.Attempt = data.attempts[res.ID] + 1
+	data.summary.AddJob(data.jobByID[res.ID].Name, &res)
+	data.spans = append(data.spans, trace.Span{Job: data.jobByID[res.ID], Worker: workerID, Result: &res})
+
+	if res.Error != nil || res.ExitCode != 0 {
+		job := data.jobByID[res.ID]
+		cause := fmt.Sprintf("exit code %d", res.ExitCode)
+		if res.Error != nil {
+			cause = *res.Error
 		}
+
+		if res.Transient && res.Attempt < c.maxAttempts(job) {
+			c.log.Warn("retrying failed job",
+				zap.String("build_id", data.buildID.String()),
+				zap.String("job_id", res.ID.String()),
+				zap.Int("attempt", res.Attempt),
+				zap.String("cause", cause))
+
+			data.attempts[res.ID] = res.Attempt
+			data.sendStatus(c.log, &api.StatusUpdate{JobRetried: &api.JobRetried{ID: res.ID, Attempt: res.Attempt, Cause: cause}})
+
+			c.mu.Lock()
+			c.buildsByJob[res.ID] = append(c.buildsByJob[res.ID], data)
+			c.mu.Unlock()
+
+			if err := c.scheduleJob(data, job); err != nil {
+				return c.finishBuild(data, err)
+			}
+			return nil
+		}
+
+		data.sendStatus(c.log, &api.StatusUpdate{JobFinished: &res})
+		return c.finishBuild(data, fmt.Errorf("job %v failed after %d attempts: %s", res.ID, res.Attempt, cause))
 	}
 
-	upd := &api.StatusUpdate{JobFinished: jobRes}
-	sendStatus(upd)
+	data.sendStatus(c.log, &api.StatusUpdate{JobFinished: &res})
 
+	data.done[res.ID] = true
 	data.jobsDoneCnt++
+	c.updatePins(data, res.ID)
 	totalJobs := len(data.jobs)
 
-	c.log.Debug(fmt.Sprintf("job %v done, %v of %v jobs done for build %v", jobRes.ID, data.jobsDoneCnt, totalJobs, data.buildID))
+	c.log.Debug(fmt.Sprintf("job %v done, %v of %v jobs done for build %v", res.ID, data.jobsDoneCnt, totalJobs, data.buildID))
+
+	if data.jobsDoneCnt < totalJobs {
+		for _, id := range data.dependents[res.ID] {
+			if job := data.jobByID[id]; data.ready(job) {
+				if err := c.scheduleJob(data, job); err != nil {
+					return c.finishBuild(data, err)
+				}
+			}
+		}
+		c.sendProgress(data)
+		return nil
+	}
+
+	return c.finishBuild(data, nil)
+}
+
+func (c *Coordinator) maxAttempts(job *build.Job) int {
+	if job.MaxAttempts > 0 {
+		return job.MaxAttempts
+	}
+	return max(c.config.MaxJobAttempts, 1)
+}
+
+// finishBuild releases resources of the build and returns queued build that should be started next, if any.
+// Build fails if err is not nil. Requires data.mu to be held.
+func (c *Coordinator) finishBuild(data *buildData, err error) *buildData {
+	data.finished = true
+	c.scheduler.FinishBuild(data.buildID)
+
+	data.summary.Duration = time.Since(data.started)
+	if !data.uploaded.IsZero() {
+		data.summary.Upload = data.uploaded.Sub(data.started)
+	}
+	c.log.Info("build summary", zap.String("build_id", data.buildID.String()), zap.Stringer("summary", &data.summary))
 
-	if data.jobsDoneCnt == totalJobs {
+	if err != nil {
+		c.log.Error("build failed", zap.String("build_id", data.buildID.String()), zap.Error(err))
+		data.sendStatus(c.log, &api.StatusUpdate{BuildFailed: &api.BuildFailed{Error: err.Error(), Summary: data.summary}})
+	} else {
 		c.log.Debug(fmt.Sprintf("all jobs done for buildID %v", data.buildID))
+		data.sendStatus(c.log, &api.StatusUpdate{BuildFinished: &api.BuildFinished{Summary: data.summary}})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.builds.Delete(data.buildID)
+	c.keepTrace(data.buildID, data.spans)
+	c.releaseJobs(data)
+	c.runningBuilds--
 
-		upd := &api.StatusUpdate{BuildFinished: &api.BuildFinished{}}
-		sendStatus(upd)
+	// builds still uploading their files keep their place in the queue
+	i := slices.IndexFunc(c.queuedBuilds, func(b *buildData) bool { return b.filesReady })
+	if i < 0 {
+		return nil
 	}
+
+	next := c.queuedBuilds[i]
+	c.queuedBuilds = slices.Delete(c.queuedBuilds, i, i+1)
+	c.runningBuilds++
+	return next
+}
+
+// updatePins pins artifact of the job done in the build if its dependents are not done yet, and unpins artifacts
+// of the job dependencies which are not needed anymore. Requires data.mu to be held.
+func (c *Coordinator) updatePins(data *buildData, id build.ID) {
+	needed := func(id build.ID) bool {
+		return slices.ContainsFunc(data.dependents[id], func(dep build.ID) bool { return !data.done[dep] })
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if needed(id) {
+		data.pinned[id] = true
+		c.pins.add(id)
+	}
+	for _, dep := range data.jobByID[id].Deps {
+		if data.pinned[dep] && !needed(dep) {
+			delete(data.pinned, dep)
+			c.pins.remove(dep)
+		}
+	}
+}
+
+// releaseJobs frees place taken by the build jobs in admit and unpins artifacts needed by the build.
+// Requires c.mu and data.mu to be held.
+func (c *Coordinator) releaseJobs(data *buildData) {
+	for id := range data.pinned {
+		c.pins.remove(id)
+	}
+	clear(data.pinned)
+
+	// failed build may still wait for some jobs
+	for _, j := range data.jobs {
+		builds := slices.DeleteFunc(c.buildsByJob[j.ID], func(b *buildData) bool { return b == data })
+		if len(builds) == 0 {
+			delete(c.buildsByJob, j.ID)
+		} else {
+			c.buildsByJob[j.ID] = builds
+		}
+	}
+	c.activeJobs -= len(data.jobs)
+}
+
+// dropBuild forgets the build which was not started because its files were not uploaded.
+// Requires data.mu to be held.
+func (c *Coordinator) dropBuild(data *buildData) {
+	data.finished = true
+	if data.uploadTimer != nil {
+		data.uploadTimer.Stop()
+	}
+	c.scheduler.FinishBuild(data.buildID)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.builds.Delete(data.buildID)
+	c.queuedBuilds = slices.DeleteFunc(c.queuedBuilds, func(b *buildData) bool { return b == data })
+	c.releaseJobs(data)
+}
+
+// expireUpload fails the build whose files were not uploaded in UploadTimeout.
+func (c *Coordinator) expireUpload(data *buildData) {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	c.mu.Lock()
+	uploaded := data.filesReady
+	c.mu.Unlock()
+	if data.finished || uploaded {
+		return
+	}
+
+	c.dropBuild(data)
+	data.summary.Duration = time.Since(data.started)
+
+	err := fmt.Errorf("source files of build %v were not uploaded in %v", data.buildID, c.config.UploadTimeout)
+	c.log.Error("build failed", zap.String("build_id", data.buildID.String()), zap.Error(err))
+	data.sendStatus(c.log, &api.StatusUpdate{BuildFailed: &api.BuildFailed{Error: err.Error(), Summary: data.summary}})
+}
+
+// maxFinishedTraces is the number of the latest finished builds whose traces are served.
+const maxFinishedTraces = 128
+
+// keepTrace keeps spans of the finished build, so that its trace is served after the build is forgotten.
+// Only traces of the latest builds are kept. Requires c.mu to be held.
+func (c *Coordinator) keepTrace(id build.ID, spans []trace.Span) {
+	c.traces[id] = spans
+	c.traceOrder = append(c.traceOrder, id)
+	if len(c.traceOrder) > maxFinishedTraces {
+		delete(c.traces, c.traceOrder[0])
+		c.traceOrder = c.traceOrder[1:]
+	}
+}
+
+// scheduleJob passes job, which dependencies are done, to scheduler. Requires data.mu to be held.
+func (c *Coordinator) scheduleJob(data *buildData, job *build.Job) error {
+	sourceFiles := make(map[build.ID]string)
+	for _, sf := range job.Inputs {
+		sourceFiles[data.fileIDByName[sf]] = sf
+	}
+
+	arts := make(map[build.ID]api.WorkerID, len(job.Deps))
+	replicas := make(map[build.ID][]api.WorkerID, len(job.Deps))
+	for _, dep := range job.Deps {
+		locations := c.scheduler.LocateArtifactReplicas(dep)
+		if len(locations) == 0 {
+			return fmt.Errorf("artifact %v required by job %v not found", dep, job.ID)
+		}
+		arts[dep] = locations[0]
+		if len(locations) > 1 {
+			replicas[dep] = locations[1:]
+		}
+	}
+
+	spec := &api.JobSpec{Job: *job, SourceFiles: sourceFiles, Artifacts: arts, ArtifactReplicas: replicas, Queued: time.Now()}
+	if spec.Timeout == 0 {
+		spec.Timeout = c.config.JobTimeout
+	}
+	c.scheduler.ScheduleBuildJob(data.buildID, spec)
+	return nil
+}
+
+// startBuild schedules all jobs of the build that are ready to run.
+func (c *Coordinator) startBuild(data *buildData) {
+	for data != nil {
+		data = c.scheduleBuild(data)
+	}
+}
+
+func (c *Coordinator) scheduleBuild(data *buildData) *buildData {
+	data.mu.Lock()
+	defer data.mu.Unlock()
+
+	c.log.Debug("start scheduling build", zap.String("build_id", data.buildID.String()))
+
+	if len(data.jobs) == 0 {
+		return c.finishBuild(data, nil)
+	}
+
+	c.scheduler.RegisterJobs(data.buildID, data.jobs)
+	for i := range data.jobs {
+		if job := &data.jobs[i]; data.ready(job) {
+			if err := c.scheduleJob(data, job); err != nil {
+				return c.finishBuild(data, err)
+			}
+		}
+	}
+	c.sendProgress(data)
+	return nil
+}
+
+// progressUpdates limits the number of progress updates of the build, since computing ETA takes time
+// linear in the build size.
+const progressUpdates = 100
+
+// sendProgress sends the number of done jobs and ETA of the build, once per 1/progressUpdates of the jobs done.
+// Requires data.mu to be held.
+func (c *Coordinator) sendProgress(data *buildData) {
+	if step := max(len(data.jobs)/progressUpdates, 1); data.jobsDoneCnt%step != 0 {
+		return
+	}
+
+	var left []build.Job
+	for _, job := range data.jobs {
+		if !data.done[job.ID] {
+			left = append(left, job)
+		}
+	}
+
+	data.sendStatus(c.log, &api.StatusUpdate{BuildProgress: &api.BuildProgress{
+		Done:  data.jobsDoneCnt,
+		Total: len(data.jobs),
+		ETA:   c.scheduler.Remaining(data.buildID, left),
+	}})
 }
 
 func (c *Coordinator) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	c.expireWorkers(req.WorkerID)
+
+	for _, id := range req.AddedArtifacts {
+		c.scheduler.AddArtifactReplica(req.WorkerID, id)
+	}
+	// store is added after the worker, so that downloads fall back to it only when the worker is unavailable,
+	// and before finished jobs, so that their dependents know about the store replica
+	for _, id := range req.StoredArtifacts {
+		c.scheduler.AddArtifactReplica(req.ArtifactStore, id)
+	}
 	for _, finished := range req.FinishedJob {
 		processFinishedJob(c, &finished, &req.WorkerID)
 	}
+	for _, id := range req.RemovedArtifacts {
+		c.scheduler.RemoveArtifactReplica(req.WorkerID, id)
+	}
 	var resp api.HeartbeatResponse
 	resp.JobsToRun = make(map[build.ID]api.JobSpec)
+	resp.CancelJobs = c.scheduler.CancelledJobs(req.WorkerID)
 
 	for i := 0; i < req.FreeSlots; i++ {
-		job := c.scheduler.PickJob(ctx, req.WorkerID)
+		// only idle worker waits for jobs, busy worker must get cancellations and report results without delay
+		var job *scheduler.PendingJob
+		if i == 0 && len(req.RunningJobs) == 0 {
+			job = c.scheduler.PickJob(ctx, req.WorkerID)
+		} else {
+			job = c.scheduler.TryPickJob(req.WorkerID)
+		}
 		if job == nil {
 			c.log.Debug("PickJob returned nil")
 			break
 		}
 		if wID, ok := c.scheduler.LocateArtifact(job.Job.ID); ok {
 			c.log.Info(fmt.Sprintf("skip job %v because it's artiffact is already in cache", job.Job.ID))
-			processFinishedJob(c, &api.JobResult{ID: job.Job.ID}, &wID)
+			processFinishedJob(c, &api.JobResult{ID: job.Job.ID, Cached: true}, &wID)
 			continue
 		}
-		resp.JobsToRun[job.Job.ID] = *job.Job
+		spec := *job.Job
+		spec.Assigned = time.Now()
+		resp.JobsToRun[spec.ID] = spec
 	}
+	// jobs skipped above are done already, their artifacts must be pinned before the worker evicts them
+	c.mu.Lock()
+	resp.PinnedArtifacts, resp.UnpinnedArtifacts, resp.ResetPins = c.pins.since(req.PinsVersion)
+	resp.PinsVersion = c.pins.version
+	c.mu.Unlock()
 
 	return &resp, nil
 }
 
-func (c *Coordinator) StartBuild(ctx context.Context, req *api.BuildRequest, w api.StatusWriter) error {
-	c.log.Debug("service StartBuild starts", zap.Any("req", *req))
-	id := build.NewID()
+// expireWorkers records heartbeat of the worker and unregisters workers which didn't send heartbeats
+// for WorkerTimeout.
+func (c *Coordinator) expireWorkers(workerID api.WorkerID) {
+	if c.config.WorkerTimeout <= 0 {
+		return
+	}
 
-	fileIDByName := make(map[string]build.ID)
+	now := time.Now()
+	var expired []api.WorkerID
+	c.mu.Lock()
+	c.lastHeartbeat[workerID] = now
+	for id, at := range c.lastHeartbeat {
+		if now.Sub(at) > c.config.WorkerTimeout {
+			expired = append(expired, id)
+			delete(c.lastHeartbeat, id)
+		}
+	}
+	c.mu.Unlock()
 
-	needFiles := make([]build.ID, 0, len(req.Graph.SourceFiles))
-	for fileID, fileName := range req.Graph.SourceFiles {
-		fileIDByName[fileName] = fileID
-		if _, unlock, err := c.files.Get(fileID); err != nil { // check if file is in cache
-			needFiles = append(needFiles, fileID)
-		} else {
-			unlock()
+	for _, id := range expired {
+		c.log.Info("worker stopped sending heartbeats", zap.String("worker_id", string(id)))
+		c.scheduler.UnregisterWorker(id)
+	}
+}
+
+// cachedResult returns stored result of the job which artifact was found in cache. Empty result is returned
+// if it is not stored, e.g. because the artifact was created before coordinator restart.
+func (c *Coordinator) cachedResult(id build.ID) *api.JobResult {
+	res, err := c.actions.Get(id)
+	if err != nil {
+		if !errors.Is(err, actioncache.ErrNotFound) {
+			c.log.Error("couldn't get stored job result", zap.String("job_id", id.String()), zap.Error(err))
 		}
+		res = &api.JobResult{ID: id}
 	}
+	res.Cached = true
+	return res
+}
+
+// admit reserves place for the build jobs or returns error if coordinator is overloaded
+// or the build exceeds its limits.
+func (c *Coordinator) admit(data *buildData) error {
+	if c.config.MaxActiveJobs > 0 && len(data.jobs) > c.config.MaxActiveJobs {
+		return &api.TooLargeError{
+			Reason: fmt.Sprintf("build has %d jobs, limit is %d", len(data.jobs), c.config.MaxActiveJobs),
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	data := buildData{jobs: build.TopSort(req.Graph.Jobs), stWriter: w, fileIDByName: fileIDByName, buildID: id}
+	if c.config.MaxActiveJobs > 0 && c.activeJobs+len(data.jobs) > c.config.MaxActiveJobs {
+		return &api.OverloadedError{
+			Reason:     fmt.Sprintf("%d jobs are active, limit is %d", c.activeJobs, c.config.MaxActiveJobs),
+			RetryAfter: c.config.RetryAfter,
+		}
+	}
+
+	c.activeJobs += len(data.jobs)
+	for _, j := range data.jobs {
+		c.buildsByJob[j.ID] = append(c.buildsByJob[j.ID], data)
+	}
+	return nil
+}
+
+// enqueue puts the build into the queue if MaxBuilds builds are running and returns its position.
+// Requires c.mu to be held.
+func (c *Coordinator) enqueue(data *buildData) (position int, queued bool) {
+	if c.config.MaxBuilds <= 0 || c.runningBuilds < c.config.MaxBuilds {
+		return 0, false
+	}
+	c.queuedBuilds = append(c.queuedBuilds, data)
+	return len(c.queuedBuilds) - 1, true
+}
+
+// sendQueued notifies the client that the build waits in the queue. Requires data.mu to be held.
+func (c *Coordinator) sendQueued(data *buildData, position int) {
+	c.log.Info("build queued", zap.String("build_id", data.buildID.String()), zap.Int("position", position))
+	data.sendStatus(c.log, &api.StatusUpdate{BuildQueued: &api.BuildQueued{Position: position}})
+}
+
+func (c *Coordinator) StartBuild(ctx context.Context, req *api.BuildRequest, w api.StatusWriter) error {
+	c.log.Debug("service StartBuild starts", zap.Any("req", *req))
+	id := build.NewID()
+
+	needFiles := c.files.Missing(slices.Collect(maps.Keys(req.Graph.SourceFiles)))
+
+	data := newBuildData(id, &req.Graph, w)
 	data.mu.Lock()
 	defer data.mu.Unlock()
 
-	for _, j := range req.Graph.Jobs {
-		buildCh, _ := c.buildByJob.LoadOrStore(j.ID, make(chan *buildData, 10))
-		buildCh.(chan *buildData) <- &data
+	if err := c.admit(data); err != nil {
+		c.log.Warn("build rejected", zap.String("build_id", id.String()), zap.Error(err))
+		return err
 	}
+	c.scheduler.StartBuild(id, req.User, req.Priority)
+
+	// build is queued right away, so that the client uploads files while it waits for its turn
+	c.mu.Lock()
+	position, queued := c.enqueue(data)
+	c.mu.Unlock()
 
-	c.builds.Store(id, &data)
+	c.builds.Store(id, data)
 	if data.stWriter == nil { // invariant
 		panic("data.StWriter is nil")
 	}
 	if err := data.stWriter.Started(&api.BuildStarted{ID: id, MissingFiles: needFiles}); err != nil {
+		c.dropBuild(data)
 		return fmt.Errorf("couldn't send started status of build %v: %w", id, err)
 	}
+	if c.config.UploadTimeout > 0 {
+		data.uploadTimer = time.AfterFunc(c.config.UploadTimeout, func() { c.expireUpload(data) })
+	}
+	if queued {
+		c.sendQueued(data, position)
+	}
 
 	return nil
 }
@@ -148,35 +693,56 @@ func (c *Coordinator) StartBuild(ctx context.Context, req *api.BuildRequest, w a
 func (c *Coordinator) SignalBuild(ctx context.Context, buildID build.ID, req *api.SignalRequest) (*api.SignalResponse, error) {
 	c.log.Debug("service SignalBuild starts", zap.String("build_id", buildID.String()), zap.Any("req", *req))
 	data_, ok := c.builds.Load(buildID)
-	if !ok { // invariant
-		panic(fmt.Sprintf("no data for buildID: %v", buildID))
+	if !ok {
+		return nil, fmt.Errorf("unknown build %v", buildID)
 	}
 	data := data_.(*buildData)
 
-	data.mu.Lock()
-	defer data.mu.Unlock()
-
 	if req.UploadDone != nil {
-		for _, job := range data.jobs {
+		// data.mu is held until the build is started or queued, so that upload deadline doesn't drop it meanwhile
+		data.mu.Lock()
+		if data.finished {
+			data.mu.Unlock()
+			return nil, fmt.Errorf("build %v is finished", buildID)
+		}
 
-			sourceFiles := make(map[build.ID]string)
+		c.mu.Lock()
+		if data.filesReady {
+			c.mu.Unlock()
+			data.mu.Unlock()
+			return nil, fmt.Errorf("files of build %v are uploaded already", buildID)
+		}
+		data.filesReady = true
+		data.uploaded = time.Now()
+		if data.uploadTimer != nil {
+			data.uploadTimer.Stop()
+		}
 
-			for _, sf := range job.Inputs {
-				sourceFiles[data.fileIDByName[sf]] = sf
+		start, queued := false, false
+		var position int
+		i := slices.Index(c.queuedBuilds, data)
+		switch {
+		case c.config.MaxBuilds <= 0 || c.runningBuilds < c.config.MaxBuilds:
+			// queued build could not be started while its files were uploading
+			if i >= 0 {
+				c.queuedBuilds = slices.Delete(c.queuedBuilds, i, i+1)
 			}
+			c.runningBuilds++
+			start = true
+		case i >= 0:
+			// build keeps its place in the queue, finishBuild of a running build starts it
+		default:
+			position, queued = c.enqueue(data)
+		}
+		c.mu.Unlock()
 
-			arts := make(map[build.ID]api.WorkerID, len(job.Deps))
+		if queued {
+			c.sendQueued(data, position)
+		}
+		data.mu.Unlock()
 
-			for _, dep := range job.Deps {
-				for {
-					if wID, ok := c.scheduler.LocateArtifact(dep); ok {
-						arts[dep] = wID
-						break
-					}
-					time.Sleep(10 * time.Millisecond)
-				}
-			}
-			c.scheduler.ScheduleJob(&api.JobSpec{Job: job, SourceFiles: sourceFiles, Artifacts: arts})
+		if start {
+			c.startBuild(data)
 		}
 	}
 
@@ -187,18 +753,76 @@ func NewCoordinator(
 	log *zap.Logger,
 	fileCache *filecache.Cache,
 ) *Coordinator {
+	c, err := NewCoordinatorWithConfig(log, fileCache, defaultConfig)
+	if err != nil { // invariant
+		panic(fmt.Sprintf("default coordinator config is invalid: %v", err))
+	}
+	return c
+}
+
+func NewCoordinatorWithConfig(
+	log *zap.Logger,
+	fileCache *filecache.Cache,
+	config Config,
+) (*Coordinator, error) {
+	s, err := scheduler.NewScheduler(log, config.Scheduler)
+	if err != nil {
+		return nil, err
+	}
+
+	actions := actioncache.NewMemory(actioncache.DefaultMemoryLimit)
+	if config.ActionCacheDir != "" {
+		if actions, err = actioncache.New(config.ActionCacheDir); err != nil {
+			log.Error("job results are kept only in memory", zap.Error(err))
+			actions = actioncache.NewMemory(actioncache.DefaultMemoryLimit)
+		}
+	}
+
 	c := Coordinator{
-		log:       log,
-		files:     fileCache,
-		scheduler: scheduler.NewScheduler(log, defaultConfig),
-		mux:       http.NewServeMux(),
+		log:           log,
+		actions:       actions,
+		files:         fileCache,
+		scheduler:     s,
+		config:        config,
+		buildsByJob:   make(map[build.ID][]*buildData),
+		lastHeartbeat: make(map[api.WorkerID]time.Time),
+		traces:        make(map[build.ID][]trace.Span),
+		pins:          newPins(),
+		mux:           http.NewServeMux(),
 	}
 
 	api.NewHeartbeatHandler(log, &c).Register(c.mux)
 	api.NewBuildService(log, &c).Register(c.mux)
 	filecache.NewHandler(log, fileCache).Register(c.mux)
+	c.mux.HandleFunc("GET /builds/{id}/trace", c.serveTrace)
+
+	if config.ArtifactStoreDir != "" {
+		newStore := artifact.NewCache
+		if config.ArtifactStore != nil {
+			newStore = func(root string) (*artifact.Cache, error) {
+				return artifact.NewCacheWithStore(root, config.ArtifactStore)
+			}
+		}
+		if store, err := newStore(config.ArtifactStoreDir); err != nil {
+			log.Error("artifact store is disabled", zap.Error(err))
+		} else {
+			handler := artifact.NewHandler(log, store)
+			handler.Register(c.mux)
+			handler.RegisterStore(c.mux)
+		}
+	}
 
-	return &c
+	if config.BazelCacheDir != "" {
+		if cache, err := filecache.New(config.BazelCacheDir); err != nil {
+			log.Error("bazel remote cache is disabled", zap.Error(err))
+		} else {
+			mux := http.NewServeMux()
+			bazelcache.NewHandler(log.Named("bazelcache"), cache).Register(mux)
+			c.mux.Handle("/bazel/", http.StripPrefix("/bazel", mux))
+		}
+	}
+
+	return &c, nil
 }
 
 func (c *Coordinator) Stop() {
@@ -208,3 +832,34 @@ func (c *Coordinator) Stop() {
 func (c *Coordinator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.mux.ServeHTTP(w, r)
 }
+
+// serveTrace returns timeline of the build jobs in Chrome trace event format.
+func (c *Coordinator) serveTrace(w http.ResponseWriter, r *http.Request) {
+	var id build.ID
+	if err := id.UnmarshalText([]byte(r.PathValue("id"))); err != nil {
+		http.Error(w, fmt.Sprintf("invalid build id: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var t *trace.Trace
+	if data_, ok := c.builds.Load(id); ok {
+		data := data_.(*buildData)
+		data.mu.Lock()
+		t = trace.New(data.spans)
+		data.mu.Unlock()
+	} else {
+		c.mu.Lock()
+		spans, ok := c.traces[id]
+		c.mu.Unlock()
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown build %v", id), http.StatusNotFound)
+			return
+		}
+		t = trace.New(spans)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t); err != nil {
+		c.log.Error("error during writing trace", zap.String("build_id", id.String()), zap.Error(err))
+	}
+}
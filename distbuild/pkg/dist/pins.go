@@ -0,0 +1,79 @@
+//go:build !solution
+
+package dist
+
+import (
+	"maps"
+	"slices"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// maxPinChanges is the number of the latest changes of pinned artifacts kept for workers.
+// Worker lagging behind more receives all pinned artifacts.
+const maxPinChanges = 4096
+
+type pinChange struct {
+	id     build.ID
+	pinned bool
+}
+
+// pins tracks artifacts needed by running builds. Changes of the set are numbered by versions,
+// so that workers receive only changes since the version they know.
+type pins struct {
+	// count is the number of builds needing the artifact
+	count   map[build.ID]int
+	version int64
+	// changes are the latest changes, the last one has number version
+	changes []pinChange
+}
+
+func newPins() *pins {
+	return &pins{count: make(map[build.ID]int)}
+}
+
+func (p *pins) add(id build.ID) {
+	p.count[id]++
+	if p.count[id] == 1 {
+		p.record(id, true)
+	}
+}
+
+func (p *pins) remove(id build.ID) {
+	p.count[id]--
+	if p.count[id] <= 0 {
+		delete(p.count, id)
+		p.record(id, false)
+	}
+}
+
+func (p *pins) record(id build.ID, pinned bool) {
+	p.version++
+	p.changes = append(p.changes, pinChange{id: id, pinned: pinned})
+	// old changes are dropped in batches, so that recording stays amortized O(1)
+	if len(p.changes) > 2*maxPinChanges {
+		p.changes = slices.Clone(p.changes[len(p.changes)-maxPinChanges:])
+	}
+}
+
+// since returns changes made after the version. All pinned artifacts are returned with reset set if the changes
+// are not kept anymore, or the version is unknown, e.g. it is zero or was issued before coordinator restart.
+func (p *pins) since(version int64) (pinned, unpinned []build.ID, reset bool) {
+	first := p.version - int64(len(p.changes))
+	if version <= 0 || version < first || version > p.version {
+		return slices.Collect(maps.Keys(p.count)), nil, true
+	}
+
+	latest := make(map[build.ID]bool)
+	for _, change := range p.changes[version-first:] {
+		latest[change.id] = change.pinned
+	}
+	for id, pin := range latest {
+		if pin {
+			pinned = append(pinned, id)
+		} else {
+			unpinned = append(unpinned, id)
+		}
+	}
+	return pinned, unpinned, false
+}
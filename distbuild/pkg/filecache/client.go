@@ -3,41 +3,82 @@
 package filecache
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"maps"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 
 	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/retry"
 )
 
 type Client struct {
 	logger   *zap.Logger
 	endpoint string
 	client   *http.Client
+	retry    retry.Policy
 }
 
 func NewClient(l *zap.Logger, endpoint string) *Client {
-	return &Client{l, endpoint, &http.Client{}}
+	return &Client{l, endpoint, &http.Client{}, retry.DefaultPolicy}
 }
 
+// SetRetryPolicy changes retry policy of Download.
+func (c *Client) SetRetryPolicy(p retry.Policy) {
+	c.retry = p
+}
+
+// hashFile returns size and sha256 digest of the file content.
+func hashFile(f *os.File) (int64, build.Digest, error) {
+	var d build.Digest
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return 0, d, err
+	}
+	h.Sum(d[:0])
+	return size, d, nil
+}
+
+// Upload streams the file to the remote cache. Content is hashed before the upload, so that the remote cache
+// rejects the file if it changes or the stream is cut.
 func (c *Client) Upload(ctx context.Context, id build.ID, localPath string) error {
-	content, err := os.ReadFile(localPath)
+	f, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("couldn't read file %v: %w", localPath, err)
 	}
+	defer f.Close()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.endpoint+"/file", bytes.NewReader(content))
+	size, digest, err := hashFile(f)
+	if err != nil {
+		return fmt.Errorf("couldn't read file %v: %w", localPath, err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("couldn't read file %v: %w", localPath, err)
+	}
+
+	// request closes the body, but the file must stay open for the deferred Close
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, c.endpoint+"/file", io.NopCloser(f))
 	if err != nil {
 		return fmt.Errorf("error during creating request: %w", err)
 	}
+	req.ContentLength = size
 
 	req.Header.Set("id", id.String())
+	req.Header.Set("digest", digest.String())
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -57,7 +98,198 @@ func (c *Client) Upload(ctx context.Context, id build.ID, localPath string) erro
 	return nil
 }
 
+const (
+	// files smaller than batchFileSize are packed into batches up to batchSize bytes
+	batchFileSize = 1 << 20
+	batchSize     = 4 << 20
+	batchCount    = 1024
+	// uploadParallelism limits number of concurrent uploads of UploadFiles
+	uploadParallelism = 8
+)
+
+// Missing returns files which are not in the remote cache.
+func (c *Client) Missing(ctx context.Context, ids []build.ID) ([]build.ID, error) {
+	body, err := json.Marshal(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/files/missing", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error during creating request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error during /files/missing request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("bad response from /files/missing, status_code: %v, body: %s", resp.StatusCode, buf)
+	}
+
+	var missing []build.ID
+	if err := json.NewDecoder(resp.Body).Decode(&missing); err != nil {
+		return nil, fmt.Errorf("error during decoding missing files: %w", err)
+	}
+	return missing, nil
+}
+
+// writeBatch packs files into tar stream, entries are named by file ids and keep digests of the content.
+func writeBatch(w io.Writer, ids []build.ID, files map[build.ID]string) error {
+	tw := tar.NewWriter(w)
+	for _, id := range ids {
+		err := func() error {
+			f, err := os.Open(files[id])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			size, digest, err := hashFile(f)
+			if err != nil {
+				return err
+			}
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag:   tar.TypeReg,
+				Name:       id.String(),
+				Size:       size,
+				Mode:       0o644,
+				PAXRecords: map[string]string{digestRecord: digest.String()},
+			}); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, f)
+			return err
+		}()
+		if err != nil {
+			return fmt.Errorf("couldn't pack file %v: %w", files[id], err)
+		}
+	}
+	return tw.Close()
+}
+
+// UploadBatch uploads files in one request. Files which exist in the remote cache are skipped by it.
+func (c *Client) UploadBatch(ctx context.Context, files map[build.ID]string) error {
+	ids := slices.SortedFunc(maps.Keys(files), func(a, b build.ID) int {
+		return bytes.Compare(a[:], b[:])
+	})
+
+	pr, pw := io.Pipe()
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		_ = pw.CloseWithError(writeBatch(pw, ids, files))
+	}()
+	defer func() {
+		// request may fail before the body is read
+		_ = pr.CloseWithError(errors.New("upload finished"))
+		<-sent
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint+"/files", pr)
+	if err != nil {
+		return fmt.Errorf("error during creating request: %w", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error during /files request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("bad response from /files, %d files, status_code: %v, body: %s", len(ids), resp.StatusCode, buf)
+	}
+	return nil
+}
+
+// UploadFiles uploads files without checking which of them the remote cache has, callers pass files
+// known to be missing there, e.g. reported by Missing. Small files are packed into batches,
+// batches and large files are uploaded in parallel.
+func (c *Client) UploadFiles(ctx context.Context, files map[build.ID]string) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(uploadParallelism)
+
+	batch := make(map[build.ID]string)
+	var size int64
+	flush := func() {
+		files := batch
+		g.Go(func() error { return c.UploadBatch(ctx, files) })
+		batch = make(map[build.ID]string)
+		size = 0
+	}
+
+	for id, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			_ = g.Wait()
+			return fmt.Errorf("couldn't read file %v: %w", path, err)
+		}
+
+		if info.Size() >= batchFileSize {
+			g.Go(func() error { return c.Upload(ctx, id, path) })
+			continue
+		}
+
+		batch[id] = path
+		size += info.Size()
+		if size >= batchSize || len(batch) >= batchCount {
+			flush()
+		}
+	}
+	if len(batch) != 0 {
+		flush()
+	}
+
+	return g.Wait()
+}
+
+// partialFile is the file being written to the local cache. It is kept between download attempts,
+// so that the next attempt requests only the rest of the file.
+type partialFile struct {
+	w     io.WriteCloser
+	abort func() error
+	hash  hash.Hash
+
+	written int64
+	// size is negative if it is unknown
+	size   int64
+	digest *build.Digest
+}
+
+// Download retries transient failures according to the client retry policy, attempts resume the file
+// received partially. It is not an error if file is already in local cache. ErrNotFound is returned
+// if remote cache doesn't have the file.
 func (c *Client) Download(ctx context.Context, localCache *Cache, id build.ID) error {
+	var p *partialFile
+	err := c.retry.Do(ctx, func(attempt int) error {
+		err := c.download(ctx, localCache, id, &p)
+		if err != nil && !errors.Is(err, ErrExists) {
+			c.logger.Warn("file download failed", zap.String("file_id", id.String()), zap.Int("attempt", attempt), zap.Error(err))
+		}
+		return err
+	})
+	if p != nil {
+		if abortErr := p.abort(); abortErr != nil {
+			c.logger.Error("couldn't abort writing file", zap.String("file_id", id.String()), zap.Error(abortErr))
+		}
+	}
+	if errors.Is(err, ErrExists) {
+		return nil
+	}
+	return err
+}
+
+// download receives the file or the rest of partial file p. Partial file is kept in p if the stream is cut.
+func (c *Client) download(ctx context.Context, localCache *Cache, id build.ID, p **partialFile) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint+"/file", nil)
 	if err != nil {
 		err = fmt.Errorf("error during creating /file request: %w", err)
@@ -65,6 +297,11 @@ func (c *Client) Download(ctx context.Context, localCache *Cache, id build.ID) e
 		return err
 	}
 	req.Header.Set("id", id.String())
+	// without digest it is unknown whether the file has the same content, so it is downloaded again
+	if *p != nil && (*p).digest != nil && (*p).written > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", (*p).written))
+		req.Header.Set("If-Range", strconv.Quote((*p).digest.String()))
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
@@ -73,41 +310,87 @@ func (c *Client) Download(ctx context.Context, localCache *Cache, id build.ID) e
 		return err
 	}
 
-	buf, err := io.ReadAll(resp.Body)
-	resp.Body.Close()
-	if err != nil {
-		err = fmt.Errorf("error during reading /file response: %w", err)
-		c.logger.Error(err.Error())
-		return err
-	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		buf, err := io.ReadAll(resp.Body)
+		if err != nil {
+			err = fmt.Errorf("error during reading /file response: %w", err)
+			c.logger.Error(err.Error())
+			return err
+		}
 		c.logger.Error(
 			"/file request returned with error",
 			zap.Int("status_code", resp.StatusCode),
 			zap.String("error", string(buf)),
 		)
+		if resp.StatusCode == http.StatusNotFound {
+			return retry.Permanent(fmt.Errorf("file %v: %w", id, ErrNotFound))
+		}
+		if resp.StatusCode == http.StatusBadRequest {
+			return retry.Permanent(errors.New(string(buf)))
+		}
 		return errors.New(string(buf))
 	}
 
-	writeCloser, abort, err := localCache.Write(id)
+	digest, err := parseDigest(resp.Header.Get("digest"))
 	if err != nil {
-		err = fmt.Errorf("error during adding file to local cache: %w", err)
-		c.logger.Error(err.Error())
-		return err
+		return retry.Permanent(err)
+	}
+
+	if resp.StatusCode == http.StatusOK && *p != nil {
+		// remote cache sends the whole file
+		if err := (*p).abort(); err != nil {
+			return fmt.Errorf("error during aborting partial file %v: %w", id, err)
+		}
+		*p = nil
+	}
+	if *p == nil {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("file %v: unexpected status_code %v", id, resp.StatusCode)
+		}
+
+		w, abort, err := localCache.Write(id)
+		if err != nil {
+			return retry.Permanent(fmt.Errorf("error during adding file to local cache: %w", err))
+		}
+		*p = &partialFile{w: w, abort: abort, hash: sha256.New(), size: resp.ContentLength, digest: digest}
 	}
-	defer writeCloser.Close()
 
-	_, err = writeCloser.Write(buf)
+	f := *p
+	n, err := io.Copy(io.MultiWriter(f.w, f.hash), resp.Body)
+	f.written += n
 	if err != nil {
-		err = fmt.Errorf("error during writing file %v content to local cache: %w", id, err)
+		// next attempt resumes the file
+		err = fmt.Errorf("error during receiving file %v, %d bytes received: %w", id, f.written, err)
 		c.logger.Error(err.Error())
-		abortErr := abort()
-		if abortErr != nil {
-			c.logger.Error("couldn't abort writing file", zap.String("file_id", id.String()), zap.Error(abortErr))
-		}
 		return err
 	}
 
+	*p = nil
+	if err := f.commit(id); err != nil {
+		err = fmt.Errorf("error during receiving file %v: %w", id, err)
+		c.logger.Error(err.Error())
+		return err
+	}
 	return nil
 }
+
+// commit checks size and digest of the received file and commits it to the cache or aborts.
+func (f *partialFile) commit(id build.ID) error {
+	var err error
+	if f.size >= 0 && f.written != f.size {
+		err = fmt.Errorf("received %d bytes of %d: %w", f.written, f.size, io.ErrUnexpectedEOF)
+	}
+	if err == nil && f.digest != nil {
+		var actual build.Digest
+		f.hash.Sum(actual[:0])
+		if actual != *f.digest {
+			err = fmt.Errorf("file %v has digest %v instead of %v: %w", id, actual, *f.digest, ErrCorrupted)
+		}
+	}
+	if err != nil {
+		return errors.Join(err, f.abort())
+	}
+	return f.w.Close()
+}
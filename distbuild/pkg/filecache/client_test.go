@@ -3,12 +3,21 @@ package filecache_test
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,6 +25,7 @@ import (
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/retry"
 )
 
 type env struct {
@@ -127,3 +137,286 @@ func TestFileDownload(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, []byte("foobar"), content)
 }
+
+func TestFileDownloadRetry(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	cache := newCache(t)
+	localCache := newCache(t)
+
+	mux := http.NewServeMux()
+	filecache.NewHandler(l, cache.Cache).Register(mux)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			http.Error(w, "connection reset", http.StatusServiceUnavailable)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := filecache.NewClient(l, server.URL)
+	client.SetRetryPolicy(retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+
+	id := build.ID{0x01}
+	w, abort, err := cache.Write(id)
+	require.NoError(t, err)
+	defer func() { _ = abort() }()
+	_, err = w.Write([]byte("foobar"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	ctx := context.Background()
+	require.NoError(t, client.Download(ctx, localCache.Cache, id))
+	require.Equal(t, 2, requests)
+
+	// missing file is not retried
+	require.Error(t, client.Download(ctx, localCache.Cache, build.ID{0x02}))
+	require.Equal(t, 3, requests)
+}
+
+func TestFileDownloadCut(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	localCache := newCache(t)
+
+	digest := sha256.Sum256([]byte("foobar"))
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("digest", hex.EncodeToString(digest[:]))
+		w.Header().Set("Content-Length", "6")
+		switch requests {
+		case 1:
+			_, _ = w.Write([]byte("foo"))
+		case 2:
+			_, _ = w.Write([]byte("foobaz"))
+		default:
+			_, _ = w.Write([]byte("foobar"))
+		}
+	}))
+	defer server.Close()
+
+	client := filecache.NewClient(l, server.URL)
+	client.SetRetryPolicy(retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+
+	// cut and corrupted streams are aborted and downloaded again
+	id := build.ID{0x01}
+	require.NoError(t, client.Download(context.Background(), localCache.Cache, id))
+	require.Equal(t, 3, requests)
+
+	path, unlock, err := localCache.Get(id)
+	require.NoError(t, err)
+	defer unlock()
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), content)
+}
+
+func TestFileUploadCorrupted(t *testing.T) {
+	env := newEnv(t)
+
+	id := build.ID{0x01}
+	digest := sha256.Sum256([]byte("foobar"))
+
+	req, err := http.NewRequest(http.MethodPut, env.server.URL+"/file", strings.NewReader("foobaz"))
+	require.NoError(t, err)
+	req.Header.Set("id", id.String())
+	req.Header.Set("digest", hex.EncodeToString(digest[:]))
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	_, _, err = env.cache.Get(id)
+	require.Truef(t, errors.Is(err, filecache.ErrNotFound), "%v", err)
+
+	// aborted write doesn't lock the file
+	_, abort, err := env.cache.Write(id)
+	require.NoError(t, err)
+	require.NoError(t, abort())
+}
+
+func TestConcurrentUploadCorrupted(t *testing.T) {
+	env := newEnv(t)
+
+	id := build.ID{0x01}
+	digest := sha256.Sum256([]byte("foobar"))
+
+	put := func(body io.Reader) int {
+		req, err := http.NewRequest(http.MethodPut, env.server.URL+"/file", body)
+		require.NoError(t, err)
+		req.Header.Set("id", id.String())
+		req.Header.Set("digest", hex.EncodeToString(digest[:]))
+
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	pr, pw := io.Pipe()
+	corrupted := make(chan int)
+	go func() { corrupted <- put(pr) }()
+	// write returns once the handler reads the body, so the corrupted upload is in progress
+	_, err := pw.Write([]byte("foo"))
+	require.NoError(t, err)
+
+	valid := make(chan int)
+	go func() { valid <- put(strings.NewReader("foobar")) }()
+	time.Sleep(100 * time.Millisecond)
+
+	_, err = pw.Write([]byte("baz"))
+	require.NoError(t, err)
+	require.NoError(t, pw.Close())
+
+	require.Equal(t, http.StatusBadRequest, <-corrupted)
+	require.Equal(t, http.StatusOK, <-valid)
+
+	path, unlock, err := env.cache.Get(id)
+	require.NoError(t, err)
+	defer unlock()
+
+	content, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, []byte("foobar"), content)
+}
+
+func TestUploadFiles(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	cache := newCache(t)
+
+	mux := http.NewServeMux()
+	filecache.NewHandler(l, cache.Cache).Register(mux)
+
+	var mu sync.Mutex
+	requests := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := filecache.NewClient(l, server.URL)
+	ctx := context.Background()
+
+	dir := t.TempDir()
+	files := make(map[build.ID]string)
+	for i := 0; i < 100; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("small%d.txt", i))
+		require.NoError(t, ioutil.WriteFile(path, []byte(fmt.Sprint(i)), 0666))
+		files[build.ID{0x01, byte(i)}] = path
+	}
+	large := filepath.Join(dir, "large.txt")
+	require.NoError(t, ioutil.WriteFile(large, bytes.Repeat([]byte("foobar"), 1024*1024), 0666))
+	files[build.ID{0x02}] = large
+
+	require.NoError(t, client.Upload(ctx, build.ID{0x01, 0}, files[build.ID{0x01, 0}]))
+	missing, err := client.Missing(ctx, []build.ID{{0x01, 0}, {0x01, 1}})
+	require.NoError(t, err)
+	require.Equal(t, []build.ID{{0x01, 1}}, missing)
+
+	// file existing already is skipped by the cache
+	require.NoError(t, client.UploadFiles(ctx, files))
+	require.Equal(t, map[string]int{
+		"PUT /file":           2,
+		"POST /files/missing": 1,
+		"POST /files":         1,
+	}, requests)
+
+	for id, path := range files {
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+
+		cached, unlock, err := cache.Get(id)
+		require.NoError(t, err)
+		actual, err := ioutil.ReadFile(cached)
+		unlock()
+		require.NoError(t, err)
+		require.Equal(t, content, actual)
+	}
+
+	missing, err = client.Missing(ctx, slices.Collect(maps.Keys(files)))
+	require.NoError(t, err)
+	require.Empty(t, missing)
+}
+
+// cutWriter fails writes after limit bytes.
+type cutWriter struct {
+	http.ResponseWriter
+	limit int
+}
+
+func (w *cutWriter) Write(p []byte) (int, error) {
+	if len(p) > w.limit {
+		n, _ := w.ResponseWriter.Write(p[:w.limit])
+		w.limit = 0
+		return n, errors.New("connection reset")
+	}
+	w.limit -= len(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func TestFileDownloadResume(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	cache := newCache(t)
+	localCache := newCache(t)
+
+	mux := http.NewServeMux()
+	filecache.NewHandler(l, cache.Cache).Register(mux)
+
+	var ranges []string
+	cut := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		if cut {
+			cut = false
+			w = &cutWriter{ResponseWriter: w, limit: 1 << 20}
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	client := filecache.NewClient(l, server.URL)
+	client.SetRetryPolicy(retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+
+	id := build.ID{0x01}
+	content := bytes.Repeat([]byte("foobar"), 1024*1024)
+	w, abort, err := cache.Write(id)
+	require.NoError(t, err)
+	defer func() { _ = abort() }()
+	_, err = w.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	req, err := http.NewRequest(http.MethodHead, server.URL+"/file", nil)
+	require.NoError(t, err)
+	req.Header.Set("id", id.String())
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, int64(len(content)), resp.ContentLength)
+	digest := sha256.Sum256(content)
+	require.Equal(t, hex.EncodeToString(digest[:]), resp.Header.Get("digest"))
+	ranges = ranges[:0]
+
+	// the first response is cut, the second one sends the rest of the file
+	cut = true
+	require.NoError(t, client.Download(context.Background(), localCache.Cache, id))
+	require.Len(t, ranges, 2)
+	require.Empty(t, ranges[0])
+	require.Regexp(t, `^bytes=[1-9][0-9]*-$`, ranges[1])
+
+	path, unlock, err := localCache.Get(id)
+	require.NoError(t, err)
+	defer unlock()
+
+	actual, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, actual)
+}
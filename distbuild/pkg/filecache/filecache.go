@@ -1,10 +1,14 @@
 package filecache
 
 import (
+	"context"
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
@@ -15,6 +19,7 @@ var (
 	ErrExists      = errors.New("file exists")
 	ErrWriteLocked = errors.New("file is locked for write")
 	ErrReadLocked  = errors.New("file is locked for read")
+	ErrCorrupted   = errors.New("file is corrupted")
 )
 
 const fileName = "file"
@@ -29,6 +34,8 @@ func convertErr(err error) error {
 		return ErrWriteLocked
 	case errors.Is(err, artifact.ErrReadLocked):
 		return ErrReadLocked
+	case errors.Is(err, artifact.ErrCorrupted):
+		return ErrCorrupted
 	default:
 		return err
 	}
@@ -48,10 +55,36 @@ func New(rootDir string) (*Cache, error) {
 	return c, nil
 }
 
+// NewWithStore creates cache keeping files in the artifact store, see artifact.NewCacheWithStore.
+func NewWithStore(rootDir string, store artifact.Store) (*Cache, error) {
+	cache, err := artifact.NewCacheWithStore(rootDir, store)
+	if err != nil {
+		return nil, err
+	}
+	return &Cache{cache: cache}, nil
+}
+
 func (c *Cache) Range(fileFn func(file build.ID) error) error {
 	return c.cache.Range(fileFn)
 }
 
+// Evict removes files exceeding limits, see artifact.Cache.Evict.
+func (c *Cache) Evict(limits artifact.Limits) ([]build.ID, error) {
+	evicted, err := c.cache.Evict(limits)
+	return evicted, convertErr(err)
+}
+
+// RunEviction calls Evict every interval until ctx is done.
+func (c *Cache) RunEviction(ctx context.Context, limits artifact.Limits, interval time.Duration, onEvict func(evicted []build.ID, err error)) {
+	c.cache.RunEviction(ctx, limits, interval, onEvict)
+}
+
+// Fsck quarantines corrupted files, see artifact.Cache.Fsck.
+func (c *Cache) Fsck() ([]build.ID, error) {
+	corrupted, err := c.cache.Fsck()
+	return corrupted, convertErr(err)
+}
+
 func (c *Cache) Remove(file build.ID) error {
 	return convertErr(c.cache.Remove(file))
 }
@@ -73,7 +106,7 @@ func (f *fileWriter) Close() error {
 		return closeErr
 	}
 
-	return commitErr
+	return convertErr(commitErr)
 }
 
 func (c *Cache) Write(file build.ID) (w io.WriteCloser, abort func() error, err error) {
@@ -85,7 +118,7 @@ func (c *Cache) Write(file build.ID) (w io.WriteCloser, abort func() error, err
 
 	f, err := os.Create(filepath.Join(path, fileName))
 	if err != nil {
-		_ = abort()
+		_ = abortDir()
 		return
 	}
 
@@ -103,6 +136,76 @@ func (c *Cache) Write(file build.ID) (w io.WriteCloser, abort func() error, err
 	return
 }
 
+// receive streams content of the file from r into the cache. Size and sha256 digest of the content are checked
+// if they are known, size is negative otherwise. Write is aborted if the content doesn't match or the stream is cut.
+func (c *Cache) receive(file build.ID, r io.Reader, size int64, digest *build.Digest) error {
+	w, abort, err := c.Write(file)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(w, h), r)
+	if err == nil && size >= 0 && n != size {
+		err = fmt.Errorf("received %d bytes of %d: %w", n, size, io.ErrUnexpectedEOF)
+	}
+	if err == nil && digest != nil {
+		var actual build.Digest
+		h.Sum(actual[:0])
+		if actual != *digest {
+			err = fmt.Errorf("file %v has digest %v instead of %v: %w", file, actual, *digest, ErrCorrupted)
+		}
+	}
+	if err != nil {
+		return errors.Join(err, abort())
+	}
+	return w.Close()
+}
+
+// Stat returns size and sha256 digest of the file. They are taken from the manifest if there is one.
+func (c *Cache) Stat(file build.ID) (size int64, digest build.Digest, err error) {
+	m, err := c.cache.Manifest(file)
+	if err == nil {
+		for _, e := range m.Entries {
+			if e.Path == fileName {
+				return e.Size, e.Digest, nil
+			}
+		}
+	} else if !errors.Is(err, artifact.ErrNotFound) {
+		return 0, digest, err
+	}
+
+	path, unlock, err := c.Get(file)
+	if err != nil {
+		return 0, digest, err
+	}
+	defer unlock()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, digest, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	size, err = io.Copy(h, f)
+	h.Sum(digest[:0])
+	return size, digest, err
+}
+
+// Missing returns files which are not in the cache, files being written are missing too.
+func (c *Cache) Missing(files []build.ID) []build.ID {
+	missing := []build.ID{}
+	for _, id := range files {
+		if _, unlock, err := c.Get(id); err != nil {
+			missing = append(missing, id)
+		} else {
+			unlock()
+		}
+	}
+	return missing
+}
+
 func (c *Cache) Get(file build.ID) (path string, unlock func(), err error) {
 	root, unlock, err := c.cache.Get(file)
 	path = filepath.Join(root, fileName)
@@ -3,11 +3,15 @@
 package filecache
 
 import (
+	"archive/tar"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"go.uber.org/zap"
@@ -24,7 +28,36 @@ func NewHandler(l *zap.Logger, cache *Cache) *Handler {
 	return &Handler{l, cache, &singleflight.Group{}}
 }
 
+// digestRecord is PAX record of batch upload entries keeping sha256 digest of the file content.
+const digestRecord = "DISTBUILD.digest"
+
+// parseDigest reads sha256 digest of the file content sent in the digest header or digestRecord,
+// it is nil if the digest is not sent.
+func parseDigest(text string) (*build.Digest, error) {
+	if text == "" {
+		return nil, nil
+	}
+	var d build.Digest
+	if err := d.UnmarshalText([]byte(text)); err != nil {
+		return nil, fmt.Errorf("couldn't unmarshal digest %q: %w", text, err)
+	}
+	return &d, nil
+}
+
+// Register adds methods of the file transfer:
+//
+//   - GET /file sends the file with its size and sha256 digest in the Content-Length and digest headers,
+//     Range requests are supported and the digest is the ETag of the file;
+//   - HEAD /file sends only the headers of GET;
+//   - PUT /file receives the file, it is rejected if it doesn't match the digest header;
+//   - POST /files/missing receives JSON list of file ids and returns ids of files missing in the cache;
+//   - POST /files receives many files packed into tar stream, see Client.UploadBatch.
+//
+// File id is passed in the id header.
 func (h *Handler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("POST /files/missing", h.missing)
+	mux.HandleFunc("POST /files", h.uploadBatch)
+
 	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
 		var id build.ID
 		if err := id.UnmarshalText([]byte(r.Header.Get("id"))); err != nil {
@@ -37,65 +70,127 @@ func (h *Handler) Register(mux *http.ServeMux) {
 		h.logger.Debug("start handling", zap.String("requestURI", r.RequestURI), zap.String("method", r.Method), zap.String("file_id", id.String()))
 
 		switch r.Method {
-		case http.MethodGet:
+		case http.MethodGet, http.MethodHead:
+			_, digest, err := h.cache.Stat(id)
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
 			path, unlock, err := h.cache.Get(id)
-			if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
 			defer unlock()
 
-			data, err := os.ReadFile(path)
+			f, err := os.Open(path)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			defer f.Close()
 
-			fmt.Fprintf(w, "%v", string(data))
+			// digest is the entity tag, so that range requests with If-Range resume only the same content
+			w.Header().Set("digest", digest.String())
+			w.Header().Set("ETag", strconv.Quote(digest.String()))
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Time{}, f)
 			return
 
 		case http.MethodPut:
-			// use singleflight to avoid multiple uploads of the same file
-			f := func() (any, error) {
-				writeCloser, abort, err := h.cache.Write(id)
-				if err != nil {
-					if errors.Is(err, ErrExists) {
-						h.logger.Debug("file already exists; skip uploading", zap.String("file_id", id.String()))
-						return nil, nil
-					}
-					return nil, err
-				}
-				buf, err := io.ReadAll(r.Body)
-				r.Body.Close()
-				if err != nil {
-					abortErr := abort()
-					if abortErr != nil {
-						h.logger.Error("error during aborting write", zap.Error(abortErr))
-						return nil, fmt.Errorf("error during reading body: %w; error during aborting write: %v", err, abortErr)
-					}
-					return nil, fmt.Errorf("error during aborting write: %w", err)
-				}
-				_, err = writeCloser.Write(buf)
-				if err != nil {
-					h.logger.Error("error during writing to cache", zap.Error(err))
-					abortErr := abort()
-					if abortErr != nil {
-						h.logger.Error("error during aborting write", zap.Error(abortErr))
-						return nil, fmt.Errorf("error during writing to cache: %w; error during aborting write: %v", err, abortErr)
-					}
-					return nil, fmt.Errorf("couldn't write file to local cache: %w", err)
-				}
-				err = writeCloser.Close()
-				if err != nil {
-					return nil, fmt.Errorf("couldn't close file writer: %w", err)
-				}
-				return nil, nil
-			}
-			_, err, _ := h.g.Do(id.String(), f)
+			digest, err := parseDigest(r.Header.Get("digest"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// use singleflight to avoid multiple uploads of the same file
+			if err := h.receive(id, r.Body, r.ContentLength, digest); err != nil {
+				http.Error(w, err.Error(), uploadErrorStatus(err))
 			}
 		}
 	})
 }
+
+func (h *Handler) missing(w http.ResponseWriter, r *http.Request) {
+	var ids []build.ID
+	if err := json.NewDecoder(r.Body).Decode(&ids); err != nil {
+		http.Error(w, fmt.Sprintf("couldn't decode file ids: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(h.cache.Missing(ids)); err != nil {
+		h.logger.Error("couldn't write missing files", zap.Error(err))
+	}
+}
+
+// receive writes file of the upload, concurrent uploads of the same file are merged. Only success is shared:
+// upload merged with the failed one, e.g. with corrupted content, is received from its own body.
+func (h *Handler) receive(id build.ID, r io.Reader, size int64, digest *build.Digest) error {
+	for {
+		own := false
+		_, err, _ := h.g.Do(id.String(), func() (any, error) {
+			own = true
+			err := h.cache.receive(id, r, size, digest)
+			if errors.Is(err, ErrExists) {
+				h.logger.Debug("file already exists; skip uploading", zap.String("file_id", id.String()))
+				return nil, nil
+			}
+			return nil, err
+		})
+		if err == nil || own {
+			return err
+		}
+	}
+}
+
+// uploadBatch receives tar stream with entries named by file ids. Entries of files which exist already are skipped.
+func (h *Handler) uploadBatch(w http.ResponseWriter, r *http.Request) {
+	tr := tar.NewReader(r.Body)
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			http.Error(w, fmt.Sprintf("error during reading batch: %v", err), http.StatusBadRequest)
+			return
+		}
+
+		var id build.ID
+		if err := id.UnmarshalText([]byte(hdr.Name)); err != nil {
+			http.Error(w, fmt.Sprintf("error diring unmarshaling file id: %v", err), http.StatusBadRequest)
+			return
+		}
+		digest, err := parseDigest(hdr.PAXRecords[digestRecord])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// reader of the skipped entry is drained by the next call of tr.Next
+		if err := h.receive(id, tr, hdr.Size, digest); err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+		count++
+	}
+	h.logger.Debug("batch uploaded", zap.Int("files", count))
+}
+
+// uploadErrorStatus returns HTTP status code of upload error.
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrCorrupted), errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,264 @@
+//go:build !solution
+
+package gocache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+)
+
+// entry is stored by the action ID and points to the output.
+type entry struct {
+	OutputID []byte
+	Size     int64
+	Time     time.Time
+}
+
+// key returns filecache id of the action entry or the output. Go uses SHA-256 ids,
+// they are hashed together with the kind to fit build.ID.
+func key(kind string, id []byte) build.ID {
+	h := sha1.New()
+	_, _ = io.WriteString(h, "gocache "+kind)
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write(id)
+
+	var k build.ID
+	copy(k[:], h.Sum(nil))
+	return k
+}
+
+func actionKey(actionID []byte) build.ID { return key("action", actionID) }
+func outputKey(outputID []byte) build.ID { return key("output", outputID) }
+
+// Cache keeps outputs in the local filecache, which is the tier in front of the coordinator filecache.
+// Outputs are uploaded to the coordinator in background, failures of the remote tier are only logged.
+type Cache struct {
+	log    *zap.Logger
+	local  *filecache.Cache
+	remote *filecache.Client
+
+	uploads sync.WaitGroup
+}
+
+// New creates cache, remote may be nil to use only the local tier.
+func New(log *zap.Logger, local *filecache.Cache, remote *filecache.Client) *Cache {
+	return &Cache{log: log, local: local, remote: remote}
+}
+
+// path returns path of the file in the local tier, downloading it from the coordinator if needed.
+func (c *Cache) path(ctx context.Context, id build.ID) (string, error) {
+	path, unlock, err := c.local.Get(id)
+	if errors.Is(err, filecache.ErrNotFound) && c.remote != nil {
+		if err = c.remote.Download(ctx, c.local, id); err != nil {
+			return "", err
+		}
+		path, unlock, err = c.local.Get(id)
+	}
+	if err != nil {
+		return "", err
+	}
+	// files are removed only by Remove, so path stays valid
+	unlock()
+	return path, nil
+}
+
+// Get looks up the output of the action. Missing action or output is reported as miss.
+func (c *Cache) Get(ctx context.Context, actionID []byte) (*Response, error) {
+	path, err := c.path(ctx, actionKey(actionID))
+	if err != nil {
+		return c.miss(actionID, err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e entry
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid action entry: %w", err)
+	}
+
+	diskPath, err := c.path(ctx, outputKey(e.OutputID))
+	if err != nil {
+		return c.miss(actionID, err)
+	}
+	return &Response{OutputID: e.OutputID, Size: e.Size, Time: &e.Time, DiskPath: diskPath}, nil
+}
+
+func (c *Cache) miss(actionID []byte, err error) (*Response, error) {
+	if !errors.Is(err, filecache.ErrNotFound) {
+		c.log.Warn("cache lookup failed", zap.Binary("action_id", actionID), zap.Error(err))
+	}
+	return &Response{Miss: true}, nil
+}
+
+// write stores content in the local tier, existing file is kept unless replace is set.
+func (c *Cache) write(id build.ID, content []byte, replace bool) error {
+	if replace {
+		if err := c.local.Remove(id); err != nil {
+			return err
+		}
+	}
+
+	w, abort, err := c.local.Write(id)
+	if errors.Is(err, filecache.ErrExists) || errors.Is(err, filecache.ErrWriteLocked) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return errors.Join(err, abort())
+	}
+	if err := w.Close(); err != nil && !errors.Is(err, filecache.ErrExists) {
+		return err
+	}
+	return nil
+}
+
+// Put stores the output of the action. The action entry is replaced only in the local tier: files in the
+// coordinator are never replaced, so other caches keep getting the output stored there first. Any output of
+// the action is valid for the go command, it only happens to differ for non-reproducible builds.
+func (c *Cache) Put(ctx context.Context, actionID, outputID []byte, body []byte) (*Response, error) {
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], outputID) {
+		return nil, fmt.Errorf("output id %x doesn't match body", outputID)
+	}
+
+	output := outputKey(outputID)
+	if err := c.write(output, body, false); err != nil {
+		return nil, fmt.Errorf("error during storing output: %w", err)
+	}
+
+	action := actionKey(actionID)
+	e, err := json.Marshal(entry{OutputID: outputID, Size: int64(len(body)), Time: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+	// replacing local entry fixes the action pointing to output evicted from the local tier
+	if err := c.write(action, e, true); err != nil {
+		return nil, fmt.Errorf("error during storing action: %w", err)
+	}
+
+	diskPath, err := c.path(ctx, output)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.remote != nil {
+		c.uploads.Add(1)
+		go func() {
+			defer c.uploads.Done()
+			c.upload(output, action)
+		}()
+	}
+	return &Response{DiskPath: diskPath}, nil
+}
+
+// upload copies files from the local tier to the coordinator, files already stored there are kept.
+// Output goes first, so that action never points to missing output.
+func (c *Cache) upload(ids ...build.ID) {
+	for _, id := range ids {
+		path, err := c.path(context.Background(), id)
+		if err == nil {
+			err = c.remote.Upload(context.Background(), id, path)
+		}
+		if err != nil {
+			c.log.Warn("couldn't upload to coordinator", zap.String("file_id", id.String()), zap.Error(err))
+			return
+		}
+	}
+}
+
+// Close waits for background uploads.
+func (c *Cache) Close() {
+	c.uploads.Wait()
+}
+
+// Serve handles requests of the go command read from r until close command or EOF.
+func (c *Cache) Serve(ctx context.Context, r io.Reader, w io.Writer) error {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	respond := func(rsp *Response) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err := enc.Encode(rsp); err != nil {
+			c.log.Error("couldn't write response", zap.Error(err))
+		}
+	}
+
+	respond(&Response{KnownCommands: []string{CmdGet, CmdPut, CmdClose}})
+
+	var wg sync.WaitGroup
+	defer c.Close()
+	defer wg.Wait()
+
+	dec := json.NewDecoder(r)
+	for {
+		var req Request
+		if err := dec.Decode(&req); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error during reading request: %w", err)
+		}
+
+		var body []byte
+		if req.Command == CmdPut && req.BodySize > 0 {
+			if err := dec.Decode(&body); err != nil {
+				return fmt.Errorf("error during reading body of request %d: %w", req.ID, err)
+			}
+			if int64(len(body)) != req.BodySize {
+				return fmt.Errorf("request %d has body of %d bytes, expected %d", req.ID, len(body), req.BodySize)
+			}
+		}
+
+		if req.Command == CmdClose {
+			wg.Wait()
+			c.Close()
+			respond(&Response{ID: req.ID})
+			return nil
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			respond(c.handle(ctx, &req, body))
+		}()
+	}
+}
+
+func (c *Cache) handle(ctx context.Context, req *Request, body []byte) *Response {
+	var rsp *Response
+	var err error
+	switch req.Command {
+	case CmdGet:
+		rsp, err = c.Get(ctx, req.ActionID)
+	case CmdPut:
+		outputID := req.OutputID
+		if outputID == nil {
+			outputID = req.ObjectID
+		}
+		rsp, err = c.Put(ctx, req.ActionID, outputID, body)
+	default:
+		err = fmt.Errorf("unknown command %q", req.Command)
+	}
+
+	if err != nil {
+		rsp = &Response{Err: err.Error()}
+	}
+	rsp.ID = req.ID
+	return rsp
+}
@@ -0,0 +1,160 @@
+package gocache_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/gocache"
+)
+
+// goCommand plays the go command side of the protocol.
+type goCommand struct {
+	t   *testing.T
+	enc *json.Encoder
+	dec *json.Decoder
+	id  int64
+}
+
+func startServe(t *testing.T, c *gocache.Cache) (*goCommand, <-chan error) {
+	reqR, reqW := io.Pipe()
+	rspR, rspW := io.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Serve(context.Background(), reqR, rspW)
+		_ = rspW.Close()
+	}()
+
+	cmd := &goCommand{t: t, enc: json.NewEncoder(reqW), dec: json.NewDecoder(rspR)}
+	rsp := cmd.read()
+	require.Equal(t, []string{gocache.CmdGet, gocache.CmdPut, gocache.CmdClose}, rsp.KnownCommands)
+	return cmd, done
+}
+
+func (c *goCommand) read() *gocache.Response {
+	var rsp gocache.Response
+	require.NoError(c.t, c.dec.Decode(&rsp))
+	return &rsp
+}
+
+func (c *goCommand) do(req *gocache.Request, body []byte) *gocache.Response {
+	c.id++
+	req.ID = c.id
+	require.NoError(c.t, c.enc.Encode(req))
+	if len(body) > 0 {
+		require.NoError(c.t, c.enc.Encode(body))
+	}
+
+	rsp := c.read()
+	require.Equal(c.t, req.ID, rsp.ID)
+	return rsp
+}
+
+func (c *goCommand) put(actionID, body []byte) *gocache.Response {
+	outputID := sha256.Sum256(body)
+	return c.do(&gocache.Request{Command: gocache.CmdPut, ActionID: actionID, OutputID: outputID[:], BodySize: int64(len(body))}, body)
+}
+
+func newCache(t *testing.T, remote *filecache.Client) *gocache.Cache {
+	local, err := filecache.New(t.TempDir())
+	require.NoError(t, err)
+	return gocache.New(zaptest.NewLogger(t), local, remote)
+}
+
+func TestServe(t *testing.T) {
+	cmd, done := startServe(t, newCache(t, nil))
+
+	actionID := []byte("action")
+	rsp := cmd.do(&gocache.Request{Command: gocache.CmdGet, ActionID: actionID}, nil)
+	require.True(t, rsp.Miss)
+
+	rsp = cmd.put(actionID, []byte("output"))
+	require.Empty(t, rsp.Err)
+	content, err := os.ReadFile(rsp.DiskPath)
+	require.NoError(t, err)
+	require.Equal(t, "output", string(content))
+
+	rsp = cmd.do(&gocache.Request{Command: gocache.CmdGet, ActionID: actionID}, nil)
+	require.False(t, rsp.Miss)
+	require.Equal(t, int64(6), rsp.Size)
+	outputID := sha256.Sum256([]byte("output"))
+	require.Equal(t, outputID[:], rsp.OutputID)
+	content, err = os.ReadFile(rsp.DiskPath)
+	require.NoError(t, err)
+	require.Equal(t, "output", string(content))
+
+	// empty output has no body
+	rsp = cmd.put([]byte("empty"), nil)
+	require.Empty(t, rsp.Err)
+
+	rsp = cmd.do(&gocache.Request{Command: gocache.CmdPut, ActionID: actionID, OutputID: []byte("wrong"), BodySize: 1}, []byte("x"))
+	require.NotEmpty(t, rsp.Err)
+
+	cmd.do(&gocache.Request{Command: gocache.CmdClose}, nil)
+	require.NoError(t, <-done)
+}
+
+func TestRemoteTier(t *testing.T) {
+	l := zaptest.NewLogger(t)
+	coordinatorCache, err := filecache.New(t.TempDir())
+	require.NoError(t, err)
+
+	mux := http.NewServeMux()
+	filecache.NewHandler(l, coordinatorCache).Register(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	actionID := []byte("action")
+
+	first := newCache(t, filecache.NewClient(l, server.URL))
+	_, err = first.Put(context.Background(), actionID, sha("output"), []byte("output"))
+	require.NoError(t, err)
+	first.Close()
+
+	// cache of another developer with empty local tier
+	second := newCache(t, filecache.NewClient(l, server.URL))
+	rsp, err := second.Get(context.Background(), actionID)
+	require.NoError(t, err)
+	require.False(t, rsp.Miss)
+	content, err := os.ReadFile(rsp.DiskPath)
+	require.NoError(t, err)
+	require.Equal(t, "output", string(content))
+
+	rsp, err = second.Get(context.Background(), []byte("other"))
+	require.NoError(t, err)
+	require.True(t, rsp.Miss)
+
+	// non-reproducible output replaces the entry only locally, the coordinator keeps the first one
+	_, err = second.Put(context.Background(), actionID, sha("changed"), []byte("changed"))
+	require.NoError(t, err)
+	second.Close()
+
+	rsp, err = second.Get(context.Background(), actionID)
+	require.NoError(t, err)
+	content, err = os.ReadFile(rsp.DiskPath)
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(content))
+
+	third := newCache(t, filecache.NewClient(l, server.URL))
+	rsp, err = third.Get(context.Background(), actionID)
+	require.NoError(t, err)
+	require.False(t, rsp.Miss)
+	content, err = os.ReadFile(rsp.DiskPath)
+	require.NoError(t, err)
+	require.Equal(t, "output", string(content))
+}
+
+func sha(s string) []byte {
+	sum := sha256.Sum256([]byte(s))
+	return sum[:]
+}
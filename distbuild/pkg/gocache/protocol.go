@@ -0,0 +1,49 @@
+//go:build !solution
+
+// Package gocache implements GOCACHEPROG protocol of the go command on top of distbuild file caches.
+//
+// The go command starts the program and sends JSON requests to its stdin, responses are read from its stdout.
+// The program announces supported commands in the first response with zero ID. Body of put request
+// follows it as a separate JSON value, base64 encoded string.
+package gocache
+
+import "time"
+
+const (
+	CmdGet   = "get"
+	CmdPut   = "put"
+	CmdClose = "close"
+)
+
+// Request is sent by the go command.
+type Request struct {
+	ID      int64
+	Command string
+
+	// ActionID is the cache key of get and put.
+	ActionID []byte `json:",omitempty"`
+	// OutputID is SHA-256 hash of the body of put.
+	OutputID []byte `json:",omitempty"`
+	// ObjectID is the name of OutputID used by go 1.23.
+	ObjectID []byte `json:",omitempty"`
+	// BodySize is the size of the body of put.
+	BodySize int64 `json:",omitempty"`
+}
+
+// Response is sent to the go command, responses may be sent in any order.
+type Response struct {
+	ID  int64
+	Err string `json:",omitempty"`
+
+	// KnownCommands is set in the first response.
+	KnownCommands []string `json:",omitempty"`
+
+	// Miss is set if get didn't find the action.
+	Miss bool `json:",omitempty"`
+	// OutputID, Size and Time describe the output found by get.
+	OutputID []byte     `json:",omitempty"`
+	Size     int64      `json:",omitempty"`
+	Time     *time.Time `json:",omitempty"`
+	// DiskPath is absolute path of the file with the output content.
+	DiskPath string `json:",omitempty"`
+}
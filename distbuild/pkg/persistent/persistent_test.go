@@ -0,0 +1,145 @@
+package persistent_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/persistent"
+)
+
+const toolEnv = "PERSISTENT_TEST_TOOL"
+
+// TestMain turns the test binary into a persistent tool, when it is started by the pool.
+func TestMain(m *testing.M) {
+	if os.Getenv(toolEnv) != "" {
+		err := persistent.Serve(os.Stdin, os.Stdout, func(req *persistent.WorkRequest) *persistent.WorkResponse {
+			switch req.Arguments[0] {
+			case "pid":
+				return &persistent.WorkResponse{Output: fmt.Sprint(os.Getpid())}
+			case "fail":
+				return &persistent.WorkResponse{ExitCode: 2, Output: "failed"}
+			case "crash":
+				fmt.Fprintln(os.Stderr, "tool crashed")
+				os.Exit(1)
+			case "sleep":
+				time.Sleep(time.Minute)
+			}
+			return &persistent.WorkResponse{Output: strings.Join(req.Arguments, " ")}
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestProtocol(t *testing.T) {
+	var buf bytes.Buffer
+	req := &persistent.WorkRequest{
+		RequestID:        1,
+		Arguments:        []string{"-o", "out"},
+		Inputs:           []persistent.Input{{Path: "/src/a.go"}},
+		WorkingDirectory: "/src",
+	}
+	require.NoError(t, persistent.WriteMessage(&buf, req))
+
+	var read persistent.WorkRequest
+	require.NoError(t, persistent.ReadMessage(&buf, &read))
+	require.Equal(t, req, &read)
+
+	require.ErrorIs(t, persistent.ReadMessage(&buf, &read), io.EOF)
+}
+
+func newTool() *persistent.Tool {
+	return &persistent.Tool{Path: os.Args[0], Env: []string{toolEnv + "=1"}}
+}
+
+func do(t *testing.T, pool *persistent.Pool, tool *persistent.Tool, args ...string) string {
+	rsp, err := pool.Do(context.Background(), tool, &persistent.WorkRequest{Arguments: args})
+	require.NoError(t, err)
+	return rsp.Output
+}
+
+func TestPoolReusesProcess(t *testing.T) {
+	pool := persistent.NewPool(zaptest.NewLogger(t), 0)
+	defer pool.Close()
+	tool := newTool()
+
+	require.Equal(t, "echo a", do(t, pool, tool, "echo", "a"))
+
+	pid := do(t, pool, tool, "pid")
+	require.Equal(t, pid, do(t, pool, tool, "pid"))
+
+	rsp, err := pool.Do(context.Background(), tool, &persistent.WorkRequest{Arguments: []string{"fail"}})
+	var exitErr *persistent.ExitError
+	require.ErrorAs(t, err, &exitErr)
+	require.Equal(t, 2, exitErr.ExitCode())
+	require.Equal(t, "failed", rsp.Output)
+
+	require.Equal(t, pid, do(t, pool, tool, "pid"), "failed request must not restart process")
+}
+
+func TestPoolRecyclesProcess(t *testing.T) {
+	pool := persistent.NewPool(zaptest.NewLogger(t), 2)
+	defer pool.Close()
+	tool := newTool()
+
+	pid := do(t, pool, tool, "pid")
+	require.Equal(t, pid, do(t, pool, tool, "pid"))
+	require.NotEqual(t, pid, do(t, pool, tool, "pid"))
+}
+
+func TestPoolCrash(t *testing.T) {
+	pool := persistent.NewPool(zaptest.NewLogger(t), 0)
+	defer pool.Close()
+	tool := newTool()
+
+	pid := do(t, pool, tool, "pid")
+
+	_, err := pool.Do(context.Background(), tool, &persistent.WorkRequest{Arguments: []string{"crash"}})
+	require.ErrorIs(t, err, persistent.ErrCrashed)
+	require.Contains(t, err.Error(), "tool crashed")
+
+	require.NotEqual(t, pid, do(t, pool, tool, "pid"))
+}
+
+func TestPoolCancel(t *testing.T) {
+	pool := persistent.NewPool(zaptest.NewLogger(t), 0)
+	defer pool.Close()
+	tool := newTool()
+
+	pid := do(t, pool, tool, "pid")
+
+	cause := errors.New("job cancelled")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(100*time.Millisecond, func() { cancel(cause) })
+
+	_, err := pool.Do(ctx, tool, &persistent.WorkRequest{Arguments: []string{"sleep"}})
+	require.ErrorIs(t, err, cause)
+
+	require.NotEqual(t, pid, do(t, pool, tool, "pid"))
+}
+
+func TestPoolClosed(t *testing.T) {
+	pool := persistent.NewPool(zaptest.NewLogger(t), 0)
+	tool := newTool()
+
+	do(t, pool, tool, "pid")
+	pool.Close()
+
+	_, err := pool.Do(context.Background(), tool, &persistent.WorkRequest{Arguments: []string{"pid"}})
+	require.Error(t, err)
+}
@@ -0,0 +1,229 @@
+//go:build !solution
+
+package persistent
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// DefaultMaxRequests is the number of requests handled by a process before it is restarted.
+const DefaultMaxRequests = 100
+
+// stderrLimit is the size of the stderr tail kept for error messages.
+const stderrLimit = 4096
+
+// Tool identifies persistent processes, requests are sent only to processes started from the same tool.
+type Tool struct {
+	// Path of the tool executable.
+	Path string
+	Env  []string
+}
+
+func (t *Tool) key() string {
+	return t.Path + "\x00" + strings.Join(t.Env, "\x00")
+}
+
+// ExitError is returned when the tool handled the request with non-zero exit code.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("persistent worker request failed with exit code %d", e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+// ErrCrashed is returned when the process died or broke the protocol, it is not reused after that.
+var ErrCrashed = errors.New("persistent worker crashed")
+
+// Pool keeps idle processes of persistent tools between requests.
+type Pool struct {
+	log         *zap.SugaredLogger
+	maxRequests int
+
+	mu     sync.Mutex
+	idle   map[string][]*process
+	closed bool
+}
+
+// NewPool returns pool restarting processes after maxRequests, DefaultMaxRequests is used if it is zero.
+func NewPool(log *zap.Logger, maxRequests int) *Pool {
+	if maxRequests == 0 {
+		maxRequests = DefaultMaxRequests
+	}
+	return &Pool{log: log.Sugar(), maxRequests: maxRequests, idle: make(map[string][]*process)}
+}
+
+type process struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   *bufio.Reader
+	stderr   *tailBuffer
+	requests int
+}
+
+func (p *Pool) start(tool *Tool) (*process, error) {
+	cmd := exec.Command(tool.Path, Flag)
+	cmd.Env = tool.Env
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &tailBuffer{}
+	cmd.Stderr = stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error during starting persistent worker %v: %w", tool.Path, err)
+	}
+	p.log.Infof("started persistent worker %v, pid %d", tool.Path, cmd.Process.Pid)
+	return &process{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout), stderr: stderr}, nil
+}
+
+func (proc *process) kill() {
+	_ = proc.stdin.Close()
+	_ = proc.cmd.Process.Kill()
+	_ = proc.cmd.Wait()
+}
+
+func (proc *process) do(req *WorkRequest) (*WorkResponse, error) {
+	if err := WriteMessage(proc.stdin, req); err != nil {
+		return nil, err
+	}
+
+	var rsp WorkResponse
+	if err := ReadMessage(proc.stdout, &rsp); err != nil {
+		return nil, err
+	}
+	if rsp.RequestID != req.RequestID {
+		return nil, fmt.Errorf("response to request %d received instead of %d", rsp.RequestID, req.RequestID)
+	}
+	return &rsp, nil
+}
+
+func (p *Pool) get(tool *Tool) (*process, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("pool is closed")
+	}
+	idle := p.idle[tool.key()]
+	if len(idle) > 0 {
+		proc := idle[len(idle)-1]
+		p.idle[tool.key()] = idle[:len(idle)-1]
+		p.mu.Unlock()
+		return proc, nil
+	}
+	p.mu.Unlock()
+
+	return p.start(tool)
+}
+
+func (p *Pool) put(tool *Tool, proc *process) {
+	p.mu.Lock()
+	if !p.closed && proc.requests < p.maxRequests {
+		p.idle[tool.key()] = append(p.idle[tool.key()], proc)
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+
+	p.log.Infof("stopping persistent worker %v, pid %d, after %d requests", tool.Path, proc.cmd.Process.Pid, proc.requests)
+	proc.kill()
+}
+
+// Do sends request to an idle process of the tool, starting a new one if there is none.
+// Process is killed if ctx is done before the response is received.
+func (p *Pool) Do(ctx context.Context, tool *Tool, req *WorkRequest) (*WorkResponse, error) {
+	proc, err := p.get(tool)
+	if err != nil {
+		return nil, err
+	}
+
+	proc.requests++
+	req.RequestID = proc.requests
+
+	type result struct {
+		rsp *WorkResponse
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rsp, err := proc.do(req)
+		done <- result{rsp, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			proc.kill()
+			return nil, fmt.Errorf("%w: %w, stderr: %q", ErrCrashed, res.err, proc.stderr.String())
+		}
+
+		p.put(tool, proc)
+		if res.rsp.ExitCode != 0 {
+			return res.rsp, &ExitError{res.rsp.ExitCode}
+		}
+		return res.rsp, nil
+
+	case <-ctx.Done():
+		// the request can't be cancelled, process is killed to stop it
+		proc.kill()
+		<-done
+		return nil, fmt.Errorf("persistent worker request interrupted: %w", context.Cause(ctx))
+	}
+}
+
+// Close kills idle processes, processes handling requests are killed when they are returned to the pool.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+
+	for _, procs := range idle {
+		for _, proc := range procs {
+			proc.kill()
+		}
+	}
+}
+
+// tailBuffer keeps the last stderrLimit bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > stderrLimit {
+		b.buf = b.buf[len(b.buf)-stderrLimit:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return string(b.buf)
+}
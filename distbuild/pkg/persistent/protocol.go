@@ -0,0 +1,92 @@
+//go:build !solution
+
+// Package persistent implements protocol of persistent worker processes.
+//
+// Tool supporting persistent mode is started with Flag. It reads requests from stdin and writes responses
+// to stdout, each message is JSON prefixed with its length as 4 byte big endian integer.
+// Stderr of the tool is not part of the protocol.
+package persistent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Flag is passed to the tool started in persistent mode.
+const Flag = "--persistent_worker"
+
+// maxMessageSize protects from reading garbage written to stdout by a broken tool.
+const maxMessageSize = 64 << 20
+
+type Input struct {
+	// Path is the absolute path of the input file.
+	Path string
+}
+
+type WorkRequest struct {
+	RequestID int
+	Arguments []string
+	Inputs    []Input
+
+	// WorkingDirectory of the request, the tool process is started in the directory of the worker.
+	WorkingDirectory string
+}
+
+type WorkResponse struct {
+	RequestID int
+	ExitCode  int
+	// Output is written to stdout of the job.
+	Output string
+}
+
+// WriteMessage writes length-prefixed JSON of msg.
+func WriteMessage(w io.Writer, msg any) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	message := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	_, err = w.Write(append(message, body...))
+	return err
+}
+
+// ReadMessage reads length-prefixed JSON into msg. It returns io.EOF if r is closed before the message.
+func ReadMessage(r io.Reader, msg any) error {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return err
+	}
+
+	n := binary.BigEndian.Uint32(size[:])
+	if n > maxMessageSize {
+		return fmt.Errorf("message size %d exceeds limit %d", n, maxMessageSize)
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return fmt.Errorf("error during reading message: %w", err)
+	}
+	return json.Unmarshal(body, msg)
+}
+
+// Serve handles requests read from r until it is closed. It is used by tools written in Go.
+func Serve(r io.Reader, w io.Writer, handle func(req *WorkRequest) *WorkResponse) error {
+	for {
+		var req WorkRequest
+		if err := ReadMessage(r, &req); errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		rsp := handle(&req)
+		rsp.RequestID = req.RequestID
+		if err := WriteMessage(w, rsp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,42 @@
+//go:build !solution
+
+// Package resources limits resources consumed by jobs and measures their usage.
+//
+// Each job is placed into its own cgroup v2 subtree, when the worker is given a delegated cgroup.
+// Without cgroups limits are approximated with rlimits of every process of the job: memory limits
+// address space, pids limits processes of the worker user, and CPU can't be limited.
+package resources
+
+import "time"
+
+type Limits struct {
+	// Memory limits memory of the job in bytes. Without cgroups it limits address space of every process
+	// of the job, unless AddressSpace is set.
+	Memory int64
+	// CPU limits number of cores used by the job. It can't be enforced without cgroups.
+	CPU float64
+	// Pids limits number of processes of the job. Without cgroups it is applied as RLIMIT_NPROC, which counts
+	// all processes of the worker user and is not checked for root.
+	Pids int
+	// AddressSpace limits virtual memory of every process of the job in bytes with RLIMIT_AS.
+	// Tools reserving large address ranges, e.g. Go and JVM, fail to start under such limit,
+	// so with cgroups it is applied only when set explicitly.
+	AddressSpace int64
+	// CPUTime limits CPU time of every process of the job with RLIMIT_CPU, with and without cgroups.
+	CPUTime time.Duration
+}
+
+type Usage struct {
+	// PeakMemory is the maximum memory used by the job in bytes. Without cgroups it is the maximum
+	// resident set size of a single process.
+	PeakMemory int64
+	// CPUTime is the total user and system time of the job processes.
+	CPUTime time.Duration
+	// OOMKilled is set when a process of the job was killed by OOM killer, either because the job
+	// exceeded its memory limit or because the host ran out of memory.
+	// It is reported only with cgroups, processes exceeding AddressSpace fail to allocate instead.
+	OOMKilled bool
+	// MemoryLimitExceeded is set when the job reached its own Memory limit. The job is likely to reach
+	// it again, unlike the job killed because of the memory pressure on the host.
+	MemoryLimitExceeded bool
+}
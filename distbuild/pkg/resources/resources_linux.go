@@ -0,0 +1,279 @@
+//go:build !solution && linux
+
+package resources
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// cpuPeriod is the period of cpu.max bandwidth limit in microseconds.
+const cpuPeriod = 100000
+
+// controllers must be available in the cgroup given to the worker.
+var controllers = []string{"cpu", "memory", "pids"}
+
+type Manager struct {
+	limits Limits
+	// root is the delegated cgroup, empty when setrlimit is used.
+	root string
+}
+
+// NewRlimitManager returns manager for workers without cgroups. It measures usage of the job processes
+// and approximates limits with setrlimit, CPU limit is not enforced.
+func NewRlimitManager(limits Limits) *Manager {
+	return &Manager{limits: limits}
+}
+
+// NewCgroupManager returns manager creating job cgroups inside root. Root must be a cgroup v2 directory
+// writable by the worker, without processes and with cpu, memory and pids controllers available.
+func NewCgroupManager(root string, limits Limits) (*Manager, error) {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(root, &fs); err != nil {
+		return nil, fmt.Errorf("error during checking cgroup %v: %w", root, err)
+	}
+	if fs.Type != unix.CGROUP2_SUPER_MAGIC {
+		return nil, fmt.Errorf("%v is not a cgroup v2 directory", root)
+	}
+
+	available, err := os.ReadFile(filepath.Join(root, "cgroup.controllers"))
+	if err != nil {
+		return nil, fmt.Errorf("error during reading cgroup controllers: %w", err)
+	}
+	fields := strings.Fields(string(available))
+	for _, c := range controllers {
+		if !slices.Contains(fields, c) {
+			return nil, fmt.Errorf("controller %q is not available in cgroup %v", c, root)
+		}
+	}
+
+	enable := "+" + strings.Join(controllers, " +")
+	if err := os.WriteFile(filepath.Join(root, "cgroup.subtree_control"), []byte(enable), 0); err != nil {
+		return nil, fmt.Errorf("error during enabling cgroup controllers: %w", err)
+	}
+
+	return &Manager{limits: limits, root: root}, nil
+}
+
+// Limits returns limits applied to every job.
+func (m *Manager) Limits() Limits {
+	return m.limits
+}
+
+// Cgroups reports whether jobs are placed into cgroups.
+func (m *Manager) Cgroups() bool {
+	return m.root != ""
+}
+
+// Group accounts processes of a single job.
+type Group struct {
+	limits Limits
+
+	dir string
+	fd  int
+
+	usage Usage
+}
+
+// NewGroup prepares a group for a new job. Close must be called after all commands of the job exited.
+func (m *Manager) NewGroup() (*Group, error) {
+	g := &Group{limits: m.limits, fd: -1}
+	if m.root == "" {
+		return g, nil
+	}
+
+	dir, err := os.MkdirTemp(m.root, "job")
+	if err != nil {
+		return nil, fmt.Errorf("error during creating job cgroup: %w", err)
+	}
+	g.dir = dir
+
+	if err := g.setLimits(); err != nil {
+		_ = g.Close()
+		return nil, err
+	}
+
+	g.fd, err = unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		_ = g.Close()
+		return nil, fmt.Errorf("error during opening job cgroup: %w", err)
+	}
+	return g, nil
+}
+
+func (g *Group) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(g.dir, file), []byte(value), 0); err != nil {
+		return fmt.Errorf("error during writing %v to %v: %w", value, file, err)
+	}
+	return nil
+}
+
+func (g *Group) setLimits() error {
+	if g.limits.Memory > 0 {
+		if err := g.write("memory.max", strconv.FormatInt(g.limits.Memory, 10)); err != nil {
+			return err
+		}
+		// swap would let the job exceed the limit, the file is missing if swap accounting is disabled
+		if err := g.write("memory.swap.max", "0"); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if g.limits.CPU > 0 {
+		quota := int64(g.limits.CPU * cpuPeriod)
+		if err := g.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			return err
+		}
+	}
+	if g.limits.Pids > 0 {
+		if err := g.write("pids.max", strconv.Itoa(g.limits.Pids)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Configure places cmd into the job cgroup, it must be called before cmd is started.
+func (g *Group) Configure(cmd *exec.Cmd) {
+	if g.fd < 0 {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = g.fd
+}
+
+// rlimits returns ulimit commands applying limits to every process of the job.
+func (g *Group) rlimits() []string {
+	var cmds []string
+
+	addressSpace := g.limits.AddressSpace
+	if addressSpace <= 0 && g.fd < 0 {
+		addressSpace = g.limits.Memory
+	}
+	if addressSpace > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -v %d", addressSpace/1024))
+	}
+	if g.limits.CPUTime > 0 {
+		cmds = append(cmds, fmt.Sprintf("ulimit -t %d", int64((g.limits.CPUTime+time.Second-1)/time.Second)))
+	}
+	if g.limits.Pids > 0 && g.fd < 0 {
+		// RLIMIT_NPROC is -p in dash and -u in other shells
+		cmds = append(cmds, fmt.Sprintf("{ ulimit -u %d 2>/dev/null || ulimit -p %d; }", g.limits.Pids, g.limits.Pids))
+	}
+	return cmds
+}
+
+// Wrap returns args of the command applying rlimits before executing args. Shell sets rlimits
+// and execs the job command, so that no process of the job escapes them.
+// Rlimits can't be applied to the started process, it could fork before.
+func (g *Group) Wrap(args []string) []string {
+	cmds := g.rlimits()
+	if len(cmds) == 0 {
+		return args
+	}
+
+	name := args[0]
+	if path, err := exec.LookPath(name); err == nil {
+		name = path
+	}
+	script := strings.Join(append(cmds, `exec "$@"`), " && ")
+	return append([]string{"sh", "-c", script, "sh", name}, args[1:]...)
+}
+
+// Exited must be called after cmd exited.
+func (g *Group) Exited(cmd *exec.Cmd) {
+	if cmd.ProcessState == nil {
+		return
+	}
+	// rusage of the process includes its waited children
+	g.usage.CPUTime += cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	if rusage, ok := cmd.ProcessState.SysUsage().(*syscall.Rusage); ok {
+		g.usage.PeakMemory = max(g.usage.PeakMemory, rusage.Maxrss*1024)
+	}
+}
+
+// readKeyed reads value of key from cgroup file with "key value" lines.
+func (g *Group) readKeyed(file, key string) (int64, error) {
+	content, err := os.ReadFile(filepath.Join(g.dir, file))
+	if err != nil {
+		return 0, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		name, value, _ := strings.Cut(scanner.Text(), " ")
+		if name == key {
+			return strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return 0, fmt.Errorf("%v not found in %v", key, file)
+}
+
+// Usage returns resources consumed by the commands of the job.
+func (g *Group) Usage() Usage {
+	usage := g.usage
+	if g.fd < 0 {
+		return usage
+	}
+
+	// memory.peak is available since linux 5.19, rusage is used on older kernels
+	if peak, err := os.ReadFile(filepath.Join(g.dir, "memory.peak")); err == nil {
+		if v, err := strconv.ParseInt(strings.TrimSpace(string(peak)), 10, 64); err == nil {
+			usage.PeakMemory = v
+		}
+	}
+	if usec, err := g.readKeyed("cpu.stat", "usage_usec"); err == nil {
+		usage.CPUTime = time.Duration(usec) * time.Microsecond
+	}
+	if kills, err := g.readKeyed("memory.events", "oom_kill"); err == nil {
+		usage.OOMKilled = kills > 0
+	}
+	// oom counts allocations failed at memory.max of the job cgroup, kills caused by limits of
+	// ancestors or by the host are not counted in it
+	if ooms, err := g.readKeyed("memory.events", "oom"); err == nil {
+		usage.MemoryLimitExceeded = ooms > 0
+	}
+	return usage
+}
+
+// Close kills processes left in the job cgroup and removes it.
+func (g *Group) Close() error {
+	if g.fd >= 0 {
+		_ = unix.Close(g.fd)
+		g.fd = -1
+	}
+	if g.dir == "" {
+		return nil
+	}
+
+	// cgroup.kill is available since linux 5.14
+	_ = g.write("cgroup.kill", "1")
+
+	var err error
+	for range 100 {
+		// cgroup can be removed only after the killed processes are gone
+		if err = os.Remove(g.dir); !errors.Is(err, unix.EBUSY) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return fmt.Errorf("error during removing job cgroup: %w", err)
+	}
+	g.dir = ""
+	return nil
+}
@@ -0,0 +1,58 @@
+//go:build !solution && !linux
+
+package resources
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// Manager doesn't limit jobs outside of linux, it only measures CPU time.
+type Manager struct {
+	limits Limits
+}
+
+func NewRlimitManager(limits Limits) *Manager {
+	return &Manager{limits: limits}
+}
+
+func NewCgroupManager(root string, limits Limits) (*Manager, error) {
+	return nil, errors.New("cgroups are supported only on linux")
+}
+
+// Limits returns limits applied to every job.
+func (m *Manager) Limits() Limits {
+	return m.limits
+}
+
+func (m *Manager) Cgroups() bool {
+	return false
+}
+
+type Group struct {
+	usage Usage
+}
+
+func (m *Manager) NewGroup() (*Group, error) {
+	return &Group{}, nil
+}
+
+func (g *Group) Configure(cmd *exec.Cmd) {}
+
+func (g *Group) Wrap(args []string) []string {
+	return args
+}
+
+func (g *Group) Exited(cmd *exec.Cmd) {
+	if cmd.ProcessState != nil {
+		g.usage.CPUTime += cmd.ProcessState.UserTime() + cmd.ProcessState.SystemTime()
+	}
+}
+
+func (g *Group) Usage() Usage {
+	return g.usage
+}
+
+func (g *Group) Close() error {
+	return nil
+}
@@ -0,0 +1,107 @@
+//go:build linux
+
+package resources_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/resources"
+)
+
+// allocate makes awk hold a string of at least 64MB.
+const allocate = `BEGIN { s = "a"; while (length(s) < 50000000) s = s s; print length(s) }`
+
+func run(t *testing.T, g *resources.Group, name string, args ...string) error {
+	args = g.Wrap(append([]string{name}, args...))
+	cmd := exec.Command(args[0], args[1:]...)
+	g.Configure(cmd)
+
+	err := cmd.Run()
+	g.Exited(cmd)
+	return err
+}
+
+func newGroup(t *testing.T, m *resources.Manager) *resources.Group {
+	g, err := m.NewGroup()
+	require.NoError(t, err)
+	t.Cleanup(func() { require.NoError(t, g.Close()) })
+	return g
+}
+
+func testUsage(t *testing.T, m *resources.Manager) {
+	g := newGroup(t, m)
+	require.NoError(t, run(t, g, "awk", allocate))
+
+	usage := g.Usage()
+	require.GreaterOrEqual(t, usage.PeakMemory, int64(64<<20))
+	require.Positive(t, usage.CPUTime)
+	require.False(t, usage.OOMKilled)
+}
+
+func TestRlimit(t *testing.T) {
+	t.Run("Usage", func(t *testing.T) {
+		testUsage(t, resources.NewRlimitManager(resources.Limits{}))
+	})
+
+	t.Run("Memory", func(t *testing.T) {
+		// without cgroups memory limit is applied as address space limit
+		g := newGroup(t, resources.NewRlimitManager(resources.Limits{Memory: 32 << 20}))
+		require.Error(t, run(t, g, "awk", allocate))
+	})
+
+	t.Run("CPUTime", func(t *testing.T) {
+		g := newGroup(t, resources.NewRlimitManager(resources.Limits{CPUTime: time.Second}))
+		require.Error(t, run(t, g, "awk", "BEGIN { while (1) {} }"))
+		require.Positive(t, g.Usage().CPUTime)
+	})
+
+	t.Run("Pids", func(t *testing.T) {
+		if os.Getuid() == 0 {
+			t.Skip("RLIMIT_NPROC is not checked for root")
+		}
+		g := newGroup(t, resources.NewRlimitManager(resources.Limits{Pids: 1}))
+		require.Error(t, run(t, g, "sh", "-c", "true & wait"))
+	})
+
+	t.Run("AddressSpace", func(t *testing.T) {
+		g := newGroup(t, resources.NewRlimitManager(resources.Limits{AddressSpace: 32 << 20}))
+		require.Error(t, run(t, g, "awk", allocate))
+		require.False(t, g.Usage().OOMKilled)
+	})
+}
+
+// TestCgroup runs only if DISTBUILD_TEST_CGROUP points to a delegated cgroup v2 directory.
+func TestCgroup(t *testing.T) {
+	root := os.Getenv("DISTBUILD_TEST_CGROUP")
+	if root == "" {
+		t.Skip("DISTBUILD_TEST_CGROUP is not set")
+	}
+
+	m, err := resources.NewCgroupManager(root, resources.Limits{})
+	require.NoError(t, err)
+	require.True(t, m.Cgroups())
+
+	t.Run("Usage", func(t *testing.T) {
+		testUsage(t, m)
+	})
+
+	t.Run("OOM", func(t *testing.T) {
+		m, err := resources.NewCgroupManager(root, resources.Limits{Memory: 32 << 20})
+		require.NoError(t, err)
+
+		g := newGroup(t, m)
+		require.Error(t, run(t, g, "awk", allocate))
+		require.True(t, g.Usage().OOMKilled)
+		require.True(t, g.Usage().MemoryLimitExceeded)
+	})
+}
+
+func TestCgroupUnavailable(t *testing.T) {
+	_, err := resources.NewCgroupManager(t.TempDir(), resources.Limits{})
+	require.Error(t, err)
+}
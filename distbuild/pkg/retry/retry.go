@@ -0,0 +1,104 @@
+//go:build !solution
+
+// Package retry implements retries with exponential backoff for transient failures.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Policy describes how many times and how often operation is retried.
+type Policy struct {
+	// MaxAttempts is the total number of attempts including the first one. Values below 1 mean one attempt.
+	MaxAttempts int
+
+	// InitialBackoff is the delay after the first failed attempt.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between attempts. Zero means no cap.
+	MaxBackoff time.Duration
+	// Multiplier is applied to the delay after every failed attempt. Values below 1 mean constant delay.
+	Multiplier float64
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts:    4,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// TimeAfter is used to wait between attempts.
+var TimeAfter = time.After
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks error that must not be retried.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent reports whether err was marked by Permanent.
+func IsPermanent(err error) bool {
+	var p *permanentError
+	return errors.As(err, &p)
+}
+
+// Backoff returns the delay after the given failed attempt, attempts are numbered from 1.
+func (p Policy) Backoff(attempt int) time.Duration {
+	d := p.InitialBackoff
+	for i := 1; i < attempt && p.Multiplier > 1; i++ {
+		d = time.Duration(float64(d) * p.Multiplier)
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// Do calls fn until it succeeds, returns permanent error, attempts are exhausted or ctx is done.
+// Attempt number starting from 1 is passed to fn. The last error of fn is returned.
+func (p Policy) Do(ctx context.Context, fn func(attempt int) error) error {
+	maxAttempts := max(p.MaxAttempts, 1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(attempt)
+		if err == nil {
+			return nil
+		}
+
+		var perm *permanentError
+		if errors.As(err, &perm) {
+			return perm.err
+		}
+
+		if attempt >= maxAttempts {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("interrupted after %d attempts: %w", attempt, err)
+		case <-TimeAfter(p.Backoff(attempt)):
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/retry"
+)
+
+var errFlaky = errors.New("flaky")
+
+func TestBackoff(t *testing.T) {
+	p := retry.Policy{InitialBackoff: time.Second, MaxBackoff: 5 * time.Second, Multiplier: 2}
+
+	require.Equal(t, time.Second, p.Backoff(1))
+	require.Equal(t, 2*time.Second, p.Backoff(2))
+	require.Equal(t, 4*time.Second, p.Backoff(3))
+	require.Equal(t, 5*time.Second, p.Backoff(4))
+	require.Equal(t, 5*time.Second, p.Backoff(100))
+}
+
+func TestDo(t *testing.T) {
+	p := retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	var attempts []int
+	err := p.Do(context.Background(), func(attempt int) error {
+		attempts = append(attempts, attempt)
+		if attempt < 3 {
+			return errFlaky
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, []int{1, 2, 3}, attempts)
+
+	attempts = nil
+	err = p.Do(context.Background(), func(attempt int) error {
+		attempts = append(attempts, attempt)
+		return errFlaky
+	})
+	require.ErrorIs(t, err, errFlaky)
+	require.Len(t, attempts, 3)
+}
+
+func TestPermanent(t *testing.T) {
+	p := retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	calls := 0
+	err := p.Do(context.Background(), func(attempt int) error {
+		calls++
+		return retry.Permanent(errFlaky)
+	})
+	require.Equal(t, errFlaky, err)
+	require.Equal(t, 1, calls)
+	require.False(t, retry.IsPermanent(err))
+	require.True(t, retry.IsPermanent(retry.Permanent(errFlaky)))
+}
+
+func TestCancel(t *testing.T) {
+	p := retry.Policy{MaxAttempts: 10, InitialBackoff: time.Hour}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	err := p.Do(ctx, func(attempt int) error {
+		calls++
+		return errFlaky
+	})
+	require.ErrorIs(t, err, errFlaky)
+	require.Equal(t, 1, calls)
+}
@@ -0,0 +1,375 @@
+//go:build !solution && linux
+
+// Package sandbox runs commands isolated in linux user, mount, pid and network namespaces.
+//
+// Command re-executes the current binary, which must call Init at the very beginning of main.
+// Inside the namespaces Init builds a new root file system containing read-only system directories and files,
+// paths from Config.ReadOnly and Config.Writable, private /tmp and /proc, and runs the command there.
+// Files that are not listed in Config are not visible, so commands reading undeclared inputs fail.
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"syscall"
+)
+
+// initArg0 is argv[0] of the re-executed binary that should act as sandbox init.
+const initArg0 = "distbuild-sandbox-init"
+
+// configFD is the descriptor of the file with init config in the re-executed binary, the first of cmd.ExtraFiles.
+// Config lists every bind mount of the job, so it may not fit into the argument size limit.
+const configFD = 3
+
+// systemDirs are mounted read-only, so that commands can find interpreters, compilers and libraries.
+var systemDirs = []string{"/bin", "/sbin", "/usr", "/lib", "/lib32", "/lib64"}
+
+// systemFiles are the parts of /etc used by toolchains: users, name resolution, dynamic linker cache,
+// alternatives of the compilers and tls certificates. They are mounted read-only if they exist.
+var systemFiles = []string{
+	"/etc/passwd",
+	"/etc/group",
+	"/etc/hosts",
+	"/etc/resolv.conf",
+	"/etc/nsswitch.conf",
+	"/etc/ld.so.cache",
+	"/etc/alternatives",
+	"/etc/ssl/certs",
+	"/etc/pki/tls/certs",
+}
+
+// devices are bind mounted into private /dev.
+var devices = []string{"/dev/null", "/dev/zero", "/dev/random", "/dev/urandom"}
+
+var devLinks = map[string]string{
+	"/dev/fd":     "/proc/self/fd",
+	"/dev/stdin":  "/proc/self/fd/0",
+	"/dev/stdout": "/proc/self/fd/1",
+	"/dev/stderr": "/proc/self/fd/2",
+}
+
+// statfs flags, they match MS_* flags except relatime
+const (
+	stNoExec     = 0x8
+	stNoAtime    = 0x400
+	stNoDirAtime = 0x800
+	stRelAtime   = 0x1000
+)
+
+type Config struct {
+	// ReadOnly paths are visible inside the sandbox at the same location and can't be modified.
+	ReadOnly []string
+	// Writable paths are visible inside the sandbox at the same location.
+	Writable []string
+	// Binds maps paths inside the sandbox to host paths mounted there read-only.
+	// Targets inside ReadOnly and Writable paths must exist, they are not created in host directories.
+	Binds map[string]string
+	// Dir is the working directory of the command.
+	Dir string
+}
+
+type initConfig struct {
+	Config
+	Root string
+	Args []string
+}
+
+// Supported reports whether sandbox can be used on this system.
+func Supported() bool {
+	_, err := os.Stat("/proc/self/ns/user")
+	return err == nil
+}
+
+// Command returns cmd which runs name with args inside the sandbox. Env, Stdout and Stderr of cmd are passed
+// to the command, cmd.Dir must not be set, use config.Dir instead. Config is passed in cmd.ExtraFiles,
+// they must not be changed. Cleanup must be called after cmd finished.
+func Command(ctx context.Context, config *Config, name string, args ...string) (cmd *exec.Cmd, cleanup func(), err error) {
+	// name is resolved using PATH of the caller, the same way exec.Command does
+	if path, err := exec.LookPath(name); err == nil {
+		name = path
+	}
+
+	root, err := os.MkdirTemp("", "sandbox")
+	if err != nil {
+		return nil, nil, fmt.Errorf("error during creating sandbox root: %w", err)
+	}
+
+	configFile, err := writeConfig(&initConfig{Config: *config, Root: root, Args: append([]string{name}, args...)})
+	if err != nil {
+		_ = os.Remove(root)
+		return nil, nil, err
+	}
+
+	cmd = exec.CommandContext(ctx, "/proc/self/exe")
+	cmd.Args[0] = initArg0
+	cmd.ExtraFiles = []*os.File{configFile}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+		UidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getuid(), Size: 1},
+		},
+		GidMappings: []syscall.SysProcIDMap{
+			{ContainerID: 0, HostID: os.Getgid(), Size: 1},
+		},
+		Pdeathsig: syscall.SIGKILL,
+	}
+
+	cleanup = func() {
+		_ = configFile.Close()
+		_ = os.Remove(root)
+	}
+	return cmd, cleanup, nil
+}
+
+// writeConfig returns unlinked temporary file with the config, it is positioned at the start.
+func writeConfig(config *initConfig) (*os.File, error) {
+	f, err := os.CreateTemp("", "sandbox-config")
+	if err != nil {
+		return nil, fmt.Errorf("error during creating sandbox config: %w", err)
+	}
+	_ = os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(config); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("error during writing sandbox config: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Init must be called at the beginning of main. It does nothing unless the binary was started by Command.
+func Init() {
+	if len(os.Args) != 1 || os.Args[0] != initArg0 {
+		return
+	}
+
+	// descriptor must not leak into the command
+	configFile := os.NewFile(configFD, "sandbox-config")
+	var config initConfig
+	err := json.NewDecoder(configFile).Decode(&config)
+	_ = configFile.Close()
+	if err != nil {
+		fatal(fmt.Errorf("invalid sandbox config: %w", err))
+	}
+
+	if err := setupRoot(&config); err != nil {
+		fatal(err)
+	}
+
+	os.Exit(run(&config))
+}
+
+func fatal(err error) {
+	_, _ = fmt.Fprintf(os.Stderr, "sandbox: %v\n", err)
+	os.Exit(127)
+}
+
+// bind mounts host path to the location under root, target is the same path if empty.
+func bind(root, path, target string, readOnly bool) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if target == "" {
+		target = path
+	}
+	target = filepath.Join(root, target)
+
+	// mount point may exist in the parent mount, which is read-only
+	if _, err := os.Stat(target); errors.Is(err, os.ErrNotExist) {
+		if info.IsDir() {
+			err = os.MkdirAll(target, 0o755)
+		} else if err = os.MkdirAll(filepath.Dir(target), 0o755); err == nil {
+			err = os.WriteFile(target, nil, 0o644)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := syscall.Mount(path, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("error during bind mount of %v: %w", path, err)
+	}
+	if readOnly {
+		// flags of the original mount are locked in user namespace and must be kept
+		var fs syscall.Statfs_t
+		if err := syscall.Statfs(path, &fs); err != nil {
+			return err
+		}
+		flags := uintptr(syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY|syscall.MS_NOSUID|syscall.MS_NODEV) |
+			uintptr(fs.Flags)&(stNoExec|stNoAtime|stNoDirAtime)
+		if fs.Flags&stRelAtime != 0 {
+			flags |= syscall.MS_RELATIME
+		}
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("error during read-only remount of %v: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func setupRoot(config *initConfig) error {
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("error during making mounts private: %w", err)
+	}
+
+	root := config.Root
+	if err := syscall.Mount("tmpfs", root, "tmpfs", 0, "mode=0755"); err != nil {
+		return fmt.Errorf("error during mounting root: %w", err)
+	}
+
+	for _, dir := range systemDirs {
+		info, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			// merged /usr, e.g. /bin -> usr/bin
+			link, err := os.Readlink(dir)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, filepath.Join(root, dir)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := bind(root, dir, "", true); err != nil {
+			return err
+		}
+	}
+
+	for _, path := range systemFiles {
+		err := bind(root, path, "", true)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+	}
+
+	for _, dev := range devices {
+		if err := bind(root, dev, "", false); err != nil {
+			return err
+		}
+	}
+	for link, target := range devLinks {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0o777); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode=1777"); err != nil {
+		return fmt.Errorf("error during mounting /tmp: %w", err)
+	}
+
+	// parents are mounted before children, otherwise children would be hidden
+	type mount struct {
+		source, target string
+		readOnly       bool
+	}
+	var mounts []mount
+	for _, path := range config.ReadOnly {
+		mounts = append(mounts, mount{path, filepath.Clean(path), true})
+	}
+	for _, path := range config.Writable {
+		mounts = append(mounts, mount{path, filepath.Clean(path), false})
+	}
+	for target, source := range config.Binds {
+		mounts = append(mounts, mount{source, filepath.Clean(target), true})
+	}
+	slices.SortStableFunc(mounts, func(a, b mount) int { return len(a.target) - len(b.target) })
+
+	for _, m := range mounts {
+		if err := bind(root, m.source, m.target, m.readOnly); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(root, "proc"), 0o555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", filepath.Join(root, "proc"), "proc", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, ""); err != nil {
+		return fmt.Errorf("error during mounting /proc: %w", err)
+	}
+
+	oldRoot := filepath.Join(root, ".old")
+	if err := os.Mkdir(oldRoot, 0o700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(root, oldRoot); err != nil {
+		return fmt.Errorf("error during pivot_root: %w", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("error during unmounting old root: %w", err)
+	}
+	if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+
+	if err := syscall.Mount("", "/", "", syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("error during read-only remount of root: %w", err)
+	}
+
+	if config.Dir != "" {
+		if err := os.Chdir(config.Dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run starts the command as a child, because signals without handlers are ignored by pid 1 of the namespace.
+// Exit code of the child is returned, 128+signal if it was killed.
+func run(config *initConfig) int {
+	cmd := exec.Command(config.Args[0], config.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	if err := cmd.Start(); err != nil {
+		fatal(err)
+	}
+
+	go func() {
+		for sig := range signals {
+			_ = cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fatal(err)
+	}
+	return 0
+}
@@ -0,0 +1,26 @@
+//go:build !solution && !linux
+
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+type Config struct {
+	ReadOnly []string
+	Writable []string
+	Binds    map[string]string
+	Dir      string
+}
+
+func Supported() bool {
+	return false
+}
+
+func Command(ctx context.Context, config *Config, name string, args ...string) (*exec.Cmd, func(), error) {
+	return nil, nil, errors.New("sandbox is supported only on linux")
+}
+
+func Init() {}
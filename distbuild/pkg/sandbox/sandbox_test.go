@@ -0,0 +1,112 @@
+package sandbox_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/sandbox"
+)
+
+func TestMain(m *testing.M) {
+	sandbox.Init()
+	os.Exit(m.Run())
+}
+
+func run(t *testing.T, config *sandbox.Config, script string) (string, error) {
+	if !sandbox.Supported() {
+		t.Skip("sandbox is not supported")
+	}
+
+	cmd, cleanup, err := sandbox.Command(context.Background(), config, "sh", "-c", script)
+	require.NoError(t, err)
+	defer cleanup()
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err = cmd.Run()
+	return out.String(), err
+}
+
+func TestSandbox(t *testing.T) {
+	input := t.TempDir()
+	output := t.TempDir()
+	hidden := t.TempDir()
+
+	require.NoError(t, os.WriteFile(filepath.Join(input, "in.txt"), []byte("input"), 0o644))
+	require.NoError(t, os.WriteFile(filepath.Join(hidden, "secret.txt"), []byte("hidden content"), 0o644))
+
+	config := &sandbox.Config{ReadOnly: []string{input}, Writable: []string{output}, Dir: input}
+
+	out, err := run(t, config, "cat in.txt > "+output+"/out.txt && echo tmp > /tmp/scratch && cat /tmp/scratch")
+	require.NoError(t, err, out)
+	require.Equal(t, "tmp\n", out)
+
+	content, err := os.ReadFile(filepath.Join(output, "out.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "input", string(content))
+
+	t.Run("ReadOnlyInputs", func(t *testing.T) {
+		out, err := run(t, config, "echo changed > in.txt")
+		require.Error(t, err, out)
+	})
+
+	t.Run("UndeclaredInputs", func(t *testing.T) {
+		out, err := run(t, config, "cat "+filepath.Join(hidden, "secret.txt"))
+		require.Error(t, err, out)
+		require.NotContains(t, out, "hidden content")
+	})
+
+	t.Run("SystemFiles", func(t *testing.T) {
+		if _, err := os.Stat("/etc/hostname"); err != nil {
+			t.Skip("/etc/hostname is missing")
+		}
+
+		out, err := run(t, config, "test -f /etc/passwd && ! test -e /etc/hostname")
+		require.NoError(t, err, out)
+	})
+
+	t.Run("NoNetwork", func(t *testing.T) {
+		out, err := run(t, config, "tail -n +3 /proc/net/dev | cut -d: -f1")
+		require.NoError(t, err, out)
+		require.Equal(t, "lo", string(bytes.TrimSpace([]byte(out))))
+	})
+
+	t.Run("Binds", func(t *testing.T) {
+		require.NoError(t, os.WriteFile(filepath.Join(input, "bound.txt"), nil, 0o644))
+
+		withBinds := *config
+		withBinds.Binds = map[string]string{filepath.Join(input, "bound.txt"): filepath.Join(hidden, "secret.txt")}
+
+		out, err := run(t, &withBinds, "cat bound.txt && ! echo changed > bound.txt")
+		require.NoError(t, err, out)
+		require.Contains(t, out, "hidden content")
+	})
+
+	t.Run("LargeConfig", func(t *testing.T) {
+		// config exceeds the size limit of a single argument
+		large := *config
+		large.ReadOnly = slices.Clone(config.ReadOnly)
+		for range 1024 {
+			large.ReadOnly = append(large.ReadOnly, input+"/"+strings.Repeat("./", 64))
+		}
+
+		out, err := run(t, &large, "cat in.txt")
+		require.NoError(t, err, out)
+		require.Equal(t, "input", out)
+	})
+
+	t.Run("PrivateProc", func(t *testing.T) {
+		out, err := run(t, config, "ls /proc | grep -c '^[0-9]'")
+		require.NoError(t, err, out)
+		// sandbox init, sh, ls and grep
+		require.LessOrEqual(t, len(out), len("4\n"))
+	})
+}
@@ -0,0 +1,149 @@
+//go:build !solution
+
+package scheduler
+
+import (
+	"cmp"
+	"math"
+	"slices"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Pending jobs are grouped into per-build queues. Every pick charges the estimated job duration
+// to the virtual time of the build and its user. Next job is taken from the user with the lowest
+// virtual time, then from that user's build with the lowest virtual time, so a huge build
+// can't starve builds submitted after it.
+
+type buildQueue struct {
+	id      build.ID
+	user    *userShare
+	weight  float64
+	seq     int
+	vtime   float64
+	pending []*PendingJob
+}
+
+type userShare struct {
+	name   string
+	vtime  float64
+	builds map[build.ID]*buildQueue
+}
+
+// priorityWeight converts build priority to its share: every priority level doubles the share.
+// Priority is clamped to [api.MinPriority, api.MaxPriority], so that shares stay finite and positive.
+func priorityWeight(priority int) float64 {
+	priority = min(max(priority, api.MinPriority), api.MaxPriority)
+	return math.Pow(2, float64(priority))
+}
+
+func (c *Scheduler) userShare(name string) *userShare {
+	u, ok := c.users[name]
+	if !ok {
+		u = &userShare{name: name, builds: make(map[build.ID]*buildQueue)}
+		c.users[name] = u
+	}
+	return u
+}
+
+func (c *Scheduler) addBuildQueue(id build.ID, user string, priority int) *buildQueue {
+	q, ok := c.builds[id]
+	if ok {
+		return q
+	}
+
+	c.buildSeq++
+	q = &buildQueue{id: id, user: c.userShare(user), weight: priorityWeight(priority), seq: c.buildSeq}
+	q.user.builds[id] = q
+	c.builds[id] = q
+	return q
+}
+
+func (c *Scheduler) removeBuildQueue(id build.ID) []*PendingJob {
+	q, ok := c.builds[id]
+	if !ok {
+		return nil
+	}
+
+	delete(c.builds, id)
+	delete(q.user.builds, id)
+	if len(q.user.builds) == 0 {
+		delete(c.users, q.user.name)
+	}
+	return q.pending
+}
+
+func (u *userShare) active() bool {
+	for _, q := range u.builds {
+		if len(q.pending) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue adds job to the queue. Queue that becomes active starts from the lowest virtual time
+// among active queues, so idle builds and users don't accumulate credit.
+func (c *Scheduler) enqueue(q *buildQueue, job *PendingJob) {
+	if len(q.pending) == 0 {
+		if !q.user.active() {
+			minUser := math.Inf(1)
+			for _, u := range c.users {
+				if u != q.user && u.active() {
+					minUser = min(minUser, u.vtime)
+				}
+			}
+			if !math.IsInf(minUser, 1) {
+				q.user.vtime = max(q.user.vtime, minUser)
+			}
+		}
+
+		minBuild := math.Inf(1)
+		for _, other := range q.user.builds {
+			if other != q && len(other.pending) > 0 {
+				minBuild = min(minBuild, other.vtime)
+			}
+		}
+		if !math.IsInf(minBuild, 1) {
+			q.vtime = max(q.vtime, minBuild)
+		}
+	}
+
+	q.pending = append(q.pending, job)
+}
+
+// fairOrder returns build queues with pending jobs in the order they should be served.
+func (c *Scheduler) fairOrder() []*buildQueue {
+	var users []*userShare
+	for _, u := range c.users {
+		if u.active() {
+			users = append(users, u)
+		}
+	}
+	slices.SortFunc(users, func(a, b *userShare) int {
+		return cmp.Or(cmp.Compare(a.vtime, b.vtime), cmp.Compare(a.name, b.name))
+	})
+
+	var order []*buildQueue
+	for _, u := range users {
+		var queues []*buildQueue
+		for _, q := range u.builds {
+			if len(q.pending) > 0 {
+				queues = append(queues, q)
+			}
+		}
+		slices.SortFunc(queues, func(a, b *buildQueue) int {
+			return cmp.Or(cmp.Compare(a.vtime, b.vtime), cmp.Compare(a.seq, b.seq))
+		})
+		order = append(order, queues...)
+	}
+	return order
+}
+
+// charge accounts job picked from the queue.
+func (c *Scheduler) charge(q *buildQueue, job *PendingJob) {
+	cost := c.history.estimateOrDefault(&job.Job.Job).Seconds()
+	q.vtime += cost / q.weight
+	q.user.vtime += cost
+}
@@ -0,0 +1,70 @@
+package scheduler_test
+
+import (
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+func TestFairShareBetweenUsers(t *testing.T) {
+	s := newScheduler(t, "")
+
+	batch, interactive := build.ID{'b'}, build.ID{'i'}
+	s.StartBuild(batch, "release", 0)
+	s.StartBuild(interactive, "alice", 0)
+
+	for i := 0; i < 100; i++ {
+		s.ScheduleBuildJob(batch, &api.JobSpec{Job: build.Job{ID: build.ID{'b', byte(i)}}})
+	}
+	pickOrder(t, s, worker0, 10)
+
+	s.ScheduleBuildJob(interactive, &api.JobSpec{Job: build.Job{ID: build.ID{'i', 0}}})
+	s.ScheduleBuildJob(interactive, &api.JobSpec{Job: build.Job{ID: build.ID{'i', 1}}})
+
+	require.Equal(t, []build.ID{{'i', 0}, {'b', 10}, {'i', 1}, {'b', 11}}, pickOrder(t, s, worker0, 4))
+}
+
+func TestBuildPriority(t *testing.T) {
+	s := newScheduler(t, "")
+
+	low, high := build.ID{'l'}, build.ID{'h'}
+	s.StartBuild(low, "ci", 0)
+	s.StartBuild(high, "ci", 1)
+
+	for i := 0; i < 10; i++ {
+		s.ScheduleBuildJob(low, &api.JobSpec{Job: build.Job{ID: build.ID{'l', byte(i)}}})
+		s.ScheduleBuildJob(high, &api.JobSpec{Job: build.Job{ID: build.ID{'h', byte(i)}}})
+	}
+
+	picked := map[byte]int{}
+	for _, id := range pickOrder(t, s, worker0, 9) {
+		picked[id[0]]++
+	}
+	require.Equal(t, map[byte]int{'h': 6, 'l': 3}, picked)
+
+	s.FinishBuild(high)
+	require.Equal(t, []build.ID{{'l', 3}}, pickOrder(t, s, worker0, 1))
+}
+
+func TestBuildPriorityClamped(t *testing.T) {
+	s := newScheduler(t, "")
+
+	huge, high := build.ID{'x'}, build.ID{'h'}
+	s.StartBuild(huge, "ci", math.MaxInt)
+	s.StartBuild(high, "ci", api.MaxPriority)
+
+	for i := 0; i < 10; i++ {
+		s.ScheduleBuildJob(huge, &api.JobSpec{Job: build.Job{ID: build.ID{'x', byte(i)}}})
+		s.ScheduleBuildJob(high, &api.JobSpec{Job: build.Job{ID: build.ID{'h', byte(i)}}})
+	}
+
+	picked := map[byte]int{}
+	for _, id := range pickOrder(t, s, worker0, 4) {
+		picked[id[0]]++
+	}
+	require.Equal(t, map[byte]int{'x': 2, 'h': 2}, picked)
+}
@@ -0,0 +1,285 @@
+//go:build !solution
+
+package scheduler
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// defaultJobEstimate is used for jobs that were never observed before.
+const defaultJobEstimate = time.Second
+
+// historySamples is the number of the latest observations kept for every job.
+const historySamples = 16
+
+// samples are the latest observed durations, oldest first.
+type samples []time.Duration
+
+func (s samples) add(d time.Duration) samples {
+	if len(s) < historySamples {
+		return append(s, d)
+	}
+	copy(s, s[1:])
+	s[len(s)-1] = d
+	return s
+}
+
+func (s samples) quantile(q float64) time.Duration {
+	sorted := slices.Clone(s)
+	slices.Sort(sorted)
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[min(max(i, 0), len(sorted)-1)]
+}
+
+// History remembers observed execution times of jobs.
+//
+// Job ID changes with every change of inputs, so estimates fall back to the job name
+// (e.g. "build pkg/a"), which stays the same between builds.
+type History struct {
+	log *zap.Logger
+
+	mu     sync.Mutex
+	byID   map[build.ID]samples
+	byName map[string]samples
+	// recent are IDs of the observations in byName, oldest first. Samples of ID are kept only while they
+	// are among samples of its name, so that IDs, which change with every change of inputs, don't accumulate.
+	recent map[string][]build.ID
+	// file is the log of observations, nil if history is kept only in memory
+	file *os.File
+}
+
+func NewHistory() *History {
+	return &History{
+		log:    zap.NewNop(),
+		byID:   make(map[build.ID]samples),
+		byName: make(map[string]samples),
+		recent: make(map[string][]build.ID),
+	}
+}
+
+// observation is a record of the history file.
+type observation struct {
+	ID       build.ID
+	Name     string
+	Duration time.Duration
+}
+
+// OpenHistory loads history from the file at path and appends new observations to it.
+// The file is a log of JSON records, it is compacted on open to the records still used for estimates.
+func OpenHistory(log *zap.Logger, path string) (*History, error) {
+	h := NewHistory()
+	h.log = log
+
+	records, err := readHistory(path)
+	if err != nil {
+		return nil, fmt.Errorf("error during reading history %v: %w", path, err)
+	}
+
+	kept := compactHistory(records)
+	for _, r := range kept {
+		h.add(&r)
+	}
+
+	if len(kept) != len(records) {
+		if err := writeHistory(path, kept); err != nil {
+			return nil, fmt.Errorf("error during compacting history %v: %w", path, err)
+		}
+	}
+
+	h.file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+func readHistory(path string) ([]observation, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []observation
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r observation
+		// the last record may be torn by crash
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// compactHistory drops records which are older than historySamples records of their job name.
+func compactHistory(records []observation) []observation {
+	byName := make(map[string]int)
+
+	var kept []observation
+	for _, r := range slices.Backward(records) {
+		byName[r.Name]++
+		if byName[r.Name] <= historySamples {
+			kept = append(kept, r)
+		}
+	}
+	slices.Reverse(kept)
+	return kept
+}
+
+// writeHistory atomically replaces file at path with records.
+func writeHistory(path string, records []observation) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range records {
+		if err := enc.Encode(r); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// Close closes the history file.
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.file == nil {
+		return nil
+	}
+	err := h.file.Close()
+	h.file = nil
+	return err
+}
+
+func (h *History) add(r *observation) {
+	h.byID[r.ID] = h.byID[r.ID].add(r.Duration)
+	h.byName[r.Name] = h.byName[r.Name].add(r.Duration)
+
+	recent := h.recent[r.Name]
+	if len(recent) < historySamples {
+		h.recent[r.Name] = append(recent, r.ID)
+		return
+	}
+
+	// the oldest sample of the name is the oldest sample of its ID as well
+	oldest := recent[0]
+	copy(recent, recent[1:])
+	recent[len(recent)-1] = r.ID
+	if s := h.byID[oldest][1:]; len(s) != 0 {
+		h.byID[oldest] = s
+	} else {
+		delete(h.byID, oldest)
+	}
+}
+
+func (h *History) Observe(job *build.Job, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	r := observation{ID: job.ID, Name: job.Name, Duration: d}
+	h.add(&r)
+
+	if h.file != nil {
+		line, err := json.Marshal(r)
+		if err == nil {
+			_, err = h.file.Write(append(line, '\n'))
+		}
+		if err != nil {
+			h.log.Error("couldn't persist job duration", zap.String("job_id", job.ID.String()), zap.Error(err))
+		}
+	}
+}
+
+func (h *History) lookup(job *build.Job) samples {
+	if s, ok := h.byID[job.ID]; ok {
+		return s
+	}
+	return h.byName[job.Name]
+}
+
+// Estimate returns the latest observed duration of the job.
+func (h *History) Estimate(job *build.Job) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.lookup(job)
+	if len(s) == 0 {
+		return 0, false
+	}
+	return s[len(s)-1], true
+}
+
+// Quantile returns q-quantile of the latest observed durations of the job.
+func (h *History) Quantile(job *build.Job, q float64) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := h.lookup(job)
+	if len(s) == 0 {
+		return 0, false
+	}
+	return s.quantile(q), true
+}
+
+// Remaining estimates time left until all jobs are done as the longest chain of jobs. Deps outside of jobs
+// are considered done. Elapsed returns how long the job is already running, zero for jobs not started yet.
+func (h *History) Remaining(jobs []build.Job, elapsed func(job *build.Job) time.Duration) time.Duration {
+	pending := make(map[build.ID]bool, len(jobs))
+	for _, job := range jobs {
+		pending[job.ID] = true
+	}
+
+	graph := make([]build.Job, len(jobs))
+	for i, job := range jobs {
+		graph[i] = job
+		graph[i].Deps = slices.DeleteFunc(slices.Clone(job.Deps), func(id build.ID) bool { return !pending[id] })
+	}
+
+	var remaining time.Duration
+	path := build.CriticalPath(graph, func(job *build.Job) time.Duration {
+		return max(h.estimateOrDefault(job)-elapsed(job), 0)
+	})
+	for _, d := range path {
+		remaining = max(remaining, d)
+	}
+	return remaining
+}
+
+func (h *History) estimateOrDefault(job *build.Job) time.Duration {
+	if d, ok := h.Estimate(job); ok {
+		return d
+	}
+	return defaultJobEstimate
+}
@@ -0,0 +1,108 @@
+package scheduler_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+func TestHistoryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	log := zaptest.NewLogger(t)
+
+	a := &build.Job{ID: build.ID{'a'}, Name: "build a"}
+	b := &build.Job{ID: build.ID{'b'}, Name: "build b"}
+
+	h, err := scheduler.OpenHistory(log, path)
+	require.NoError(t, err)
+	for i := range 40 {
+		h.Observe(a, time.Duration(i)*time.Second)
+	}
+	h.Observe(b, time.Minute)
+	require.NoError(t, h.Close())
+
+	h, err = scheduler.OpenHistory(log, path)
+	require.NoError(t, err)
+	defer h.Close()
+
+	d, ok := h.Estimate(a)
+	require.True(t, ok)
+	require.Equal(t, 39*time.Second, d)
+
+	d, ok = h.Estimate(&build.Job{ID: build.ID{'B'}, Name: "build b"})
+	require.True(t, ok, "estimate falls back to job name")
+	require.Equal(t, time.Minute, d)
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 17, bytes.Count(content, []byte("\n")), "old records are compacted")
+}
+
+func TestHistoryCompactsChangedIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	log := zaptest.NewLogger(t)
+
+	h, err := scheduler.OpenHistory(log, path)
+	require.NoError(t, err)
+
+	// ID of the job changes with every change of its inputs
+	job := func(i int) *build.Job {
+		return &build.Job{ID: build.ID{byte(i)}, Name: "build a"}
+	}
+	for i := range 100 {
+		h.Observe(job(i), time.Duration(i)*time.Second)
+	}
+
+	check := func() {
+		d, ok := h.Estimate(job(0))
+		require.True(t, ok)
+		require.Equal(t, 99*time.Second, d, "samples of old IDs are dropped")
+
+		d, ok = h.Estimate(job(90))
+		require.True(t, ok)
+		require.Equal(t, 90*time.Second, d)
+	}
+	check()
+	require.NoError(t, h.Close())
+
+	h, err = scheduler.OpenHistory(log, path)
+	require.NoError(t, err)
+	defer h.Close()
+	check()
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, 16, bytes.Count(content, []byte("\n")), "records of old IDs are compacted")
+}
+
+func TestHistoryRemaining(t *testing.T) {
+	h := scheduler.NewHistory()
+
+	a := build.Job{ID: build.ID{'a'}, Name: "a"}
+	b := build.Job{ID: build.ID{'b'}, Name: "b", Deps: []build.ID{a.ID, {'d'}}}
+	c := build.Job{ID: build.ID{'c'}, Name: "c"}
+	h.Observe(&a, 3*time.Second)
+	h.Observe(&b, 2*time.Second)
+	h.Observe(&c, 4*time.Second)
+
+	notStarted := func(*build.Job) time.Duration { return 0 }
+	require.Equal(t, 5*time.Second, h.Remaining([]build.Job{a, b, c}, notStarted))
+
+	aRunning := func(job *build.Job) time.Duration {
+		if job.ID == a.ID {
+			return 2 * time.Second
+		}
+		return 0
+	}
+	require.Equal(t, 4*time.Second, h.Remaining([]build.Job{a, b, c}, aRunning))
+	require.Equal(t, 2*time.Second, h.Remaining([]build.Job{b}, notStarted))
+	require.Equal(t, time.Duration(0), h.Remaining(nil, notStarted))
+}
@@ -0,0 +1,109 @@
+//go:build !solution
+
+package scheduler
+
+import (
+	"fmt"
+	"slices"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Policy chooses which of the pending jobs should run next on a worker.
+type Policy interface {
+	// Pick returns index of the job in pending that should run on workerID,
+	// or -1 if none of them should run there. pending is ordered by scheduling time.
+	Pick(workerID api.WorkerID, pending []*PendingJob) int
+}
+
+const (
+	PolicyFIFO         = "fifo"
+	PolicyLocality     = "locality"
+	PolicyCriticalPath = "critical-path"
+	PolicyShortestJob  = "shortest-job"
+)
+
+func newPolicy(name string, s *Scheduler) (Policy, error) {
+	switch name {
+	case "", PolicyFIFO:
+		return fifoPolicy{}, nil
+	case PolicyLocality:
+		return &localityPolicy{s}, nil
+	case PolicyCriticalPath:
+		return &criticalPathPolicy{s}, nil
+	case PolicyShortestJob:
+		return &shortestJobPolicy{s}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheduling policy %q", name)
+	}
+}
+
+// pickBest returns index of the job with the highest score; ties are broken in FIFO order.
+func pickBest[T int | int64](pending []*PendingJob, score func(p *PendingJob) T) int {
+	best := -1
+	var bestScore T
+	for i, p := range pending {
+		if s := score(p); best == -1 || s > bestScore {
+			best, bestScore = i, s
+		}
+	}
+	return best
+}
+
+type fifoPolicy struct{}
+
+func (fifoPolicy) Pick(workerID api.WorkerID, pending []*PendingJob) int {
+	if len(pending) == 0 {
+		return -1
+	}
+	return 0
+}
+
+// localityPolicy prefers jobs whose result or dependencies are already cached on the worker.
+type localityPolicy struct {
+	s *Scheduler
+}
+
+func (p *localityPolicy) Pick(workerID api.WorkerID, pending []*PendingJob) int {
+	isLocal := func(id build.ID) bool {
+		return slices.Contains(p.s.LocateArtifactReplicas(id), workerID)
+	}
+
+	return pickBest(pending, func(job *PendingJob) int {
+		if isLocal(job.Job.ID) {
+			// job result is in cache, worker will only report it
+			return len(job.Job.Deps) + 1
+		}
+
+		score := 0
+		for _, dep := range job.Job.Deps {
+			if isLocal(dep) {
+				score++
+			}
+		}
+		return score
+	})
+}
+
+// criticalPathPolicy prefers jobs with the longest chain of jobs waiting for them.
+type criticalPathPolicy struct {
+	s *Scheduler
+}
+
+func (p *criticalPathPolicy) Pick(workerID api.WorkerID, pending []*PendingJob) int {
+	return pickBest(pending, func(job *PendingJob) int64 {
+		return int64(p.s.criticalPath[job.BuildID][job.Job.ID])
+	})
+}
+
+// shortestJobPolicy prefers jobs with the smallest observed execution time.
+type shortestJobPolicy struct {
+	s *Scheduler
+}
+
+func (p *shortestJobPolicy) Pick(workerID api.WorkerID, pending []*PendingJob) int {
+	return pickBest(pending, func(job *PendingJob) int64 {
+		return -int64(p.s.history.estimateOrDefault(&job.Job.Job))
+	})
+}
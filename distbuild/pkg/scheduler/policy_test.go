@@ -0,0 +1,109 @@
+package scheduler_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+const (
+	worker0 api.WorkerID = "w0"
+	worker1 api.WorkerID = "w1"
+)
+
+func newScheduler(t *testing.T, policy string) *scheduler.Scheduler {
+	s, err := scheduler.NewScheduler(zaptest.NewLogger(t), scheduler.Config{Policy: policy})
+	require.NoError(t, err)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func pickOrder(t *testing.T, s *scheduler.Scheduler, workerID api.WorkerID, n int) []build.ID {
+	var ids []build.ID
+	for i := 0; i < n; i++ {
+		job := s.PickJob(context.Background(), workerID)
+		require.NotNil(t, job)
+		ids = append(ids, job.Job.ID)
+	}
+	return ids
+}
+
+func TestFIFOPolicy(t *testing.T) {
+	s := newScheduler(t, scheduler.PolicyFIFO)
+
+	for _, id := range []build.ID{{'a'}, {'b'}, {'c'}} {
+		s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: id}})
+	}
+
+	require.Equal(t, []build.ID{{'a'}, {'b'}, {'c'}}, pickOrder(t, s, worker0, 3))
+}
+
+func TestLocalityPolicy(t *testing.T) {
+	s := newScheduler(t, scheduler.PolicyLocality)
+
+	s.OnJobComplete(worker1, build.ID{'x'}, &api.JobResult{ID: build.ID{'x'}})
+
+	s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: build.ID{'a'}}})
+	s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: build.ID{'b'}, Deps: []build.ID{{'x'}}}})
+
+	require.Equal(t, []build.ID{{'b'}}, pickOrder(t, s, worker1, 1))
+	require.Equal(t, []build.ID{{'a'}}, pickOrder(t, s, worker0, 1))
+
+	// copies of the artifact are as good as the original
+	s.AddArtifactReplica(worker0, build.ID{'x'})
+	s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: build.ID{'c'}}})
+	s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: build.ID{'d'}, Deps: []build.ID{{'x'}}}})
+
+	require.Equal(t, []build.ID{{'d'}, {'c'}}, pickOrder(t, s, worker0, 2))
+}
+
+func TestCriticalPathPolicy(t *testing.T) {
+	s := newScheduler(t, scheduler.PolicyCriticalPath)
+
+	jobs := []build.Job{
+		{ID: build.ID{'a'}},
+		{ID: build.ID{'b'}},
+		{ID: build.ID{'c'}, Deps: []build.ID{{'b'}}},
+	}
+	s.RegisterJobs(build.ID{}, jobs)
+
+	s.ScheduleJob(&api.JobSpec{Job: jobs[0]})
+	s.ScheduleJob(&api.JobSpec{Job: jobs[1]})
+
+	require.Equal(t, []build.ID{{'b'}, {'a'}}, pickOrder(t, s, worker0, 2))
+}
+
+func TestShortestJobPolicy(t *testing.T) {
+	now := time.Now()
+	scheduler.TimeNow = func() time.Time { return now }
+	defer func() { scheduler.TimeNow = time.Now }()
+
+	s := newScheduler(t, scheduler.PolicyShortestJob)
+
+	run := func(job build.Job, d time.Duration, cached bool) {
+		s.ScheduleJob(&api.JobSpec{Job: job})
+		pickOrder(t, s, worker0, 1)
+		now = now.Add(d)
+		s.OnJobComplete(worker0, job.ID, &api.JobResult{ID: job.ID, Cached: cached})
+	}
+
+	run(build.Job{ID: build.ID{'a', 1}, Name: "test a"}, time.Minute, false)
+	run(build.Job{ID: build.ID{'b', 1}, Name: "test b"}, time.Millisecond, false)
+
+	// results taken from cache must not make the job look fast
+	for i := byte(0); i < 3; i++ {
+		run(build.Job{ID: build.ID{'a', 10 + i}, Name: "test a"}, 0, true)
+	}
+
+	s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: build.ID{'a', 2}, Name: "test a"}})
+	s.ScheduleJob(&api.JobSpec{Job: build.Job{ID: build.ID{'b', 2}, Name: "test b"}})
+
+	require.Equal(t, []build.ID{{'b', 2}, {'a', 2}}, pickOrder(t, s, worker0, 2))
+}
@@ -5,6 +5,7 @@ package scheduler
 import (
 	"context"
 	"fmt"
+	"slices"
 	"sync"
 	"time"
 
@@ -14,94 +15,461 @@ import (
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 )
 
-var TimeAfter = time.After
+var (
+	TimeAfter = time.After
+	TimeNow   = time.Now
+)
 
 type PendingJob struct {
 	Job      *api.JobSpec
 	Finished chan struct{}
 	Result   *api.JobResult
+
+	BuildID build.ID
+
+	scheduledAt time.Time
+	pickedAt    time.Time
+	// workers running the job, more than one if speculative duplicate was started
+	workers []api.WorkerID
 }
 
 type Config struct {
 	CacheTimeout time.Duration
 	DepsTimeout  time.Duration
+
+	// Policy is the name of scheduling policy (see Policy* constants), FIFO if empty.
+	Policy string
+
+	// SpeculationFactor enables speculative execution: job running longer than SpeculationFactor times
+	// p90 of its history is duplicated on an idle worker. First successful attempt wins, others are cancelled.
+	// Zero disables speculative execution.
+	SpeculationFactor float64
+	// SpeculationMinRuntime is the minimal runtime of the job before it is duplicated.
+	SpeculationMinRuntime time.Duration
+
+	// HistoryPath is the file where observed durations of jobs are kept between restarts.
+	// History is kept only in memory if it is empty.
+	HistoryPath string
 }
 
+// speculationCheckInterval is how often idle workers look for straggler jobs.
+const speculationCheckInterval = 50 * time.Millisecond
+
 type Scheduler struct {
-	l      *zap.Logger
-	config Config
+	l       *zap.Logger
+	config  Config
+	policy  Policy
+	history *History
 
-	jobsQue           chan *PendingJob
+	mu       sync.Mutex
+	builds   map[build.ID]*buildQueue
+	users    map[string]*userShare
+	buildSeq int
+	// running maps job id to its running attempts by build id, one job may be run by several builds
+	running      map[build.ID]map[build.ID]*PendingJob
+	criticalPath map[build.ID]map[build.ID]time.Duration
+	// losers are the jobs that must be cancelled on the worker, the value is true once the worker was told so
+	losers map[api.WorkerID]map[build.ID]bool
+	// jobAdded is closed and replaced every time a new job is scheduled
+	jobAdded chan struct{}
+
+	// artifactLocations maps artifact id to the []api.WorkerID having it, the slices are never modified.
 	artifactLocations sync.Map
+	locationsMu       sync.Mutex
 
 	stopped   bool
-	stoppedMu sync.RWMutex
 	stoppedCh chan struct{}
 }
 
-func NewScheduler(l *zap.Logger, config Config) *Scheduler {
-	return &Scheduler{
-		l,
-		config,
+// NewScheduler creates scheduler, it fails if the scheduling policy is unknown.
+func NewScheduler(l *zap.Logger, config Config) (*Scheduler, error) {
+	c := &Scheduler{
+		l:       l,
+		config:  config,
+		history: NewHistory(),
+
+		builds:       make(map[build.ID]*buildQueue),
+		users:        make(map[string]*userShare),
+		running:      make(map[build.ID]map[build.ID]*PendingJob),
+		criticalPath: make(map[build.ID]map[build.ID]time.Duration),
+		losers:       make(map[api.WorkerID]map[build.ID]bool),
+		jobAdded:     make(chan struct{}),
 
-		make(chan *PendingJob, 100), // if chan is full (contains 100 elements) ScheduleJob will hang until next PickJob
-		sync.Map{},
+		stoppedCh: make(chan struct{}),
+	}
 
-		false,
-		sync.RWMutex{},
-		make(chan struct{}),
+	policy, err := newPolicy(config.Policy, c)
+	if err != nil {
+		return nil, err
 	}
+	c.policy = policy
+
+	if config.HistoryPath != "" {
+		history, err := OpenHistory(l, config.HistoryPath)
+		if err != nil {
+			l.Error("job history is kept only in memory", zap.Error(err))
+		} else {
+			c.history = history
+		}
+	}
+
+	return c, nil
 }
 
+// LocateArtifact returns the worker which produced the artifact or the first worker which got its copy.
 func (c *Scheduler) LocateArtifact(id build.ID) (api.WorkerID, bool) {
-	workerID, ok := c.artifactLocations.Load(id.String())
-	c.l.Debug(fmt.Sprintf("check if artifact %v is in cache: %v", id, ok))
-	if ok {
-		return workerID.(api.WorkerID), ok
+	replicas := c.LocateArtifactReplicas(id)
+	if len(replicas) != 0 {
+		return replicas[0], true
 	}
 	return api.WorkerID(""), false
 }
 
+// LocateArtifactReplicas returns all workers having the artifact.
+func (c *Scheduler) LocateArtifactReplicas(id build.ID) []api.WorkerID {
+	replicas, ok := c.artifactLocations.Load(id)
+	if !ok {
+		return nil
+	}
+	return replicas.([]api.WorkerID)
+}
+
+// AddArtifactReplica records that the worker has a copy of the artifact.
+func (c *Scheduler) AddArtifactReplica(workerID api.WorkerID, id build.ID) {
+	c.locationsMu.Lock()
+	defer c.locationsMu.Unlock()
+
+	replicas := c.LocateArtifactReplicas(id)
+	if slices.Contains(replicas, workerID) {
+		return
+	}
+	c.artifactLocations.Store(id, append(slices.Clip(replicas), workerID))
+}
+
+// RemoveArtifactReplica records that the worker lost its copy of the artifact, e.g. it was evicted from the cache.
+func (c *Scheduler) RemoveArtifactReplica(workerID api.WorkerID, id build.ID) {
+	c.locationsMu.Lock()
+	defer c.locationsMu.Unlock()
+
+	replicas := c.LocateArtifactReplicas(id)
+	i := slices.Index(replicas, workerID)
+	if i < 0 {
+		return
+	}
+	if len(replicas) == 1 {
+		c.artifactLocations.Delete(id)
+		return
+	}
+	c.artifactLocations.Store(id, slices.Delete(slices.Clone(replicas), i, i+1))
+}
+
+// OnJobComplete records job result and reports whether the result should be processed.
+// Results of the speculative attempts that lost or failed while other attempt is still running are dropped.
 func (c *Scheduler) OnJobComplete(workerID api.WorkerID, jobID build.ID, res *api.JobResult) bool {
 	c.l.Info(fmt.Sprintf("Job %v completed, res: %v", res.ID, *res))
-	if res.ExitCode == 0 {
-		c.artifactLocations.Store(res.ID.String(), workerID)
+	failed := res.ExitCode != 0 || res.Error != nil
+
+	c.mu.Lock()
+	if _, ok := c.losers[workerID][jobID]; ok {
+		delete(c.losers[workerID], jobID)
+		if len(c.losers[workerID]) == 0 {
+			delete(c.losers, workerID)
+		}
+		c.mu.Unlock()
+
+		c.l.Debug(fmt.Sprintf("drop result of cancelled attempt of job %v on worker %v", jobID, workerID))
+		return false
+	}
+
+	job := c.runningOn(workerID, jobID)
+	ok := job != nil
+	if ok && len(job.workers) > 1 {
+		if failed {
+			job.workers = slices.DeleteFunc(job.workers, func(w api.WorkerID) bool { return w == workerID })
+			c.mu.Unlock()
+
+			c.l.Debug(fmt.Sprintf("drop failed attempt of job %v on worker %v, other attempt is running", jobID, workerID))
+			return false
+		}
+
+		for _, w := range job.workers {
+			if w != workerID {
+				if c.losers[w] == nil {
+					c.losers[w] = make(map[build.ID]bool)
+				}
+				c.losers[w][jobID] = false
+			}
+		}
+	}
+	if ok {
+		c.removeRunning(job)
+	}
+	c.mu.Unlock()
+
+	if failed {
 		return true
 	}
-	return false
+
+	// results taken from cache and jobs that never ran on a worker say nothing about execution time
+	if ok && !res.Cached && !job.pickedAt.IsZero() {
+		c.history.Observe(&job.Job.Job, TimeNow().Sub(job.pickedAt))
+	}
+	c.AddArtifactReplica(workerID, res.ID)
+	return true
+}
+
+// runningOn returns attempt of the job running on the worker. Results of jobs found in cache are reported
+// by the worker having the artifact, the latest picked attempt is returned then. Requires c.mu to be held.
+func (c *Scheduler) runningOn(workerID api.WorkerID, jobID build.ID) *PendingJob {
+	var latest *PendingJob
+	for _, job := range c.running[jobID] {
+		if slices.Contains(job.workers, workerID) {
+			return job
+		}
+		if latest == nil || job.pickedAt.After(latest.pickedAt) {
+			latest = job
+		}
+	}
+	return latest
+}
+
+func (c *Scheduler) addRunning(job *PendingJob) {
+	builds := c.running[job.Job.ID]
+	if builds == nil {
+		builds = make(map[build.ID]*PendingJob)
+		c.running[job.Job.ID] = builds
+	}
+	builds[job.BuildID] = job
+}
+
+func (c *Scheduler) removeRunning(job *PendingJob) {
+	builds := c.running[job.Job.ID]
+	delete(builds, job.BuildID)
+	if len(builds) == 0 {
+		delete(c.running, job.Job.ID)
+	}
+}
+
+// CancelledJobs returns jobs the worker should stop, because their other attempt finished first.
+// Every job is returned once.
+func (c *Scheduler) CancelledJobs(workerID api.WorkerID) []build.ID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var ids []build.ID
+	for id, notified := range c.losers[workerID] {
+		if !notified {
+			ids = append(ids, id)
+			c.losers[workerID][id] = true
+		}
+	}
+	return ids
+}
+
+// UnregisterWorker forgets the worker which stopped sending heartbeats. Its cancellations are dropped,
+// and jobs duplicated on it are considered running only on the other worker, so they may be duplicated again.
+func (c *Scheduler) UnregisterWorker(workerID api.WorkerID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.losers, workerID)
+	for _, builds := range c.running {
+		for _, job := range builds {
+			if len(job.workers) > 1 {
+				job.workers = slices.DeleteFunc(job.workers, func(w api.WorkerID) bool { return w == workerID })
+			}
+		}
+	}
+}
+
+// RegisterJobs computes priorities of the build jobs. It should be called before the jobs are scheduled,
+// priorities are kept until FinishBuild.
+func (c *Scheduler) RegisterJobs(buildID build.ID, jobs []build.Job) {
+	path := build.CriticalPath(jobs, c.history.estimateOrDefault)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.criticalPath[buildID] = path
+}
+
+// Remaining estimates time left until the jobs of the build are done, running jobs are accounted by their
+// remaining time.
+func (c *Scheduler) Remaining(buildID build.ID, jobs []build.Job) time.Duration {
+	now := TimeNow()
+
+	c.mu.Lock()
+	picked := make(map[build.ID]time.Time)
+	for _, job := range jobs {
+		if p, ok := c.running[job.ID][buildID]; ok {
+			picked[job.ID] = p.pickedAt
+		}
+	}
+	c.mu.Unlock()
+
+	return c.history.Remaining(jobs, func(job *build.Job) time.Duration {
+		if at, ok := picked[job.ID]; ok {
+			return now.Sub(at)
+		}
+		return 0
+	})
+}
+
+// StartBuild registers build in fair share scheduling. Builds of one user share the user's slots
+// proportionally to their priority: every priority level doubles the share of the build.
+func (c *Scheduler) StartBuild(buildID build.ID, user string, priority int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.addBuildQueue(buildID, user, priority)
+}
+
+// FinishBuild removes build from fair share scheduling together with its pending jobs.
+func (c *Scheduler) FinishBuild(buildID build.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.criticalPath, buildID)
+	dropped := c.removeBuildQueue(buildID)
+	if len(dropped) != 0 {
+		c.l.Debug(fmt.Sprintf("build %v finished with %v pending jobs", buildID, len(dropped)))
+	}
 }
 
 func (c *Scheduler) ScheduleJob(job *api.JobSpec) *PendingJob {
-	c.stoppedMu.RLock()
-	c.l.Info("schedule job", zap.Any("job", *job))
+	return c.ScheduleBuildJob(build.ID{}, job)
+}
+
+func (c *Scheduler) ScheduleBuildJob(buildID build.ID, job *api.JobSpec) *PendingJob {
+	c.l.Info("schedule job", zap.Any("job", *job), zap.String("build_id", buildID.String()))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.stopped {
 		return nil
 	}
-	c.stoppedMu.RUnlock()
 
-	p := PendingJob{job, make(chan struct{}), &api.JobResult{ID: job.ID}}
-	c.jobsQue <- &p
+	p := &PendingJob{
+		Job:         job,
+		Finished:    make(chan struct{}),
+		Result:      &api.JobResult{ID: job.ID},
+		BuildID:     buildID,
+		scheduledAt: TimeNow(),
+	}
+	c.enqueue(c.addBuildQueue(buildID, "", 0), p)
+
+	close(c.jobAdded)
+	c.jobAdded = make(chan struct{})
 
-	return &p
+	return p
 }
 
-func (c *Scheduler) PickJob(ctx context.Context, workerID api.WorkerID) *PendingJob {
-	select {
-	case job := <-c.jobsQue:
-		c.l.Info("PickJob", zap.Any("jobSpec", *job.Job))
-		return job
-	case <-ctx.Done():
-		c.l.Info("PickJob cancelled")
-		return nil
-	case <-c.stoppedCh:
-		c.l.Info("PickJob: scheduler stopped")
+// tryPickJob returns the job chosen by policy or nil together with the channel to wait for new jobs on.
+func (c *Scheduler) tryPickJob(workerID api.WorkerID) (*PendingJob, <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, q := range c.fairOrder() {
+		i := c.policy.Pick(workerID, q.pending)
+		if i < 0 {
+			continue
+		}
+
+		job := q.pending[i]
+		q.pending = append(q.pending[:i], q.pending[i+1:]...)
+		c.charge(q, job)
+
+		job.pickedAt = TimeNow()
+		job.workers = []api.WorkerID{workerID}
+		c.addRunning(job)
+		return job, nil
+	}
+
+	if job := c.straggler(workerID); job != nil {
+		c.l.Info("start speculative attempt", zap.String("job_id", job.Job.ID.String()), zap.Any("workers", job.workers))
+		return job, nil
+	}
+
+	return nil, c.jobAdded
+}
+
+// straggler returns running job which should be duplicated on the worker, if any. Requires c.mu to be held.
+func (c *Scheduler) straggler(workerID api.WorkerID) *PendingJob {
+	if c.config.SpeculationFactor <= 0 {
 		return nil
 	}
+
+	now := TimeNow()
+	var slowest *PendingJob
+	var slowestLag time.Duration
+	for _, builds := range c.running {
+		for _, job := range builds {
+			// job is duplicated at most once
+			if len(job.workers) != 1 || job.workers[0] == workerID {
+				continue
+			}
+
+			p90, ok := c.history.Quantile(&job.Job.Job, 0.9)
+			if !ok {
+				continue
+			}
+
+			threshold := max(time.Duration(float64(p90)*c.config.SpeculationFactor), c.config.SpeculationMinRuntime)
+			if lag := now.Sub(job.pickedAt) - threshold; lag > 0 && (slowest == nil || lag > slowestLag) {
+				slowest, slowestLag = job, lag
+			}
+		}
+	}
+
+	if slowest != nil {
+		slowest.workers = append(slowest.workers, workerID)
+	}
+	return slowest
+}
+
+// TryPickJob is non-blocking version of PickJob, it returns nil if there are no jobs for the worker.
+func (c *Scheduler) TryPickJob(workerID api.WorkerID) *PendingJob {
+	job, _ := c.tryPickJob(workerID)
+	return job
+}
+
+func (c *Scheduler) PickJob(ctx context.Context, workerID api.WorkerID) *PendingJob {
+	for {
+		job, jobAdded := c.tryPickJob(workerID)
+		if job != nil {
+			c.l.Info("PickJob", zap.Any("jobSpec", *job.Job))
+			return job
+		}
+
+		var recheck <-chan time.Time
+		if c.config.SpeculationFactor > 0 {
+			recheck = TimeAfter(speculationCheckInterval)
+		}
+
+		select {
+		case <-jobAdded:
+		case <-recheck:
+		case <-ctx.Done():
+			c.l.Info("PickJob cancelled")
+			return nil
+		case <-c.stoppedCh:
+			c.l.Info("PickJob: scheduler stopped")
+			return nil
+		}
+	}
 }
 
 func (c *Scheduler) Stop() {
-	c.stoppedMu.Lock()
-	c.stopped = true
-	close(c.stoppedCh)
-	c.stoppedMu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.stopped {
+		c.stopped = true
+		close(c.stoppedCh)
+
+		if err := c.history.Close(); err != nil {
+			c.l.Error("couldn't close job history", zap.Error(err))
+		}
+	}
 }
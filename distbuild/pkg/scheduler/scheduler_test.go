@@ -0,0 +1,139 @@
+package scheduler_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+func TestArtifactReplicas(t *testing.T) {
+	s := newScheduler(t, scheduler.PolicyFIFO)
+
+	failed := "signal: killed"
+	s.OnJobComplete(worker0, build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}, ExitCode: -1, Error: &failed})
+	_, ok := s.LocateArtifact(build.ID{'a'})
+	require.False(t, ok)
+
+	s.OnJobComplete(worker1, build.ID{'a'}, &api.JobResult{ID: build.ID{'a'}})
+	s.AddArtifactReplica(worker0, build.ID{'a'})
+	s.AddArtifactReplica(worker0, build.ID{'a'})
+
+	owner, ok := s.LocateArtifact(build.ID{'a'})
+	require.True(t, ok)
+	require.Equal(t, worker1, owner)
+	require.Equal(t, []api.WorkerID{worker1, worker0}, s.LocateArtifactReplicas(build.ID{'a'}))
+
+	s.RemoveArtifactReplica(worker1, build.ID{'a'})
+	owner, ok = s.LocateArtifact(build.ID{'a'})
+	require.True(t, ok)
+	require.Equal(t, worker0, owner)
+
+	s.RemoveArtifactReplica(worker0, build.ID{'a'})
+	_, ok = s.LocateArtifact(build.ID{'a'})
+	require.False(t, ok)
+}
+
+func TestSpeculativeAttempt(t *testing.T) {
+	now := time.Now()
+	scheduler.TimeNow = func() time.Time { return now }
+	defer func() { scheduler.TimeNow = time.Now }()
+
+	s, err := scheduler.NewScheduler(zaptest.NewLogger(t), scheduler.Config{SpeculationFactor: 2})
+	require.NoError(t, err)
+	defer s.Stop()
+
+	fast := build.Job{ID: build.ID{'a', 0}, Name: "compile"}
+	s.ScheduleJob(&api.JobSpec{Job: fast})
+	pickOrder(t, s, worker0, 1)
+	now = now.Add(time.Second)
+	require.True(t, s.OnJobComplete(worker0, fast.ID, &api.JobResult{ID: fast.ID}))
+
+	slow := build.Job{ID: build.ID{'a', 1}, Name: "compile"}
+	s.ScheduleJob(&api.JobSpec{Job: slow})
+	pickOrder(t, s, worker0, 1)
+
+	now = now.Add(time.Second)
+	require.Nil(t, s.TryPickJob(worker1))
+
+	now = now.Add(2 * time.Second)
+	require.Nil(t, s.TryPickJob(worker0), "job is not duplicated on the same worker")
+	duplicate := s.TryPickJob(worker1)
+	require.NotNil(t, duplicate)
+	require.Equal(t, slow.ID, duplicate.Job.ID)
+	require.Nil(t, s.TryPickJob("w2"), "job is duplicated only once")
+
+	require.True(t, s.OnJobComplete(worker1, slow.ID, &api.JobResult{ID: slow.ID}))
+	require.Equal(t, []build.ID{slow.ID}, s.CancelledJobs(worker0))
+	require.Empty(t, s.CancelledJobs(worker0))
+
+	cancelled := "signal: killed"
+	require.False(t, s.OnJobComplete(worker0, slow.ID, &api.JobResult{ID: slow.ID, ExitCode: -1, Error: &cancelled}))
+}
+
+func TestUnregisterWorker(t *testing.T) {
+	now := time.Now()
+	scheduler.TimeNow = func() time.Time { return now }
+	defer func() { scheduler.TimeNow = time.Now }()
+
+	s, err := scheduler.NewScheduler(zaptest.NewLogger(t), scheduler.Config{SpeculationFactor: 2})
+	require.NoError(t, err)
+	defer s.Stop()
+
+	fast := build.Job{ID: build.ID{'a', 0}, Name: "compile"}
+	s.ScheduleJob(&api.JobSpec{Job: fast})
+	pickOrder(t, s, worker0, 1)
+	now = now.Add(time.Second)
+	require.True(t, s.OnJobComplete(worker0, fast.ID, &api.JobResult{ID: fast.ID}))
+
+	slow := build.Job{ID: build.ID{'a', 1}, Name: "compile"}
+	s.ScheduleJob(&api.JobSpec{Job: slow})
+	pickOrder(t, s, worker0, 1)
+	now = now.Add(3 * time.Second)
+	require.NotNil(t, s.TryPickJob(worker1))
+
+	// duplicate is lost together with worker1, the job may be duplicated again
+	s.UnregisterWorker(worker1)
+	duplicate := s.TryPickJob("w2")
+	require.NotNil(t, duplicate)
+	require.Equal(t, slow.ID, duplicate.Job.ID)
+
+	require.True(t, s.OnJobComplete(worker0, slow.ID, &api.JobResult{ID: slow.ID}))
+	s.UnregisterWorker("w2")
+	require.Empty(t, s.CancelledJobs("w2"))
+}
+
+func TestJobSharedByBuilds(t *testing.T) {
+	now := time.Now()
+	scheduler.TimeNow = func() time.Time { return now }
+	defer func() { scheduler.TimeNow = time.Now }()
+
+	s := newScheduler(t, scheduler.PolicyFIFO)
+
+	job := build.Job{ID: build.ID{'a'}, Name: "compile"}
+	buildA, buildB := build.ID{'A'}, build.ID{'B'}
+	s.ScheduleBuildJob(buildA, &api.JobSpec{Job: job})
+	s.ScheduleBuildJob(buildB, &api.JobSpec{Job: job})
+	pickOrder(t, s, worker0, 1)
+	pickOrder(t, s, worker1, 1)
+
+	now = now.Add(time.Second)
+	require.True(t, s.OnJobComplete(worker0, job.ID, &api.JobResult{ID: job.ID}))
+
+	// attempt of the other build is still running
+	require.Equal(t, time.Duration(0), s.Remaining(buildB, []build.Job{job}))
+	require.Equal(t, time.Second, s.Remaining(buildA, []build.Job{job}))
+
+	require.True(t, s.OnJobComplete(worker1, job.ID, &api.JobResult{ID: job.ID}))
+	require.Equal(t, time.Second, s.Remaining(buildB, []build.Job{job}))
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	_, err := scheduler.NewScheduler(zaptest.NewLogger(t), scheduler.Config{Policy: "random"})
+	require.Error(t, err)
+}
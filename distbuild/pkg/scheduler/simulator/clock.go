@@ -0,0 +1,49 @@
+//go:build !solution
+
+package simulator
+
+import (
+	"time"
+)
+
+type timer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// clock is a virtual clock; time moves only when the simulation advances it.
+type clock struct {
+	now    time.Time
+	timers []timer
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func (c *clock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.timers = append(c.timers, timer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *clock) advance(to time.Time) {
+	if to.After(c.now) {
+		c.now = to
+	}
+
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if t.at.After(c.now) {
+			active = append(active, t)
+		} else {
+			t.ch <- c.now
+		}
+	}
+	c.timers = active
+}
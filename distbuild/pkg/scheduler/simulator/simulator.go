@@ -0,0 +1,351 @@
+//go:build !solution
+
+// Package simulator replays recorded workloads through scheduler.Scheduler
+// against simulated workers using a virtual clock.
+package simulator
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+)
+
+// Build is one recorded build of the workload.
+type Build struct {
+	// SubmitAt is the offset from the start of the simulation at which the build is submitted.
+	SubmitAt time.Duration
+
+	Jobs []build.Job
+
+	// Durations contains observed execution times of jobs.
+	Durations map[build.ID]time.Duration
+
+	// ArtifactSizes contains sizes of job outputs in bytes.
+	ArtifactSizes map[build.ID]int64
+
+	// User and Priority are passed to fair share scheduling.
+	User     string
+	Priority int
+}
+
+type Workload struct {
+	Builds []Build
+}
+
+// ReadWorkload decodes json encoded workload.
+func ReadWorkload(r io.Reader) (*Workload, error) {
+	var w Workload
+	if err := json.NewDecoder(r).Decode(&w); err != nil {
+		return nil, fmt.Errorf("error during decoding workload: %w", err)
+	}
+	return &w, nil
+}
+
+type Config struct {
+	Workers   int
+	Scheduler scheduler.Config
+
+	// Bandwidth in bytes per second is used to compute artifact transfer time.
+	// Transfers are instant if Bandwidth is zero.
+	Bandwidth int64
+}
+
+type Result struct {
+	Makespan         time.Duration
+	Utilization      map[api.WorkerID]float64
+	BytesTransferred int64
+
+	// BuildLatency contains time from submit to finish of every build, in workload order.
+	BuildLatency []time.Duration
+}
+
+type eventKind int
+
+const (
+	buildSubmitted eventKind = iota
+	jobFinished
+)
+
+type event struct {
+	at   time.Time
+	seq  int
+	kind eventKind
+
+	build  int
+	worker int
+	job    *scheduler.PendingJob
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+func (q eventQueue) Less(i, j int) bool {
+	if !q[i].at.Equal(q[j].at) {
+		return q[i].at.Before(q[j].at)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *eventQueue) Push(x any)   { *q = append(*q, x.(*event)) }
+func (q *eventQueue) Pop() any {
+	old := *q
+	e := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return e
+}
+
+type buildState struct {
+	id         build.ID
+	spec       *Build
+	jobs       map[build.ID]*build.Job
+	dependents map[build.ID][]build.ID
+	done       map[build.ID]bool
+	submitted  time.Time
+	finished   time.Time
+}
+
+type workerState struct {
+	id        api.WorkerID
+	busy      bool
+	busyTime  time.Duration
+	artifacts map[build.ID]struct{}
+}
+
+type simulation struct {
+	l      *zap.Logger
+	config Config
+	clock  *clock
+	s      *scheduler.Scheduler
+
+	events  eventQueue
+	seq     int
+	builds  []*buildState
+	workers []*workerState
+	buildOf map[build.ID]int
+
+	bytesTransferred int64
+}
+
+// Run simulates the workload and returns collected metrics.
+//
+// Run replaces scheduler.TimeNow and scheduler.TimeAfter for the duration of the simulation,
+// so simulations must not run concurrently with each other or with a real scheduler.
+func Run(l *zap.Logger, w *Workload, config Config) (*Result, error) {
+	if config.Workers <= 0 {
+		return nil, fmt.Errorf("invalid number of workers: %v", config.Workers)
+	}
+
+	c := &clock{now: time.Unix(0, 0).UTC()}
+
+	prevNow, prevAfter := scheduler.TimeNow, scheduler.TimeAfter
+	scheduler.TimeNow, scheduler.TimeAfter = c.Now, c.After
+	defer func() {
+		scheduler.TimeNow, scheduler.TimeAfter = prevNow, prevAfter
+	}()
+
+	s, err := scheduler.NewScheduler(l, config.Scheduler)
+	if err != nil {
+		return nil, err
+	}
+
+	sim := &simulation{
+		l:       l,
+		config:  config,
+		clock:   c,
+		s:       s,
+		buildOf: make(map[build.ID]int),
+	}
+	defer sim.s.Stop()
+
+	for i := 0; i < config.Workers; i++ {
+		sim.workers = append(sim.workers, &workerState{
+			id:        api.WorkerID(fmt.Sprintf("worker%d", i)),
+			artifacts: make(map[build.ID]struct{}),
+		})
+	}
+
+	start := c.Now()
+	for i := range w.Builds {
+		sim.push(&event{at: start.Add(w.Builds[i].SubmitAt), kind: buildSubmitted, build: i})
+		sim.builds = append(sim.builds, newBuildState(i, &w.Builds[i]))
+		sim.buildOf[sim.builds[i].id] = i
+	}
+
+	for sim.events.Len() > 0 {
+		e := heap.Pop(&sim.events).(*event)
+		c.advance(e.at)
+
+		switch e.kind {
+		case buildSubmitted:
+			sim.submit(e.build)
+		case jobFinished:
+			sim.finish(e.worker, e.job)
+		}
+
+		sim.dispatch()
+	}
+
+	result := &Result{
+		Makespan:         c.Now().Sub(start),
+		Utilization:      make(map[api.WorkerID]float64),
+		BytesTransferred: sim.bytesTransferred,
+	}
+
+	for i, b := range sim.builds {
+		if len(b.done) != len(b.jobs) {
+			return nil, fmt.Errorf("build %d is stuck: %d of %d jobs done", i, len(b.done), len(b.jobs))
+		}
+		result.BuildLatency = append(result.BuildLatency, b.finished.Sub(b.submitted))
+	}
+
+	for _, w := range sim.workers {
+		if result.Makespan > 0 {
+			result.Utilization[w.id] = float64(w.busyTime) / float64(result.Makespan)
+		} else {
+			result.Utilization[w.id] = 0
+		}
+	}
+
+	return result, nil
+}
+
+func newBuildState(idx int, spec *Build) *buildState {
+	b := &buildState{
+		spec:       spec,
+		jobs:       make(map[build.ID]*build.Job),
+		dependents: make(map[build.ID][]build.ID),
+		done:       make(map[build.ID]bool),
+	}
+	binary.BigEndian.PutUint64(b.id[:], uint64(idx+1))
+
+	for i := range spec.Jobs {
+		job := &spec.Jobs[i]
+		b.jobs[job.ID] = job
+		for _, dep := range job.Deps {
+			b.dependents[dep] = append(b.dependents[dep], job.ID)
+		}
+	}
+	return b
+}
+
+func (sim *simulation) push(e *event) {
+	e.seq = sim.seq
+	sim.seq++
+	heap.Push(&sim.events, e)
+}
+
+func (sim *simulation) schedule(buildIdx int, job *build.Job) {
+	sim.s.ScheduleBuildJob(sim.builds[buildIdx].id, &api.JobSpec{Job: *job})
+}
+
+func (sim *simulation) submit(buildIdx int) {
+	b := sim.builds[buildIdx]
+	b.submitted = sim.clock.Now()
+	b.finished = b.submitted
+
+	jobs := build.TopSort(b.spec.Jobs)
+	sim.s.StartBuild(b.id, b.spec.User, b.spec.Priority)
+	sim.s.RegisterJobs(b.id, jobs)
+
+	for i := range jobs {
+		if b.ready(&jobs[i]) {
+			sim.schedule(buildIdx, b.jobs[jobs[i].ID])
+		}
+	}
+}
+
+// ready reports whether all dependencies of the job are done. Dependencies from outside
+// of the build graph are expected to be in cache.
+func (b *buildState) ready(job *build.Job) bool {
+	for _, dep := range job.Deps {
+		if _, inGraph := b.jobs[dep]; inGraph && !b.done[dep] {
+			return false
+		}
+	}
+	return true
+}
+
+// complete marks job as done in its build and schedules dependent jobs that became ready.
+func (sim *simulation) complete(buildIdx int, id build.ID) {
+	b := sim.builds[buildIdx]
+	b.done[id] = true
+	b.finished = sim.clock.Now()
+	if len(b.done) == len(b.jobs) {
+		sim.s.FinishBuild(b.id)
+	}
+
+	for _, dependentID := range b.dependents[id] {
+		if dependent := b.jobs[dependentID]; b.ready(dependent) {
+			sim.schedule(buildIdx, dependent)
+		}
+	}
+}
+
+func (sim *simulation) finish(workerIdx int, job *scheduler.PendingJob) {
+	w := sim.workers[workerIdx]
+	w.busy = false
+	w.artifacts[job.Job.ID] = struct{}{}
+
+	// losing speculative attempt finishes the job that is done already
+	if sim.s.OnJobComplete(w.id, job.Job.ID, &api.JobResult{ID: job.Job.ID}) {
+		sim.complete(sim.buildOf[job.BuildID], job.Job.ID)
+	}
+}
+
+// dispatch gives jobs to all idle workers.
+func (sim *simulation) dispatch() {
+	for i, w := range sim.workers {
+		for !w.busy {
+			job := sim.s.TryPickJob(w.id)
+			if job == nil {
+				break
+			}
+
+			buildIdx := sim.buildOf[job.BuildID]
+			if owner, ok := sim.s.LocateArtifact(job.Job.ID); ok {
+				// same as coordinator, job result is taken from cache
+				sim.s.OnJobComplete(owner, job.Job.ID, &api.JobResult{ID: job.Job.ID})
+				sim.complete(buildIdx, job.Job.ID)
+				continue
+			}
+
+			spec := sim.builds[buildIdx].spec
+
+			var transferred int64
+			for _, dep := range job.Job.Deps {
+				if _, ok := w.artifacts[dep]; !ok {
+					transferred += sim.artifactSize(dep)
+					w.artifacts[dep] = struct{}{}
+				}
+			}
+			sim.bytesTransferred += transferred
+
+			d := spec.Durations[job.Job.ID]
+			if sim.config.Bandwidth > 0 {
+				d += time.Duration(float64(transferred) / float64(sim.config.Bandwidth) * float64(time.Second))
+			}
+
+			w.busy = true
+			w.busyTime += d
+			sim.push(&event{at: sim.clock.Now().Add(d), kind: jobFinished, worker: i, job: job})
+		}
+	}
+}
+
+func (sim *simulation) artifactSize(id build.ID) int64 {
+	for _, b := range sim.builds {
+		if size, ok := b.spec.ArtifactSizes[id]; ok {
+			return size
+		}
+	}
+	return 0
+}
@@ -0,0 +1,151 @@
+package simulator_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler"
+	"gitlab.com/slon/shad-go/distbuild/pkg/scheduler/simulator"
+)
+
+// chainWorkload has four independent jobs followed by a chain of three jobs; every job takes 10s.
+func chainWorkload() *simulator.Workload {
+	b := simulator.Build{
+		Durations:     map[build.ID]time.Duration{},
+		ArtifactSizes: map[build.ID]int64{},
+	}
+
+	for i := 0; i < 4; i++ {
+		b.Jobs = append(b.Jobs, build.Job{ID: build.ID{'b', byte(i)}})
+	}
+	b.Jobs = append(b.Jobs,
+		build.Job{ID: build.ID{'c', 0}},
+		build.Job{ID: build.ID{'c', 1}, Deps: []build.ID{{'c', 0}}},
+		build.Job{ID: build.ID{'c', 2}, Deps: []build.ID{{'c', 1}}},
+	)
+
+	for _, j := range b.Jobs {
+		b.Durations[j.ID] = 10 * time.Second
+		b.ArtifactSizes[j.ID] = 100
+	}
+
+	return &simulator.Workload{Builds: []simulator.Build{b}}
+}
+
+func TestCompare(t *testing.T) {
+	l := zaptest.NewLogger(t)
+
+	fifo, err := simulator.Run(l, chainWorkload(), simulator.Config{
+		Workers:   2,
+		Scheduler: scheduler.Config{Policy: scheduler.PolicyFIFO},
+	})
+	require.NoError(t, err)
+
+	criticalPath, err := simulator.Run(l, chainWorkload(), simulator.Config{
+		Workers:   2,
+		Scheduler: scheduler.Config{Policy: scheduler.PolicyCriticalPath},
+	})
+	require.NoError(t, err)
+
+	require.Equal(t, 50*time.Second, fifo.Makespan)
+	require.Equal(t, 40*time.Second, criticalPath.Makespan)
+	require.Equal(t, []time.Duration{40 * time.Second}, criticalPath.BuildLatency)
+	// 70s of work on two workers during 40s
+	require.InDelta(t, 1.75, criticalPath.Utilization["worker0"]+criticalPath.Utilization["worker1"], 1e-9)
+}
+
+func TestTransfer(t *testing.T) {
+	w := chainWorkload()
+	w.Builds = append(w.Builds, simulator.Build{
+		SubmitAt: time.Hour,
+		Jobs: []build.Job{
+			{ID: build.ID{'d'}, Deps: []build.ID{{'b', 0}, {'b', 1}, {'b', 2}, {'b', 3}}},
+		},
+		Durations: map[build.ID]time.Duration{{'d'}: time.Second},
+	})
+
+	result, err := simulator.Run(zaptest.NewLogger(t), w, simulator.Config{Workers: 1, Bandwidth: 100})
+	require.NoError(t, err)
+
+	require.Zero(t, result.BytesTransferred)
+	require.Equal(t, []time.Duration{70 * time.Second, time.Second}, result.BuildLatency)
+	require.Equal(t, time.Hour+time.Second, result.Makespan)
+
+	result, err = simulator.Run(zaptest.NewLogger(t), w, simulator.Config{Workers: 4, Bandwidth: 100})
+	require.NoError(t, err)
+
+	require.Equal(t, int64(300), result.BytesTransferred)
+	require.Equal(t, 4*time.Second, result.BuildLatency[1])
+}
+
+func TestReadWorkload(t *testing.T) {
+	w, err := simulator.ReadWorkload(strings.NewReader(`{
+		"Builds": [{
+			"Jobs": [{"ID": "6100000000000000000000000000000000000000"}],
+			"Durations": {"6100000000000000000000000000000000000000": 1000000000}
+		}]
+	}`))
+	require.NoError(t, err)
+
+	result, err := simulator.Run(zaptest.NewLogger(t), w, simulator.Config{Workers: 1})
+	require.NoError(t, err)
+	require.Equal(t, time.Second, result.Makespan)
+}
+
+func TestInteractiveLatency(t *testing.T) {
+	batch := simulator.Build{User: "release", Durations: map[build.ID]time.Duration{}}
+	for i := 0; i < 100; i++ {
+		id := build.ID{'b', byte(i)}
+		batch.Jobs = append(batch.Jobs, build.Job{ID: id})
+		batch.Durations[id] = time.Second
+	}
+
+	interactive := simulator.Build{
+		SubmitAt: 10 * time.Second,
+		User:     "alice",
+		Jobs:     []build.Job{{ID: build.ID{'i', 0}}, {ID: build.ID{'i', 1}}},
+		Durations: map[build.ID]time.Duration{
+			{'i', 0}: time.Second,
+			{'i', 1}: time.Second,
+		},
+	}
+
+	w := &simulator.Workload{Builds: []simulator.Build{batch, interactive}}
+	result, err := simulator.Run(zaptest.NewLogger(t), w, simulator.Config{Workers: 2})
+	require.NoError(t, err)
+
+	// interactive build gets one of two workers right away instead of waiting for 90 batch jobs
+	require.Equal(t, []time.Duration{51 * time.Second, 2 * time.Second}, result.BuildLatency)
+}
+
+func TestSpeculation(t *testing.T) {
+	b := simulator.Build{
+		Jobs: []build.Job{
+			{ID: build.ID{'f'}, Name: "compile"},
+			{ID: build.ID{'s'}, Name: "compile"},
+			{ID: build.ID{'g'}, Name: "link", Deps: []build.ID{{'f'}}},
+			{ID: build.ID{'d'}, Name: "link", Deps: []build.ID{{'s'}}},
+		},
+		Durations: map[build.ID]time.Duration{
+			{'f'}: time.Second,
+			{'s'}: 100 * time.Second,
+			{'g'}: 5 * time.Second,
+			{'d'}: time.Second,
+		},
+	}
+
+	result, err := simulator.Run(zaptest.NewLogger(t), &simulator.Workload{Builds: []simulator.Build{b}}, simulator.Config{
+		Workers:   2,
+		Scheduler: scheduler.Config{SpeculationFactor: 2},
+	})
+	require.NoError(t, err)
+
+	// s is duplicated after g is done, the duplicate loses and doesn't finish the build again
+	require.Equal(t, []time.Duration{101 * time.Second}, result.BuildLatency)
+	require.Equal(t, 106*time.Second, result.Makespan)
+}
@@ -2,12 +2,26 @@ package tarstream
 
 import (
 	"archive/tar"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 )
 
+// fileMode нормализует права файла, чтобы поток не зависел от umask: исполняемые файлы
+// получают 0755, остальные 0644.
+func fileMode(mode os.FileMode) int64 {
+	if mode&0o111 != 0 {
+		return 0o755
+	}
+	return 0o644
+}
+
 // Send рекурсивно обходит директорию и сериализует её содержимое в поток w.
+//
+// Поток детерминирован: файлы обходятся в лексикографическом порядке, права нормализуются,
+// а время модификации и владелец не записываются. Поэтому одинаковые директории дают
+// побайтово одинаковые потоки.
 func Send(dir string, w io.Writer) error {
 	tw := tar.NewWriter(w)
 
@@ -37,7 +51,7 @@ func Send(dir string, w io.Writer) error {
 				Typeflag: tar.TypeReg,
 				Name:     rel,
 				Size:     info.Size(),
-				Mode:     int64(info.Mode()),
+				Mode:     fileMode(info.Mode()),
 			}
 
 			if err := tw.WriteHeader(h); err != nil {
@@ -63,6 +77,9 @@ func Send(dir string, w io.Writer) error {
 }
 
 // Receive читает поток r и материализует содержимое потока внутри dir.
+//
+// Поток может прийти по сети, поэтому записи с путями вне dir и записи, которые не являются
+// файлами или директориями (например, символические ссылки), отклоняются до записи на диск.
 func Receive(dir string, r io.Reader) error {
 	tr := tar.NewReader(r)
 
@@ -74,6 +91,13 @@ func Receive(dir string, r io.Reader) error {
 			return err
 		}
 
+		if !filepath.IsLocal(h.Name) {
+			return fmt.Errorf("tarstream: entry %q is outside of the directory", h.Name)
+		}
+		if h.Typeflag != tar.TypeDir && h.Typeflag != tar.TypeReg {
+			return fmt.Errorf("tarstream: entry %q has unsupported type %q", h.Name, h.Typeflag)
+		}
+
 		absPath := filepath.Join(dir, h.Name)
 
 		if h.Typeflag == tar.TypeDir {
@@ -1,6 +1,7 @@
 package tarstream_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"io/ioutil"
 	"os"
@@ -62,6 +63,51 @@ func TestTarStream(t *testing.T) {
 	checkFile(filepath.Join(to, "b", "c", "y.txt"), []byte("yyy"), 0644)
 }
 
+func TestTarStreamDeterministic(t *testing.T) {
+	send := func(dirMode, fileMode, binMode os.FileMode) []byte {
+		dir := t.TempDir()
+		require.NoError(t, os.Mkdir(filepath.Join(dir, "a"), dirMode))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "a", "x.txt"), []byte("xxx"), fileMode))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "y.bin"), []byte("yyy"), binMode))
+		require.NoError(t, os.Chmod(filepath.Join(dir, "a", "x.txt"), fileMode))
+		require.NoError(t, os.Chmod(filepath.Join(dir, "y.bin"), binMode))
+
+		var buf bytes.Buffer
+		require.NoError(t, tarstream.Send(dir, &buf))
+		return buf.Bytes()
+	}
+
+	require.Equal(t, send(0o755, 0o644, 0o755), send(0o700, 0o600, 0o700))
+}
+
+func TestTarStreamRejectsUnsafeEntries(t *testing.T) {
+	for _, h := range []*tar.Header{
+		{Name: "../x", Typeflag: tar.TypeReg},
+		{Name: "/tmp/x", Typeflag: tar.TypeReg},
+		{Name: "a/../../x", Typeflag: tar.TypeDir},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+		{Name: "hardlink", Typeflag: tar.TypeLink, Linkname: "../x"},
+	} {
+		t.Run(h.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			require.NoError(t, tw.WriteHeader(h))
+			require.NoError(t, tw.Close())
+
+			dir := filepath.Join(t.TempDir(), "dir")
+			require.NoError(t, os.Mkdir(dir, 0777))
+			require.Error(t, tarstream.Receive(dir, &buf))
+
+			entries, err := os.ReadDir(filepath.Dir(dir))
+			require.NoError(t, err)
+			require.Len(t, entries, 1, "nothing is written")
+			entries, err = os.ReadDir(dir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+}
+
 func init() {
 	unix.Umask(0022)
 }
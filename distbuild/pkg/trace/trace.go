@@ -0,0 +1,207 @@
+//go:build !solution
+
+// Package trace converts timings of build jobs to Chrome trace event format,
+// which is loaded by chrome://tracing and Perfetto.
+package trace
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+)
+
+// Span is an attempt to run the job on the worker.
+type Span struct {
+	Job    *build.Job
+	Worker api.WorkerID
+	Result *api.JobResult
+}
+
+// Event is a trace event, see https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU.
+type Event struct {
+	Name     string         `json:"name"`
+	Category string         `json:"cat,omitempty"`
+	Phase    string         `json:"ph"`
+	Time     int64          `json:"ts"`
+	Duration int64          `json:"dur,omitempty"`
+	Pid      int            `json:"pid"`
+	Tid      int            `json:"tid"`
+	ID       int            `json:"id,omitempty"`
+	Binding  string         `json:"bp,omitempty"`
+	Args     map[string]any `json:"args,omitempty"`
+}
+
+type Trace struct {
+	Events []Event `json:"traceEvents"`
+}
+
+// slot is a row of the worker, jobs executed concurrently by the worker are placed to different slots.
+type slot struct {
+	pid, tid int
+	free     time.Time
+}
+
+type placed struct {
+	*Span
+	slot *slot
+}
+
+// New builds trace with a process per worker and a thread per worker slot. Every job is shown
+// with its phases: download of dependencies and source files, commands and artifact commit.
+// Flow arrows connect jobs with their dependencies. Spans of cached jobs are skipped.
+//
+// Spans are placed by Started and Finished measured by workers, while the queued time in args is measured
+// by the coordinator. All of them are assumed to share one clock, e.g. synchronized with NTP. With clock skew
+// between workers, jobs of different workers are shifted relative to each other and flow arrows may point backwards.
+func New(spans []Span) *Trace {
+	spans = slices.DeleteFunc(slices.Clone(spans), func(s Span) bool { return s.Result.Cached || s.Result.Timings.Started.IsZero() })
+	slices.SortStableFunc(spans, func(a, b Span) int {
+		return a.Result.Timings.Started.Compare(b.Result.Timings.Started)
+	})
+
+	t := &Trace{Events: []Event{}}
+	if len(spans) == 0 {
+		return t
+	}
+
+	start := spans[0].Result.Timings.Started
+	ts := func(at time.Time) int64 {
+		return at.Sub(start).Microseconds()
+	}
+
+	// metadata events are appended to t.Events directly, so they go before other events
+	var events []Event
+	pids := make(map[api.WorkerID]int)
+	slots := make(map[api.WorkerID][]*slot)
+	lastSpan := make(map[build.ID]placed)
+	var all []placed
+
+	for i := range spans {
+		span := &spans[i]
+		timings := &span.Result.Timings
+
+		pid, ok := pids[span.Worker]
+		if !ok {
+			pid = len(pids) + 1
+			pids[span.Worker] = pid
+			t.Events = append(t.Events, Event{
+				Name:  "process_name",
+				Phase: "M",
+				Pid:   pid,
+				Args:  map[string]any{"name": span.Worker.String()},
+			})
+		}
+
+		// the first slot that is free when the job starts
+		var s *slot
+		for _, candidate := range slots[span.Worker] {
+			if !candidate.free.After(timings.Started) {
+				s = candidate
+				break
+			}
+		}
+		if s == nil {
+			s = &slot{pid: pid, tid: len(slots[span.Worker])}
+			slots[span.Worker] = append(slots[span.Worker], s)
+			t.Events = append(t.Events, Event{
+				Name:  "thread_name",
+				Phase: "M",
+				Pid:   pid,
+				Tid:   s.tid,
+				Args:  map[string]any{"name": fmt.Sprintf("slot %d", s.tid)},
+			})
+		}
+		s.free = timings.Finished
+
+		p := placed{span, s}
+		all = append(all, p)
+		lastSpan[span.Job.ID] = p
+
+		events = append(events, p.events(ts)...)
+	}
+
+	flow := 0
+	for _, p := range all {
+		for _, dep := range p.Job.Deps {
+			from, ok := lastSpan[dep]
+			if !ok {
+				continue
+			}
+
+			flow++
+			// flow starts inside the dependency span to be bound to it
+			end := max(ts(from.Result.Timings.Finished)-1, ts(from.Result.Timings.Started))
+			events = append(events,
+				Event{Name: "dep", Category: "deps", Phase: "s", ID: flow, Time: end, Pid: from.slot.pid, Tid: from.slot.tid},
+				Event{Name: "dep", Category: "deps", Phase: "f", Binding: "e", ID: flow, Time: ts(p.Result.Timings.Started), Pid: p.slot.pid, Tid: p.slot.tid},
+			)
+		}
+	}
+
+	t.Events = append(t.Events, events...)
+	return t
+}
+
+// events returns complete events of the job and its phases. Worker reports only durations of the phases,
+// downloads are placed at the job start and commands with commit at its end.
+func (p *placed) events(ts func(time.Time) int64) []Event {
+	timings := &p.Result.Timings
+	complete := func(name, category string, from, to time.Time, args map[string]any) Event {
+		return Event{
+			Name:     name,
+			Category: category,
+			Phase:    "X",
+			Time:     ts(from),
+			Duration: to.Sub(from).Microseconds(),
+			Pid:      p.slot.pid,
+			Tid:      p.slot.tid,
+			Args:     args,
+		}
+	}
+
+	args := map[string]any{
+		"id":      p.Job.ID.String(),
+		"attempt": p.Result.Attempt,
+	}
+	if !timings.Queued.IsZero() && !timings.Assigned.IsZero() {
+		args["queued"] = timings.Assigned.Sub(timings.Queued).String()
+	}
+	if p.Result.Error != nil {
+		args["error"] = *p.Result.Error
+	}
+	events := []Event{complete(p.Job.Name, "job", timings.Started, timings.Finished, args)}
+
+	at := timings.Started
+	for _, download := range []struct {
+		name     string
+		transfer api.Transfer
+	}{
+		{"download artifacts", timings.Artifacts},
+		{"download source files", timings.SourceFiles},
+	} {
+		if download.transfer.Count == 0 {
+			continue
+		}
+		end := at.Add(download.transfer.Duration)
+		events = append(events, complete(download.name, "download", at, end, map[string]any{
+			"count": download.transfer.Count,
+			"bytes": download.transfer.Bytes,
+		}))
+		at = end
+	}
+
+	at = timings.Finished.Add(-timings.Commit)
+	if timings.Commit > 0 {
+		events = append(events, complete("commit", "upload", at, timings.Finished, nil))
+	}
+	for i := len(timings.Cmds) - 1; i >= 0; i-- {
+		cmd := timings.Cmds[i]
+		begin := at.Add(-cmd.Wall)
+		events = append(events, complete(fmt.Sprintf("cmd %d", i), "exec", begin, at, map[string]any{"cpu": cmd.CPU.String()}))
+		at = begin
+	}
+	return events
+}
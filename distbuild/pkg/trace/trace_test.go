@@ -0,0 +1,82 @@
+package trace_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/trace"
+)
+
+func TestTrace(t *testing.T) {
+	start := time.Now()
+	at := func(ms int) time.Time {
+		return start.Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	a := &build.Job{ID: build.ID{'a'}, Name: "a"}
+	b := &build.Job{ID: build.ID{'b'}, Name: "b"}
+	c := &build.Job{ID: build.ID{'c'}, Name: "c", Deps: []build.ID{a.ID, b.ID}}
+	cached := &build.Job{ID: build.ID{'d'}, Name: "cached"}
+
+	spans := []trace.Span{
+		{Job: c, Worker: "w1", Result: &api.JobResult{ID: c.ID, Timings: api.JobTimings{
+			Started:   at(20),
+			Finished:  at(30),
+			Artifacts: api.Transfer{Count: 1, Bytes: 100, Duration: 2 * time.Millisecond},
+			Cmds:      []api.CmdTiming{{Wall: 3 * time.Millisecond}, {Wall: 4 * time.Millisecond}},
+			Commit:    time.Millisecond,
+		}}},
+		{Job: a, Worker: "w0", Result: &api.JobResult{ID: a.ID, Timings: api.JobTimings{Started: at(0), Finished: at(10)}}},
+		{Job: b, Worker: "w0", Result: &api.JobResult{ID: b.ID, Timings: api.JobTimings{Started: at(5), Finished: at(15)}}},
+		{Job: cached, Worker: "w0", Result: &api.JobResult{ID: cached.ID, Cached: true, Timings: api.JobTimings{Started: at(0), Finished: at(1)}}},
+	}
+
+	tr := trace.New(spans)
+
+	type key struct {
+		name, phase string
+		pid, tid    int
+	}
+	events := make(map[key]trace.Event)
+	for _, e := range tr.Events {
+		events[key{e.Name, e.Phase, e.Pid, e.Tid}] = e
+	}
+
+	require.Equal(t, "w0", events[key{"process_name", "M", 1, 0}].Args["name"])
+	require.Equal(t, "w1", events[key{"process_name", "M", 2, 0}].Args["name"])
+	require.Equal(t, "slot 1", events[key{"thread_name", "M", 1, 1}].Args["name"], "overlapping jobs use different slots")
+
+	require.Equal(t, int64(0), events[key{"a", "X", 1, 0}].Time)
+	require.Equal(t, int64(5000), events[key{"b", "X", 1, 1}].Time)
+	require.Equal(t, int64(10000), events[key{"c", "X", 2, 0}].Duration)
+
+	require.Equal(t, int64(20000), events[key{"download artifacts", "X", 2, 0}].Time)
+	require.Equal(t, int64(2000), events[key{"download artifacts", "X", 2, 0}].Duration)
+	require.Equal(t, int64(22000), events[key{"cmd 0", "X", 2, 0}].Time)
+	require.Equal(t, int64(25000), events[key{"cmd 1", "X", 2, 0}].Time)
+	require.Equal(t, int64(29000), events[key{"commit", "X", 2, 0}].Time)
+
+	var flows []trace.Event
+	for _, e := range tr.Events {
+		require.NotEqual(t, "cached", e.Name)
+		if e.Phase == "s" || e.Phase == "f" {
+			flows = append(flows, e)
+		}
+	}
+	require.Len(t, flows, 4)
+	require.Equal(t, int64(20000), events[key{"dep", "f", 2, 0}].Time)
+
+	_, err := json.Marshal(tr)
+	require.NoError(t, err)
+}
+
+func TestTraceEmpty(t *testing.T) {
+	body, err := json.Marshal(trace.New(nil))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"traceEvents": []}`, string(body))
+}
@@ -0,0 +1,30 @@
+//go:build !solution && linux
+
+package worker
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile shares extents of src with dst if the file system supports reflinks.
+func cloneFile(dst, src *os.File) bool {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())) == nil
+}
+
+// canLink reports whether jobs running as the worker user can't modify src through a hard link:
+// src lives on a read-only file system, or it is owned by another user and is not writable by others.
+func canLink(src string) bool {
+	var fs unix.Statfs_t
+	if err := unix.Statfs(src, &fs); err == nil && fs.Flags&unix.ST_RDONLY != 0 {
+		return true
+	}
+
+	var st unix.Stat_t
+	if err := unix.Stat(src, &st); err != nil {
+		return false
+	}
+	euid := os.Geteuid()
+	return euid != 0 && int(st.Uid) != euid && st.Mode&0o022 == 0
+}
@@ -0,0 +1,13 @@
+//go:build !solution && !linux
+
+package worker
+
+import "os"
+
+func cloneFile(dst, src *os.File) bool {
+	return false
+}
+
+func canLink(src string) bool {
+	return false
+}
@@ -0,0 +1,309 @@
+//go:build !solution
+
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"go.uber.org/zap"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/persistent"
+	"gitlab.com/slon/shad-go/distbuild/pkg/resources"
+	"gitlab.com/slon/shad-go/distbuild/pkg/sandbox"
+)
+
+// Execution is a job ready to be executed: its source files and dependencies are in the local caches.
+type Execution struct {
+	ID   build.ID
+	Cmds []build.Cmd
+
+	// SourceFiles maps paths of the source files relative to the source dir to their paths in the file cache.
+	SourceFiles map[string]string
+	// Deps maps dependencies of the job to their artifact directories.
+	Deps map[build.ID]string
+	// OutputDir is the directory of the artifact being created.
+	OutputDir string
+
+	Stdout, Stderr io.Writer
+}
+
+// Report describes resources consumed by the job.
+type Report struct {
+	resources.Usage
+
+	// Cmds lists timings of the commands which were run, including the failed one.
+	Cmds []api.CmdTiming
+}
+
+// Executor runs commands of jobs.
+type Executor interface {
+	// Execute runs commands of the job one by one until the first failure. Error having ExitCode() int method
+	// means that the command failed, SetupError means that the job environment couldn't be prepared.
+	// Report is returned even if the job failed.
+	Execute(ctx context.Context, e *Execution) (Report, error)
+}
+
+// SetupError is returned by executors when the job failed before its commands were run, it may succeed if retried.
+type SetupError struct {
+	Err error
+}
+
+func (e *SetupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.Err
+}
+
+type processExecutor struct {
+	log             *zap.SugaredLogger
+	resources       *resources.Manager
+	materialization Materialization
+	sandbox         bool
+	pool            *persistent.Pool
+}
+
+// NewLocalExecutor returns executor running commands as processes of the worker user.
+// Inputs are copied if materialization is empty or not supported.
+// Commands marked as persistent are sent to processes of the pool unless it is nil.
+func NewLocalExecutor(log *zap.Logger, resources *resources.Manager, materialization Materialization, pool *persistent.Pool) Executor {
+	if materialization == "" {
+		materialization = MaterializeCopy
+	} else if materialization == MaterializeBind {
+		log.Warn("bind materialization requires sandbox, inputs are copied")
+		materialization = MaterializeCopy
+	}
+	return &processExecutor{log: log.Sugar(), resources: resources, materialization: materialization, pool: pool}
+}
+
+// NewSandboxExecutor returns executor running commands in the sandbox, where only declared inputs,
+// dependencies and output directory of the job are visible and network is not available.
+// Inputs are copied if materialization is empty. Persistent processes are not used, since
+// they would outlive the sandbox of the job.
+func NewSandboxExecutor(log *zap.Logger, resources *resources.Manager, materialization Materialization) Executor {
+	if materialization == "" {
+		materialization = MaterializeCopy
+	}
+	return &processExecutor{log: log.Sugar(), resources: resources, materialization: materialization, sandbox: true}
+}
+
+func (p *processExecutor) Execute(ctx context.Context, e *Execution) (Report, error) {
+	group, err := p.resources.NewGroup()
+	if err != nil {
+		return Report{}, &SetupError{err}
+	}
+	defer func() {
+		if err := group.Close(); err != nil {
+			p.log.Error("couldn't remove job cgroup", zap.Error(err))
+		}
+	}()
+
+	root, err := os.MkdirTemp("", "job")
+	if err != nil {
+		return Report{}, &SetupError{fmt.Errorf("couldn't create execution root: %w", err)}
+	}
+	defer func() {
+		if err := removeAll(root); err != nil {
+			p.log.Error("couldn't remove execution root", zap.Error(err))
+		}
+	}()
+
+	sourceDir := filepath.Join(root, "src")
+	deps, box, err := p.materialize(root, sourceDir, e)
+	if err != nil {
+		return Report{}, &SetupError{err}
+	}
+
+	var cmds []api.CmdTiming
+	report := func() Report {
+		return Report{Usage: group.Usage(), Cmds: cmds}
+	}
+
+	for _, tmpl := range e.Cmds {
+		rendered, err := tmpl.Render(build.JobContext{
+			SourceDir: sourceDir,
+			OutputDir: e.OutputDir,
+			Deps:      deps,
+		})
+		if err != nil {
+			return report(), fmt.Errorf("error during rendering cmd: %w", err)
+		}
+
+		start := time.Now()
+		cpu := group.Usage().CPUTime
+		if rendered.Persistent && p.pool != nil && rendered.Exec != nil {
+			err = p.runPersistent(ctx, sourceDir, e, rendered)
+		} else {
+			err = p.runCmd(ctx, box, group, rendered, e.Stdout, e.Stderr)
+		}
+		cmds = append(cmds, api.CmdTiming{Wall: time.Since(start), CPU: group.Usage().CPUTime - cpu})
+
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				if usage := group.Usage(); usage.MemoryLimitExceeded {
+					err = fmt.Errorf("job exceeded memory limit of %d bytes: %w", p.resources.Limits().Memory, err)
+				} else if usage.OOMKilled {
+					err = fmt.Errorf("job was killed by OOM killer: %w", err)
+				}
+			}
+			return report(), err
+		}
+	}
+	return report(), nil
+}
+
+// materialize lays out inputs of the job read-only in its execution root. It returns directories of the dependencies
+// to be used by commands and the sandbox config if the job is sandboxed.
+func (p *processExecutor) materialize(root, sourceDir string, e *Execution) (map[build.ID]string, *sandbox.Config, error) {
+	if err := os.Mkdir(sourceDir, 0o755); err != nil {
+		return nil, nil, fmt.Errorf("couldn't create source dir: %w", err)
+	}
+
+	var box *sandbox.Config
+	if p.sandbox {
+		box = &sandbox.Config{ReadOnly: []string{root}, Writable: []string{e.OutputDir}}
+	}
+
+	if p.materialization == MaterializeBind {
+		box.Binds = make(map[string]string)
+		for name, path := range e.SourceFiles {
+			// mount point can't be created inside read-only source dir
+			target := filepath.Join(sourceDir, name)
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return nil, nil, err
+			}
+			if err := os.WriteFile(target, nil, 0o444); err != nil {
+				return nil, nil, err
+			}
+			box.Binds[target] = path
+		}
+		box.ReadOnly = append(box.ReadOnly, slices.Collect(maps.Values(e.Deps))...)
+		return e.Deps, box, makeReadOnly(root)
+	}
+
+	for name, path := range e.SourceFiles {
+		if err := materializeFile(p.materialization, path, filepath.Join(sourceDir, name)); err != nil {
+			return nil, nil, fmt.Errorf("error during materializing source file %v: %w", name, err)
+		}
+	}
+
+	deps := make(map[build.ID]string, len(e.Deps))
+	for id, path := range e.Deps {
+		deps[id] = filepath.Join(root, "deps", id.String())
+		if err := materializeTree(p.materialization, path, deps[id]); err != nil {
+			return nil, nil, fmt.Errorf("error during materializing artifact %v: %w", id, err)
+		}
+	}
+	return deps, box, makeReadOnly(root)
+}
+
+// runCmd runs rendered command in its own process group until it exits or ctx is done.
+// Command is executed inside the sandbox unless box is nil, its resources are accounted in group.
+func (p *processExecutor) runCmd(ctx context.Context, box *sandbox.Config, group *resources.Group, rendered *build.Cmd, stdout, stderr io.Writer) error {
+	if rendered.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, rendered.Timeout, &timeoutError{"command", rendered.Timeout})
+		defer cancel()
+	}
+
+	var args []string
+	var env []string
+	var dir string
+	if rendered.Exec != nil {
+		args = rendered.Exec
+		env = rendered.Environ
+		dir = rendered.WorkingDirectory
+	}
+
+	if rendered.CatTemplate != "" {
+		args = []string{"sh", "-c", fmt.Sprintf("printf %q > %q", rendered.CatTemplate, rendered.CatOutput)}
+	}
+
+	args = group.Wrap(args)
+
+	var cmd *exec.Cmd
+	if box != nil {
+		cmdBox := *box
+		cmdBox.Dir = dir
+
+		var cleanup func()
+		var err error
+		cmd, cleanup, err = sandbox.Command(ctx, &cmdBox, args[0], args[1:]...)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+	} else {
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Dir = dir
+	}
+	cmd.Env = env
+
+	group.Configure(cmd)
+	killGroup := configureProcessGroup(cmd)
+	defer killGroup()
+
+	p.log.Debugf("cmd: %v", cmd.String())
+
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+
+	err := cmd.Run()
+	group.Exited(cmd)
+	if err != nil {
+		if cause := context.Cause(ctx); cause != nil {
+			return fmt.Errorf("error during cmd %q running: %w: %w", cmd.String(), cause, err)
+		}
+		return fmt.Errorf("error during cmd %q running: %w", cmd.String(), err)
+	}
+	return nil
+}
+
+// runPersistent sends rendered command as a request to a persistent process of its tool.
+// Such processes are shared between jobs, so their resources are not accounted.
+func (p *processExecutor) runPersistent(ctx context.Context, sourceDir string, e *Execution, rendered *build.Cmd) error {
+	if rendered.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, rendered.Timeout, &timeoutError{"command", rendered.Timeout})
+		defer cancel()
+	}
+
+	path, err := exec.LookPath(rendered.Exec[0])
+	if err != nil {
+		return fmt.Errorf("error during cmd %q running: %w", rendered.Exec[0], err)
+	}
+
+	req := &persistent.WorkRequest{
+		Arguments:        rendered.Exec[1:],
+		WorkingDirectory: rendered.WorkingDirectory,
+	}
+	for _, name := range slices.Sorted(maps.Keys(e.SourceFiles)) {
+		req.Inputs = append(req.Inputs, persistent.Input{Path: filepath.Join(sourceDir, name)})
+	}
+
+	p.log.Debugf("persistent cmd: %v %v", path, req.Arguments)
+
+	rsp, err := p.pool.Do(ctx, &persistent.Tool{Path: path, Env: rendered.Environ}, req)
+	if rsp != nil {
+		_, _ = io.WriteString(e.Stdout, rsp.Output)
+	}
+	if errors.Is(err, persistent.ErrCrashed) {
+		return &SetupError{err}
+	} else if err != nil {
+		return fmt.Errorf("error during cmd %q running: %w", rendered.Exec, err)
+	}
+	return nil
+}
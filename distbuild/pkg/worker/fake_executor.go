@@ -0,0 +1,99 @@
+//go:build !solution
+
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/resources"
+)
+
+// FakeJob is the script of a job executed by FakeExecutor.
+type FakeJob struct {
+	Stdout, Stderr string
+	// Outputs maps paths relative to the output directory to contents of files written there.
+	Outputs map[string]string
+	// ExitCode is returned as exit code of the last command.
+	ExitCode int
+	// Duration is the time the job runs, it is interrupted when ctx is done.
+	Duration time.Duration
+	Usage    resources.Usage
+}
+
+// FakeExitError is returned by FakeExecutor when the job script has non-zero exit code.
+type FakeExitError struct {
+	Code int
+}
+
+func (e *FakeExitError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (e *FakeExitError) ExitCode() int {
+	return e.Code
+}
+
+// FakeExecutor runs jobs from scripts without spawning processes. Jobs without script succeed without output.
+type FakeExecutor struct {
+	mu         sync.Mutex
+	jobs       map[build.ID]FakeJob
+	executions []*Execution
+}
+
+func NewFakeExecutor(jobs map[build.ID]FakeJob) *FakeExecutor {
+	return &FakeExecutor{jobs: jobs}
+}
+
+// Executions returns executed jobs in the order they were started.
+func (f *FakeExecutor) Executions() []*Execution {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*Execution(nil), f.executions...)
+}
+
+// Execute runs the job script, which is reported as a single command.
+func (f *FakeExecutor) Execute(ctx context.Context, e *Execution) (Report, error) {
+	f.mu.Lock()
+	f.executions = append(f.executions, e)
+	job := f.jobs[e.ID]
+	f.mu.Unlock()
+
+	start := time.Now()
+	report := func() Report {
+		return Report{Usage: job.Usage, Cmds: []api.CmdTiming{{Wall: time.Since(start), CPU: job.Usage.CPUTime}}}
+	}
+
+	if job.Duration > 0 {
+		select {
+		case <-time.After(job.Duration):
+		case <-ctx.Done():
+			return report(), fmt.Errorf("job interrupted: %w", context.Cause(ctx))
+		}
+	}
+
+	_, _ = io.WriteString(e.Stdout, job.Stdout)
+	_, _ = io.WriteString(e.Stderr, job.Stderr)
+
+	for name, content := range job.Outputs {
+		path := filepath.Join(e.OutputDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return report(), err
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return report(), err
+		}
+	}
+
+	if job.ExitCode != 0 {
+		return report(), &FakeExitError{job.ExitCode}
+	}
+	return report(), nil
+}
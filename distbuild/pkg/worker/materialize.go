@@ -0,0 +1,134 @@
+//go:build !solution
+
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Materialization is the way inputs of the job are presented in its execution root.
+type Materialization string
+
+const (
+	// MaterializeHardlink links inputs from the caches if jobs can't modify them: the caches are owned by
+	// another user or mounted read-only. Inputs are copied otherwise and across file systems.
+	MaterializeHardlink Materialization = "hardlink"
+	// MaterializeCopy clones inputs with reflink if the file system supports it and copies them otherwise.
+	// It is the default.
+	MaterializeCopy Materialization = "copy"
+	// MaterializeBind bind mounts inputs read-only, it is supported only by the sandbox executor.
+	MaterializeBind Materialization = "bind"
+)
+
+// materializeFile makes src available at dst. Hardlink falls back to copy, copy tries reflink first.
+// Copies are created read-only, while links keep the mode of the cache file, which is never changed.
+func materializeFile(strategy Materialization, src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+
+	if strategy == MaterializeHardlink && canLink(src) {
+		err := os.Link(src, dst)
+		var linkErr *os.LinkError
+		if err == nil || !errors.As(err, &linkErr) || !errors.Is(linkErr.Err, syscall.EXDEV) && !errors.Is(linkErr.Err, syscall.EPERM) {
+			return err
+		}
+	}
+	return copyFile(src, dst)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm()&^0o222)
+	if err != nil {
+		return err
+	}
+
+	if !cloneFile(out, in) {
+		if _, err := io.Copy(out, in); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// materializeTree makes directory src with its content available at dst.
+func materializeTree(strategy Materialization, src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, 0o755)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		default:
+			return materializeFile(strategy, path, target)
+		}
+	})
+}
+
+// makeReadOnly removes write permissions from the directories of root, so files can't be added or replaced.
+// Files are not touched: copies are already read-only and hardlinks share their inode with the caches.
+func makeReadOnly(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return os.Chmod(path, info.Mode().Perm()&^0o222)
+	})
+}
+
+// removeAll removes root made read-only by makeReadOnly.
+func removeAll(root string) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.Chmod(path, 0o755)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error during removing %v: %w", root, err)
+	}
+	return os.RemoveAll(root)
+}
@@ -0,0 +1,14 @@
+//go:build !solution && !unix
+
+package worker
+
+import (
+	"os/exec"
+	"time"
+)
+
+// configureProcessGroup only limits waiting for output of the killed command, process groups are not supported.
+func configureProcessGroup(cmd *exec.Cmd) (kill func()) {
+	cmd.WaitDelay = time.Second
+	return func() {}
+}
@@ -0,0 +1,58 @@
+//go:build !solution && unix
+
+package worker
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// terminateGracePeriod is the time between SIGTERM and SIGKILL sent to the process group of the command.
+const terminateGracePeriod = 2 * time.Second
+
+// configureProcessGroup makes the command leader of a new process group. When the command context is done,
+// SIGTERM is sent to the whole group and SIGKILL follows after terminateGracePeriod.
+//
+// Returned kill must be called once Wait of the command returned. It kills processes left by the command
+// and cancels the delayed SIGKILL, which could hit an unrelated group reusing the id later.
+func configureProcessGroup(cmd *exec.Cmd) (kill func()) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	var mu sync.Mutex
+	var delayedKill *time.Timer
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		mu.Lock()
+		delayedKill = time.AfterFunc(terminateGracePeriod, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		mu.Unlock()
+
+		err := syscall.Kill(-pgid, syscall.SIGTERM)
+		if errors.Is(err, syscall.ESRCH) {
+			return os.ErrProcessDone
+		}
+		return err
+	}
+	// children may keep output pipes open after the group leader exited
+	cmd.WaitDelay = terminateGracePeriod + time.Second
+
+	return func() {
+		mu.Lock()
+		if delayedKill != nil {
+			delayedKill.Stop()
+		}
+		mu.Unlock()
+
+		if cmd.Process != nil {
+			_ = syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
+}
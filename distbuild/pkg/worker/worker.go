@@ -4,12 +4,18 @@ package worker
 
 import (
 	"bytes"
+	"cmp"
 	"context"
+	"errors"
 	"fmt"
+	"io/fs"
+	"maps"
 	"net/http"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
@@ -17,8 +23,55 @@ import (
 	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
 	"gitlab.com/slon/shad-go/distbuild/pkg/build"
 	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/persistent"
+	"gitlab.com/slon/shad-go/distbuild/pkg/resources"
+	"gitlab.com/slon/shad-go/distbuild/pkg/retry"
 )
 
+type Config struct {
+	// Sandbox runs commands in linux namespaces, where only declared inputs, dependencies
+	// and output directory of the job are visible and network is not available.
+	// Sandbox re-executes the worker binary, so its main must call sandbox.Init first.
+	Sandbox bool
+
+	// Limits are applied to every job.
+	Limits resources.Limits
+
+	// CgroupRoot is a delegated cgroup v2 directory, each job is placed into its child cgroup.
+	// If it is empty or unusable, limits are approximated with rlimits and CPU limit is not enforced.
+	CgroupRoot string
+
+	// Materialization selects how inputs are presented to the local and sandbox executors.
+	// Inputs are copied by default.
+	Materialization Materialization
+
+	// PersistentWorkers keeps processes of tools supporting persistent mode between jobs.
+	// It is ignored by the sandbox executor.
+	PersistentWorkers bool
+	// PersistentMaxRequests is the number of requests after which persistent process is restarted.
+	// persistent.DefaultMaxRequests is used if it is zero.
+	PersistentMaxRequests int
+
+	// ArtifactStore is the endpoint of the artifact store, e.g. the coordinator, where committed artifacts
+	// are uploaded, so they are available after the worker is lost. Artifacts are not uploaded if it is empty.
+	ArtifactStore string
+
+	// ArtifactLimits and FileLimits bound the worker caches, evicted artifacts are reported to the coordinator.
+	// Caches are not evicted by default.
+	ArtifactLimits artifact.Limits
+	FileLimits     artifact.Limits
+	// EvictionInterval is the period of eviction, DefaultEvictionInterval is used if it is zero.
+	EvictionInterval time.Duration
+
+	// Fsck makes the worker check caches on start, corrupted entries are quarantined.
+	Fsck bool
+
+	// Executor runs commands of jobs. If it is nil, local or sandbox executor is used depending on Sandbox.
+	Executor Executor
+}
+
+const DefaultEvictionInterval = 10 * time.Second
+
 type Worker struct {
 	workerID            api.WorkerID
 	coordinatorEndpoint string
@@ -31,6 +84,21 @@ type Worker struct {
 	client *api.HeartbeatClient
 
 	filesClient *filecache.Client
+	retry       retry.Policy
+
+	executor Executor
+	pool     *persistent.Pool
+	store    string
+
+	artifactLimits, fileLimits artifact.Limits
+	evictionInterval           time.Duration
+	lastEviction               time.Time
+
+	// pinned are artifacts needed by the coordinator as of pinsVersion
+	pinned      map[build.ID]bool
+	pinsVersion int64
+
+	fsck bool
 }
 
 func New(
@@ -39,10 +107,53 @@ func New(
 	log *zap.Logger,
 	fileCache *filecache.Cache,
 	artifacts *artifact.Cache,
+) *Worker {
+	return NewWithConfig(workerID, coordinatorEndpoint, log, fileCache, artifacts, Config{})
+}
+
+func NewWithConfig(
+	workerID api.WorkerID,
+	coordinatorEndpoint string,
+	log *zap.Logger,
+	fileCache *filecache.Cache,
+	artifacts *artifact.Cache,
+	config Config,
 ) *Worker {
 	mux := http.NewServeMux()
 	filecache.NewHandler(log, fileCache).Register(mux)
 	artifact.NewHandler(log, artifacts).Register(mux)
+
+	var pool *persistent.Pool
+	executor := config.Executor
+	if executor == nil {
+		manager := resources.NewRlimitManager(config.Limits)
+		if config.CgroupRoot != "" {
+			cgroups, err := resources.NewCgroupManager(config.CgroupRoot, config.Limits)
+			if err != nil {
+				log.Warn("cgroups are unavailable, falling back to rlimits", zap.Error(err))
+			} else {
+				manager = cgroups
+			}
+		}
+		if limits := config.Limits; !manager.Cgroups() {
+			if limits.CPU > 0 {
+				log.Warn("cpu limit requires cgroup v2 and is not enforced")
+			}
+			if limits.Memory > 0 || limits.Pids > 0 {
+				log.Warn("memory and pids limits are approximated with address space and user process rlimits")
+			}
+		}
+
+		if config.Sandbox {
+			executor = NewSandboxExecutor(log, manager, config.Materialization)
+		} else {
+			if config.PersistentWorkers {
+				pool = persistent.NewPool(log, config.PersistentMaxRequests)
+			}
+			executor = NewLocalExecutor(log, manager, config.Materialization, pool)
+		}
+	}
+
 	return &Worker{
 		workerID,
 		coordinatorEndpoint,
@@ -55,30 +166,198 @@ func New(
 		api.NewHeartbeatClient(log, coordinatorEndpoint),
 
 		filecache.NewClient(log, coordinatorEndpoint),
+		retry.DefaultPolicy,
+
+		executor,
+		pool,
+		config.ArtifactStore,
+
+		config.ArtifactLimits,
+		config.FileLimits,
+		cmp.Or(config.EvictionInterval, DefaultEvictionInterval),
+		time.Time{},
+
+		make(map[build.ID]bool),
+		0,
+
+		config.Fsck,
+	}
+}
+
+// checkCaches quarantines corrupted entries of the caches. Errors are logged, so that the worker starts anyway.
+func (w *Worker) checkCaches() {
+	if !w.fsck {
+		return
+	}
+
+	corrupted, err := w.artifacts.Fsck()
+	if err != nil {
+		w.log.Errorf("artifact cache check failed: %v", err)
+	}
+	for _, id := range corrupted {
+		w.log.Warnf("artifact %v is corrupted, it is quarantined", id)
+	}
+
+	corrupted, err = w.files.Fsck()
+	if err != nil {
+		w.log.Errorf("file cache check failed: %v", err)
+	}
+	for _, id := range corrupted {
+		w.log.Warnf("file %v is corrupted, it is quarantined", id)
 	}
 }
 
+// runFileEviction evicts file cache in background until ctx is done.
+func (w *Worker) runFileEviction(ctx context.Context, wg *sync.WaitGroup) {
+	if !w.fileLimits.Enabled() {
+		return
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		w.files.RunEviction(ctx, w.fileLimits, w.evictionInterval, func(evicted []build.ID, err error) {
+			if err != nil {
+				w.log.Errorf("file eviction failed: %v", err)
+			}
+			if len(evicted) != 0 {
+				w.log.Infof("evicted %v files", len(evicted))
+			}
+		})
+	}()
+}
+
+// evictArtifacts evicts artifact cache if eviction interval passed. It runs right before heartbeat, so that
+// evicted artifacts are reported before the coordinator sends jobs relying on them, e.g. idle worker
+// would report eviction made in background only after it gets the next job.
+func (w *Worker) evictArtifacts() []build.ID {
+	if !w.artifactLimits.Enabled() || time.Since(w.lastEviction) < w.evictionInterval {
+		return nil
+	}
+	w.lastEviction = time.Now()
+
+	evicted, err := w.artifacts.Evict(w.artifactLimits)
+	if err != nil {
+		w.log.Errorf("artifact eviction failed: %v", err)
+	}
+	if len(evicted) != 0 {
+		w.log.Infof("evicted %v artifacts", len(evicted))
+	}
+	return evicted
+}
+
+// pin protects the artifact from eviction until the coordinator tells it is not needed.
+func (w *Worker) pin(id build.ID) {
+	if !w.pinned[id] {
+		w.pinned[id] = true
+		w.artifacts.Pin(id)
+	}
+}
+
+func (w *Worker) unpin(id build.ID) {
+	if w.pinned[id] {
+		delete(w.pinned, id)
+		w.artifacts.Unpin(id)
+	}
+}
+
+// updatePins applies changes of the artifacts needed by the coordinator.
+func (w *Worker) updatePins(resp *api.HeartbeatResponse) {
+	if resp.ResetPins {
+		next := make(map[build.ID]bool, len(resp.PinnedArtifacts))
+		for _, id := range resp.PinnedArtifacts {
+			next[id] = true
+		}
+		for id := range w.pinned {
+			if !next[id] {
+				w.unpin(id)
+			}
+		}
+	}
+	for _, id := range resp.PinnedArtifacts {
+		w.pin(id)
+	}
+	for _, id := range resp.UnpinnedArtifacts {
+		w.unpin(id)
+	}
+	w.pinsVersion = resp.PinsVersion
+}
+
 func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	w.mux.ServeHTTP(rw, r)
 }
 
+// heartbeatInterval is the period of heartbeats while the worker is busy.
+// Idle worker waits for new jobs inside heartbeat request.
+const heartbeatInterval = 100 * time.Millisecond
+
+// slots is the number of jobs executed concurrently.
+const slots = 1
+
+type jobDone struct {
+	res   *api.JobResult
+	added []build.ID
+	// stored is set if the job artifact was uploaded to the artifact store
+	stored bool
+}
+
 func (w *Worker) Run(ctx context.Context) error {
-	runningJobs := make([]build.ID, 0)
-	finishedJobs := make([]api.JobResult, 0)
-	addedArtifacts := make([]build.ID, 0)
+	if w.pool != nil {
+		defer w.pool.Close()
+	}
+
+	w.checkCaches()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	evictionCtx, stopEviction := context.WithCancel(ctx)
+	defer stopEviction()
+	w.runFileEviction(evictionCtx, &wg)
+
+	running := make(map[build.ID]context.CancelFunc)
+	defer func() {
+		for _, cancel := range running {
+			cancel()
+		}
+	}()
+
+	done := make(chan jobDone)
+	var finishedJobs []api.JobResult
+	var addedArtifacts []build.ID
+	var storedArtifacts []build.ID
+
+	collect := func(d jobDone) {
+		delete(running, d.res.ID)
+		if d.res.Error != nil {
+			w.log.Errorf("job %v failed, transient: %v: %v", d.res.ID, d.res.Transient, *d.res.Error)
+		}
+		finishedJobs = append(finishedJobs, *d.res)
+		// dependents of the job may be scheduled before the coordinator pins the artifact,
+		// so it is pinned until the coordinator gets the result
+		w.artifacts.Pin(d.res.ID)
+		addedArtifacts = append(addedArtifacts, d.added...)
+		if d.stored {
+			storedArtifacts = append(storedArtifacts, d.res.ID)
+		}
+	}
 
 	w.log.Debugf("start worker %v", w.workerID)
 
 	for {
 		hbReq := api.HeartbeatRequest{
-			WorkerID:    w.workerID,
-			RunningJobs: runningJobs,
-			FreeSlots:   1,
-			// for now algorithm works only for one slot on every worker
-			// improve scheduling algorithm before change number of clots
+			WorkerID:       w.workerID,
+			RunningJobs:    slices.Collect(maps.Keys(running)),
+			FreeSlots:      slots - len(running),
 			FinishedJob:    finishedJobs,
 			AddedArtifacts: addedArtifacts,
+			PinsVersion:    w.pinsVersion,
+		}
+		if len(storedArtifacts) != 0 {
+			hbReq.StoredArtifacts = storedArtifacts
+			hbReq.ArtifactStore = api.WorkerID(w.store)
 		}
+		hbReq.RemovedArtifacts = w.evictArtifacts()
 
 		resp, err := w.client.Heartbeat(ctx, &hbReq)
 		if err != nil {
@@ -88,160 +367,305 @@ func (w *Worker) Run(ctx context.Context) error {
 
 		finishedJobs = nil
 		addedArtifacts = nil
+		storedArtifacts = nil
 
-		w.log.Infof("%v received %v jobs to run", w.workerID, len(resp.JobsToRun))
-		for _, spec := range resp.JobsToRun {
-
-			w.log.Debugf("start to collect artifacts for job %v on worker %v", spec.ID, w.workerID)
-
-			depsMap := make(map[build.ID]string)
-
-			for artID, workID := range spec.Artifacts {
-				path, unlock, err := w.artifacts.Get(artID)
-				if err != nil { // artifact is not already in local cache
-					err = artifact.Download(ctx, workID.String(), w.artifacts, artID)
-					if err != nil {
-						w.log.Errorf("error during downloading artifact %v for job %v : %v", artID, spec.ID, err)
-						return err
-					}
-					path, unlock, err = w.artifacts.Get(artID)
-					if err != nil { // invariant
-						panic("error in get of just downloaded artifact")
-					}
-				}
-				depsMap[artID] = path
+		w.updatePins(resp)
+		for _, res := range hbReq.FinishedJob {
+			w.artifacts.Unpin(res.ID)
+		}
 
-				defer unlock()
-				addedArtifacts = append(addedArtifacts, artID)
+		for _, id := range resp.CancelJobs {
+			if cancel, ok := running[id]; ok {
+				w.log.Infof("cancel job %v, its duplicate finished first", id)
+				cancel()
 			}
-			w.log.Debugf("artifacts for job %v collected, downloaded %v artifacts", spec.ID, len(spec.Artifacts))
-
-			w.log.Debugf("start to collect source files for job %v on worker %v", spec.ID, w.workerID)
-			for fileID := range spec.SourceFiles {
-				w.log.Debugf("downloading file %v on worker %v", fileID, w.workerID)
-				err := w.filesClient.Download(ctx, w.files, fileID)
-				if err != nil {
-					err = fmt.Errorf("error during downloading file %v: %w", fileID, err)
-					w.log.Error(err.Error())
-					return err
+		}
+
+		w.log.Infof("%v received %v jobs to run", w.workerID, len(resp.JobsToRun))
+		for id, spec := range resp.JobsToRun {
+			jobCtx, cancel := context.WithCancel(ctx)
+			running[id] = cancel
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer cancel()
+
+				d := w.runJob(jobCtx, &spec)
+				select {
+				case done <- d:
+				case <-ctx.Done():
 				}
-			}
-			w.log.Debugf("source files for job %v collected, downloaded %v files", spec.ID, len(spec.SourceFiles))
+			}()
+		}
 
-			w.log.Infof("creating artifact for job %v", spec.ID)
-			path, createArtifactCommit, createArtifactAbort, err := w.artifacts.Create(spec.ID)
-			if err != nil {
-				w.log.Errorf("error during creating artifact %v: %v", spec.ID, err)
-				return err
-			}
+		if len(running) == 0 {
+			continue
+		}
 
-			var bytesOut, bytesErr bytes.Buffer
+		select {
+		case d := <-done:
+			collect(d)
+		case <-time.After(heartbeatInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
 
-			sourceDir, err := os.MkdirTemp("", "")
-			if err != nil {
-				panic(fmt.Sprintf("couldn't create temp dir for execute job spec %v", spec.ID))
-			}
+type timeoutError struct {
+	what    string
+	timeout time.Duration
+}
 
-			unlockFiles := make([]func(), 0, len(spec.SourceFiles))
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.what, e.timeout)
+}
 
-			unlockFilesFunc := func() {
-				for i := len(unlockFiles) - 1; i >= 0; i-- {
-					unlockFiles[i]()
-				}
-			}
+// jobFailed creates result of the job that failed before its commands were run or without exit code.
+func jobFailed(id build.ID, transient bool, err error) *api.JobResult {
+	msg := err.Error()
+	return &api.JobResult{ID: id, ExitCode: -1, Error: &msg, Transient: transient}
+}
 
-			defer unlockFilesFunc()
-			defer os.Remove(sourceDir)
+// downloadDeps downloads missing artifacts of the job dependencies and returns ids of downloaded ones.
+func (w *Worker) downloadDeps(ctx context.Context, spec *api.JobSpec) ([]build.ID, error) {
+	var added []build.ID
+	for artID, workID := range spec.Artifacts {
+		if _, unlock, err := w.artifacts.Get(artID); err == nil {
+			unlock()
+			continue
+		}
 
-			runAbort := func() {
-				abortErr := createArtifactAbort()
-				if abortErr != nil {
-					w.log.Error("couldn't abort creating artifact", zap.Error(abortErr))
-				}
+		endpoints := []string{workID.String()}
+		for _, replica := range spec.ArtifactReplicas[artID] {
+			if replica != workID {
+				endpoints = append(endpoints, replica.String())
 			}
+		}
 
-			for sfID, sfName := range spec.SourceFiles {
-				path, unlock, err := w.files.Get(sfID)
-				if err != nil {
-					w.log.Errorf("error during copying file %v for job spec %v", sfName, spec.ID)
-					runAbort()
-					return err
-				}
-				w.log.Debugf("creating symlink %v --> %v", filepath.Join(sourceDir, sfName), path)
-				symlink := filepath.Join(sourceDir, sfName)
-				sfDir := filepath.Dir(symlink)
-				if sfDir != "" {
-					err = os.MkdirAll(sfDir, 0o755)
-					if err != nil {
-						w.log.Errorf("error during creating dir for symlink %v: %v", symlink, err)
-						runAbort()
-						return err
-					}
-					defer os.Remove(sfDir)
-				}
-				err = os.Symlink(path, symlink)
-				if err != nil {
-					w.log.Errorf("error during creating symlink: %v", err)
-					runAbort()
-					return err
-				}
-				unlockFiles = append(unlockFiles, unlock)
+		if err := artifact.DownloadFromReplicas(ctx, w.retry, endpoints, w.artifacts, artID); err != nil {
+			return added, fmt.Errorf("error during downloading artifact %v: %w", artID, err)
+		}
+		added = append(added, artID)
+	}
+	return added, nil
+}
+
+// dirSize returns total size of files in the directory.
+func dirSize(path string) int64 {
+	var size int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
 			}
+		}
+		return nil
+	})
+	return size
+}
+
+// runJob executes the job and returns its result together with ids of artifacts downloaded to the local cache.
+// Artifact of the successful job is uploaded to the artifact store if it is configured.
+func (w *Worker) runJob(ctx context.Context, spec *api.JobSpec) jobDone {
+	timings := &api.JobTimings{Queued: spec.Queued, Assigned: spec.Assigned, Started: time.Now()}
+	res, added := w.executeJob(ctx, spec, timings)
+	timings.Finished = time.Now()
+	res.Timings = *timings
+
+	d := jobDone{res: res, added: added}
+	if w.store != "" && res.Error == nil && res.ExitCode == 0 {
+		// the artifact stays available from this worker, so failed upload doesn't fail the job
+		if err := artifact.Upload(ctx, w.store, w.artifacts, spec.ID); err != nil {
+			w.log.Warnf("couldn't upload artifact %v to store %v: %v", spec.ID, w.store, err)
+		} else {
+			d.stored = true
+		}
+	}
+	return d
+}
 
-			for _, tmpl := range spec.Cmds {
+func (w *Worker) executeJob(ctx context.Context, spec *api.JobSpec, timings *api.JobTimings) (*api.JobResult, []build.ID) {
+	// timeout covers downloads of the job inputs too, so that a stuck transfer doesn't hold the slot forever
+	jobCtx := ctx
+	if spec.Timeout > 0 {
+		var cancel context.CancelFunc
+		jobCtx, cancel = context.WithTimeoutCause(ctx, spec.Timeout, &timeoutError{"job", spec.Timeout})
+		defer cancel()
+	}
 
-				rendered, err := tmpl.Render(build.JobContext{
-					SourceDir: sourceDir,
-					OutputDir: path,
-					Deps:      depsMap,
-				})
+	w.log.Debugf("start to collect artifacts for job %v on worker %v", spec.ID, w.workerID)
+	start := time.Now()
+	added, err := w.downloadDeps(jobCtx, spec)
+	timings.Artifacts = api.Transfer{Count: len(added), Duration: time.Since(start)}
+	if err != nil {
+		return jobFailed(spec.ID, true, err), added
+	}
 
-				if err != nil {
-					err = fmt.Errorf("error during rendering cmd: %w", err)
-					w.log.Error(err.Error())
-					runAbort()
-					return err
-				}
+	depsMap := make(map[build.ID]string)
+	for artID := range spec.Artifacts {
+		path, unlock, err := w.artifacts.Get(artID)
+		if err != nil {
+			return jobFailed(spec.ID, true, fmt.Errorf("artifact %v disappeared from local cache: %w", artID, err)), added
+		}
+		defer unlock()
+		depsMap[artID] = path
+	}
+	for _, artID := range added {
+		timings.Artifacts.Bytes += dirSize(depsMap[artID])
+	}
+	w.log.Debugf("artifacts for job %v collected, downloaded %v artifacts", spec.ID, len(added))
+
+	w.log.Debugf("start to collect source files for job %v on worker %v", spec.ID, w.workerID)
+	start = time.Now()
+	for fileID := range spec.SourceFiles {
+		if _, unlock, err := w.files.Get(fileID); err == nil {
+			unlock()
+			continue
+		}
 
-				var cmd *exec.Cmd
-				if tmpl.Exec != nil {
+		w.log.Debugf("downloading file %v on worker %v", fileID, w.workerID)
+		if err := w.filesClient.Download(jobCtx, w.files, fileID); err != nil {
+			timings.SourceFiles.Duration = time.Since(start)
+			return jobFailed(spec.ID, true, fmt.Errorf("error during downloading file %v: %w", fileID, err)), added
+		}
+		timings.SourceFiles.Count++
+		if path, unlock, err := w.files.Get(fileID); err == nil {
+			if info, err := os.Stat(path); err == nil {
+				timings.SourceFiles.Bytes += info.Size()
+			}
+			unlock()
+		}
+	}
+	timings.SourceFiles.Duration = time.Since(start)
+	w.log.Debugf("source files for job %v collected, downloaded %v files", spec.ID, timings.SourceFiles.Count)
+
+	w.log.Infof("creating artifact for job %v", spec.ID)
+	path, commit, abort, err := w.artifacts.Create(spec.ID)
+	if errors.Is(err, artifact.ErrExists) {
+		// previous attempt committed the artifact, but its result didn't reach coordinator, the result
+		// is reported as cached, so that coordinator replays the stored one instead of empty output
+		return &api.JobResult{ID: spec.ID, Cached: true}, added
+	} else if err != nil {
+		return jobFailed(spec.ID, true, fmt.Errorf("error during creating artifact %v: %w", spec.ID, err)), added
+	}
 
-					cmd = exec.Command(rendered.Exec[0], rendered.Exec[1:]...)
-					cmd.Env = rendered.Environ
-					cmd.Dir = rendered.WorkingDirectory
-				}
+	committed := false
+	defer func() {
+		if committed {
+			return
+		}
+		if abortErr := abort(); abortErr != nil {
+			w.log.Error("couldn't abort creating artifact", zap.Error(abortErr))
+		}
+	}()
 
-				if tmpl.CatTemplate != "" {
-					cmd = exec.Command("sh", "-c", fmt.Sprintf("printf %q > %q", rendered.CatTemplate, rendered.CatOutput))
-				}
+	sourceFiles := make(map[string]string)
+	for sfID, sfName := range spec.SourceFiles {
+		sfPath, unlock, err := w.files.Get(sfID)
+		if err != nil {
+			return jobFailed(spec.ID, true, fmt.Errorf("error during getting file %v: %w", sfName, err)), added
+		}
+		defer unlock()
+		sourceFiles[sfName] = sfPath
+	}
 
-				w.log.Debugf("cmd: %v", cmd.String())
+	var bytesOut, bytesErr bytes.Buffer
+	var report Report
+	result := func(exitCode int, err error, transient bool) *api.JobResult {
+		res := &api.JobResult{
+			ID:         spec.ID,
+			Stdout:     bytesOut.Bytes(),
+			Stderr:     bytesErr.Bytes(),
+			ExitCode:   exitCode,
+			Transient:  transient,
+			PeakMemory: report.PeakMemory,
+			CPUTime:    report.CPUTime,
+			OOMKilled:  report.OOMKilled,
+		}
+		if err != nil {
+			msg := err.Error()
+			res.Error = &msg
+		}
+		return res
+	}
 
-				cmd.Stderr = &bytesErr
-				cmd.Stdout = &bytesOut
+	report, err = w.executor.Execute(jobCtx, &Execution{
+		ID:          spec.ID,
+		Cmds:        spec.Cmds,
+		SourceFiles: sourceFiles,
+		Deps:        depsMap,
+		OutputDir:   path,
+		Stdout:      &bytesOut,
+		Stderr:      &bytesErr,
+	})
+	timings.Cmds = report.Cmds
+	if err != nil {
+		var timeoutErr *timeoutError
+		if errors.As(err, &timeoutErr) {
+			res := result(-1, err, false)
+			res.TimedOut = true
+			return res, added
+		}
 
-				err = cmd.Run()
-				if err != nil {
-					err = fmt.Errorf("error during cmd %q running: %w", cmd.String(), err)
-					w.log.Error(err.Error())
-					return err
-				}
+		if ctx.Err() != nil {
+			return result(-1, fmt.Errorf("job cancelled: %w", err), true), added
+		}
 
-				w.log.Debugf("err: %v, out: %v", bytesErr.String(), bytesOut.String())
-			}
+		var setupErr *SetupError
+		if errors.As(err, &setupErr) {
+			return result(-1, err, true), added
+		}
 
-			finishedJobs = append(finishedJobs, api.JobResult{
-				ID:       spec.ID,
-				Stdout:   bytesOut.Bytes(),
-				Stderr:   bytesErr.Bytes(),
-				ExitCode: 0,
-			})
-			err = createArtifactCommit()
-			if err != nil {
-				err = fmt.Errorf("couldn't commit artifact creating: %w", err)
-				w.log.Error(err.Error())
-				return err
-			}
+		var exitErr interface{ ExitCode() int }
+		if !errors.As(err, &exitErr) {
+			return result(-1, err, false), added
+		}
+		// kills by the worker are reported above as timeouts and cancellations, so only OOM kills
+		// caused by the host may succeed on retry, the job exceeding its own memory limit would exceed
+		// it again and crashes on other signals are deterministic
+		return result(exitErr.ExitCode(), err, report.OOMKilled && !report.MemoryLimitExceeded), added
+	}
+	w.log.Debugf("job %v finished, err: %v, out: %v", spec.ID, bytesErr.String(), bytesOut.String())
+
+	start = time.Now()
+	err = commit()
+	committed = true
+	timings.Commit = time.Since(start)
+	if errors.Is(err, artifact.ErrExists) {
+		// duplicate of the job committed the same artifact first
+		w.log.Infof("artifact %v was already committed", spec.ID)
+	} else if err != nil {
+		return result(0, fmt.Errorf("couldn't commit artifact creating: %w", err), true), added
+	}
+
+	res := result(0, nil, false)
+	// commit hashes the artifact files into its manifest, outputs are not reported without it
+	if m, err := w.artifacts.Manifest(spec.ID); err != nil {
+		w.log.Warnf("couldn't read manifest of artifact %v: %v", spec.ID, err)
+	} else {
+		res.Outputs = outputFiles(m)
+	}
+	return res, added
+}
+
+// outputFiles lists files of the artifact manifest.
+func outputFiles(m *artifact.Manifest) []api.OutputFile {
+	var outputs []api.OutputFile
+	for _, e := range m.Entries {
+		if e.Mode.IsDir() {
+			continue
 		}
+		outputs = append(outputs, api.OutputFile{
+			Path:       e.Path,
+			Size:       e.Size,
+			Executable: e.Mode&0o111 != 0,
+			Digest:     e.Digest,
+		})
 	}
+	return outputs
 }
@@ -0,0 +1,235 @@
+package worker_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zaptest"
+
+	"gitlab.com/slon/shad-go/distbuild/pkg/api"
+	"gitlab.com/slon/shad-go/distbuild/pkg/artifact"
+	"gitlab.com/slon/shad-go/distbuild/pkg/build"
+	"gitlab.com/slon/shad-go/distbuild/pkg/filecache"
+	"gitlab.com/slon/shad-go/distbuild/pkg/resources"
+	"gitlab.com/slon/shad-go/distbuild/pkg/worker"
+)
+
+// fakeCoordinator hands out jobs one per heartbeat and collects their results.
+type fakeCoordinator struct {
+	jobs    chan api.JobSpec
+	results chan api.JobResult
+}
+
+func (c *fakeCoordinator) Heartbeat(ctx context.Context, req *api.HeartbeatRequest) (*api.HeartbeatResponse, error) {
+	for _, res := range req.FinishedJob {
+		c.results <- res
+	}
+
+	rsp := &api.HeartbeatResponse{JobsToRun: map[build.ID]api.JobSpec{}}
+	select {
+	case spec := <-c.jobs:
+		rsp.JobsToRun[spec.ID] = spec
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+	}
+	return rsp, nil
+}
+
+type env struct {
+	coordinator *fakeCoordinator
+	files       *filecache.Cache
+	artifacts   *artifact.Cache
+	executor    *worker.FakeExecutor
+}
+
+func newEnv(t *testing.T, jobs map[build.ID]worker.FakeJob) *env {
+	log := zaptest.NewLogger(t)
+	tmp := t.TempDir()
+
+	files, err := filecache.New(filepath.Join(tmp, "coordinator"))
+	require.NoError(t, err)
+
+	env := &env{
+		coordinator: &fakeCoordinator{jobs: make(chan api.JobSpec), results: make(chan api.JobResult, 16)},
+		files:       files,
+		executor:    worker.NewFakeExecutor(jobs),
+	}
+
+	mux := http.NewServeMux()
+	api.NewHeartbeatHandler(log, env.coordinator).Register(mux)
+	filecache.NewHandler(log, files).Register(mux)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	workerFiles, err := filecache.New(filepath.Join(tmp, "worker", "files"))
+	require.NoError(t, err)
+	env.artifacts, err = artifact.NewCache(filepath.Join(tmp, "worker", "artifacts"))
+	require.NoError(t, err)
+
+	w := worker.NewWithConfig("worker0", server.URL, log, workerFiles, env.artifacts, worker.Config{Executor: env.executor})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Run(ctx) }()
+	t.Cleanup(func() {
+		cancel()
+		require.ErrorIs(t, <-done, context.Canceled)
+	})
+
+	return env
+}
+
+func (e *env) run(t *testing.T, spec api.JobSpec) api.JobResult {
+	e.coordinator.jobs <- spec
+
+	select {
+	case res := <-e.coordinator.results:
+		require.Equal(t, spec.ID, res.ID)
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("job result is not reported")
+		return api.JobResult{}
+	}
+}
+
+func TestWorkerRunsJob(t *testing.T) {
+	jobID := build.ID{'j'}
+	env := newEnv(t, map[build.ID]worker.FakeJob{
+		jobID: {Stdout: "OK", Outputs: map[string]string{"out.txt": "result"}},
+	})
+
+	fileID := build.ID{'f'}
+	w, _, err := env.files.Write(fileID)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("source"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	res := env.run(t, api.JobSpec{
+		SourceFiles: map[build.ID]string{fileID: "a.txt"},
+		Job:         build.Job{ID: jobID, Name: "fake"},
+	})
+	require.Nil(t, res.Error)
+	require.Equal(t, 0, res.ExitCode)
+	require.Equal(t, "OK", string(res.Stdout))
+
+	require.Equal(t, 1, res.Timings.SourceFiles.Count)
+	require.Equal(t, int64(len("source")), res.Timings.SourceFiles.Bytes)
+	require.Len(t, res.Timings.Cmds, 1)
+	require.False(t, res.Timings.Started.After(res.Timings.Finished))
+
+	require.Len(t, res.Outputs, 1)
+	require.Equal(t, "out.txt", res.Outputs[0].Path)
+	require.Equal(t, int64(len("result")), res.Outputs[0].Size)
+	require.Equal(t, build.Digest(sha256.Sum256([]byte("result"))), res.Outputs[0].Digest)
+
+	path, unlock, err := env.artifacts.Get(jobID)
+	require.NoError(t, err)
+	defer unlock()
+
+	output, err := os.ReadFile(filepath.Join(path, "out.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "result", string(output))
+
+	executions := env.executor.Executions()
+	require.Len(t, executions, 1)
+
+	source, err := os.ReadFile(executions[0].SourceFiles["a.txt"])
+	require.NoError(t, err)
+	require.Equal(t, "source", string(source))
+}
+
+func TestWorkerReportsCommittedArtifactAsCached(t *testing.T) {
+	jobID := build.ID{'j'}
+	env := newEnv(t, map[build.ID]worker.FakeJob{
+		jobID: {Stdout: "OK", Outputs: map[string]string{"out.txt": "result"}},
+	})
+
+	res := env.run(t, api.JobSpec{Job: build.Job{ID: jobID, Name: "fake"}})
+	require.Nil(t, res.Error)
+	require.False(t, res.Cached)
+
+	res = env.run(t, api.JobSpec{Job: build.Job{ID: jobID, Name: "fake"}})
+	require.Nil(t, res.Error)
+	require.True(t, res.Cached, "output of the execution is replayed by coordinator")
+	require.Empty(t, res.Stdout)
+	require.Len(t, env.executor.Executions(), 1)
+}
+
+func TestWorkerReportsFailure(t *testing.T) {
+	jobID := build.ID{'j'}
+	env := newEnv(t, map[build.ID]worker.FakeJob{
+		jobID: {Stderr: "error", ExitCode: 3, Outputs: map[string]string{"out.txt": "partial"}},
+	})
+
+	res := env.run(t, api.JobSpec{Job: build.Job{ID: jobID, Name: "fake"}})
+	require.NotNil(t, res.Error)
+	require.Equal(t, 3, res.ExitCode)
+	require.Equal(t, "error", string(res.Stderr))
+	require.False(t, res.Transient)
+
+	_, _, err := env.artifacts.Get(jobID)
+	require.ErrorIs(t, err, artifact.ErrNotFound)
+}
+
+func TestWorkerReportsCrash(t *testing.T) {
+	crashID, oomID, limitID := build.ID{'c'}, build.ID{'o'}, build.ID{'l'}
+	env := newEnv(t, map[build.ID]worker.FakeJob{
+		crashID: {ExitCode: -1},
+		oomID:   {ExitCode: -1, Usage: resources.Usage{OOMKilled: true}},
+		limitID: {ExitCode: -1, Usage: resources.Usage{OOMKilled: true, MemoryLimitExceeded: true}},
+	})
+
+	res := env.run(t, api.JobSpec{Job: build.Job{ID: crashID, Name: "fake"}})
+	require.Equal(t, -1, res.ExitCode)
+	require.False(t, res.Transient, "crash is deterministic")
+
+	res = env.run(t, api.JobSpec{Job: build.Job{ID: oomID, Name: "fake"}})
+	require.Equal(t, -1, res.ExitCode)
+	require.True(t, res.OOMKilled)
+	require.True(t, res.Transient, "job killed by OOM killer is retried")
+
+	res = env.run(t, api.JobSpec{Job: build.Job{ID: limitID, Name: "fake"}})
+	require.Equal(t, -1, res.ExitCode)
+	require.True(t, res.OOMKilled)
+	require.False(t, res.Transient, "job exceeding its memory limit would exceed it again")
+}
+
+func TestWorkerJobTimeout(t *testing.T) {
+	jobID := build.ID{'j'}
+	env := newEnv(t, map[build.ID]worker.FakeJob{
+		jobID: {Duration: time.Minute},
+	})
+
+	res := env.run(t, api.JobSpec{Job: build.Job{ID: jobID, Name: "fake", Timeout: 10 * time.Millisecond}})
+	require.NotNil(t, res.Error)
+	require.True(t, res.TimedOut)
+	require.Contains(t, *res.Error, "job timed out after 10ms")
+}
+
+func TestWorkerJobTimeoutCoversDownloads(t *testing.T) {
+	jobID := build.ID{'j'}
+	env := newEnv(t, map[build.ID]worker.FakeJob{jobID: {}})
+
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer stuck.Close()
+
+	depID := build.ID{'d'}
+	res := env.run(t, api.JobSpec{
+		Job:       build.Job{ID: jobID, Name: "fake", Deps: []build.ID{depID}, Timeout: 50 * time.Millisecond},
+		Artifacts: map[build.ID]api.WorkerID{depID: api.WorkerID(stuck.URL)},
+	})
+	require.NotNil(t, res.Error)
+	require.True(t, res.Transient, "artifact may be downloaded from other worker")
+	require.Contains(t, *res.Error, depID.String())
+	require.Contains(t, *res.Error, "job timed out after 50ms")
+}